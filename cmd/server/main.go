@@ -1,8 +1,11 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
 	"github.com/rverst/bwof-backend/pkg/server"
 	"os"
 )
@@ -11,5 +14,41 @@ func main() {
 
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 
-	server.Run()
+	configFile := flag.String("config", helper.GetStringEnv(server.EnvConfigFile, ""),
+		"path to a TOML config file, values set in the environment take precedence")
+	printConfig := flag.Bool("print-config", false,
+		"print the effective configuration with secrets redacted and exit")
+	fsck := flag.Bool("fsck", false,
+		"check the database and media directories for inconsistencies and exit, the server must not be running")
+	repair := flag.Bool("repair", false,
+		"with -fsck, regenerate missing thumbnails, rebuild indexes and quarantine orphan files")
+	flag.Parse()
+
+	cfg, err := server.LoadConfig(*configFile)
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("unable to print config")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+
+	log.Logger = cfg.Logger(os.Stdout)
+	if *fsck {
+		ok, err := server.RunFsck(cfg, *repair, os.Stdout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("fsck failed")
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	server.Run(cfg)
 }
@@ -3,6 +3,7 @@ module github.com/rverst/bwof-backend
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/boltdb/bolt v1.3.1
 	github.com/goji/goji v2.0.2+incompatible // indirect
 	github.com/google/uuid v1.1.1
@@ -11,6 +12,7 @@ require (
 	github.com/oliamb/cutter v0.2.2
 	github.com/rs/zerolog v1.19.0
 	goji.io v2.0.2+incompatible
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 	golang.org/x/image v0.0.0-20200801110659-972c09e46d76 // indirect
-	golang.org/x/sys v0.0.0-20200817155316-9781c653f443 // indirect
+	golang.org/x/sys v0.0.0-20200817155316-9781c653f443
 )
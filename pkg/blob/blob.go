@@ -0,0 +1,63 @@
+// Package blob keeps the media files of posts, either in a local directory or
+// in an S3-compatible object storage.
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Info describes a stored blob.
+type Info struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// Store keeps blobs under slash separated keys like `pictures/<id>/orig.jpg`.
+type Store interface {
+	// Put stores size bytes read from r as key, an existing blob is replaced.
+	// Readers never see a partially written blob.
+	Put(key string, r io.Reader, size int64) error
+	// Get opens key or returns ErrNotFound. The reader implements
+	// io.ReadSeeker if the backend supports it.
+	Get(key string) (io.ReadCloser, Info, error)
+	// Delete removes key, it's no error if it doesn't exist.
+	Delete(key string) error
+	// DeletePrefix removes all blobs whose keys start with prefix.
+	DeletePrefix(prefix string) error
+	// List returns all blobs whose keys start with prefix, ordered by key.
+	List(prefix string) ([]Info, error)
+	// Ping checks that the storage is reachable and writable.
+	Ping() error
+}
+
+// Presigner is implemented by stores that can hand out urls which allow
+// downloading a blob directly from the storage for a limited time.
+type Presigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// ContentType guesses the media type of key from its extension.
+func ContentType(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// checkKey rejects keys that aren't clean relative paths.
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key ||
+		key == ".." || strings.HasPrefix(key, "../") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package blob
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FS stores blobs as files below a directory, the key is the relative path.
+// Files and directories whose names start with a dot are ignored, they're
+// used for temporary files.
+type FS struct {
+	root string
+}
+
+// NewFS returns a store that keeps its blobs below root, which must exist.
+func NewFS(root string) (*FS, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &FS{root: root}, nil
+}
+
+func (s *FS) file(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put writes r to a temporary file that replaces key once complete and
+// synced.
+func (s *FS) Put(key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	name := s.file(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0770); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".blob-*")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("%s: wrote %d bytes, expected %d", key, n, size)
+	}
+	if err == nil {
+		// the content has to be on disk before the rename, otherwise a crash
+		// can leave an empty or partial file behind under the final name
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0660)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// Get opens the file of key, the reader is an *os.File.
+func (s *FS) Get(key string) (io.ReadCloser, Info, error) {
+	if err := checkKey(key); err != nil {
+		return nil, Info{}, err
+	}
+	f, err := os.Open(s.file(key))
+	if os.IsNotExist(err) {
+		return nil, Info{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Info{}, err
+	}
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = ErrNotFound
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, Info{}, err
+	}
+	return f, Info{Key: key, Size: fi.Size(), Modified: fi.ModTime()}, nil
+}
+
+func (s *FS) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	err := os.Remove(s.file(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DeletePrefix removes whole directories if prefix ends with a slash.
+func (s *FS) DeletePrefix(prefix string) error {
+	if strings.HasSuffix(prefix, "/") {
+		if err := checkKey(strings.TrimSuffix(prefix, "/")); err != nil {
+			return err
+		}
+		return os.RemoveAll(s.file(prefix))
+	}
+	infos, err := s.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, i := range infos {
+		if err := s.Delete(i.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FS) List(prefix string) ([]Info, error) {
+	// walk the deepest directory that contains all matching keys
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		if err := checkKey(prefix[:i]); err != nil {
+			return nil, err
+		}
+		dir = s.file(prefix[:i])
+	}
+
+	infos := make([]Info, 0)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") && p != dir {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, Info{Key: key, Size: fi.Size(), Modified: fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// Ping creates and removes a temporary file in the root directory.
+func (s *FS) Ping() error {
+	f, err := ioutil.TempFile(s.root, ".ping-")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,291 @@
+package blob
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3 store, only Endpoint and Bucket are required.
+type S3Config struct {
+	// Endpoint is the base url of the service, e.g.
+	// `https://s3.eu-central-1.amazonaws.com` or `http://localhost:9000`.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// AccessKey and SecretKey sign the requests, anonymous requests are
+	// sent if both are empty.
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as first path segment instead of as
+	// subdomain of the endpoint, most self-hosted services need it.
+	PathStyle bool
+	// Prefix is prepended to all keys, it allows sharing a bucket.
+	Prefix string
+}
+
+// S3 stores blobs as objects of a bucket in an S3-compatible object storage.
+type S3 struct {
+	cfg    S3Config
+	base   *url.URL
+	signer signer
+	client *http.Client
+}
+
+// s3Error is the error document returned by the service.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// NewS3 returns a store for the bucket described by cfg, it doesn't contact
+// the service.
+func NewS3(cfg S3Config) (*S3, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint must be a http or https url, got %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket must not be empty")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Prefix = strings.TrimPrefix(cfg.Prefix, "/")
+	if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+
+	base := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: strings.TrimSuffix(u.Path, "/")}
+	if cfg.PathStyle {
+		base.Path += "/" + cfg.Bucket
+	} else {
+		base.Host = cfg.Bucket + "." + u.Host
+	}
+
+	return &S3{
+		cfg:    cfg,
+		base:   base,
+		signer: signer{accessKey: cfg.AccessKey, secretKey: cfg.SecretKey, region: cfg.Region},
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: time.Minute,
+				MaxIdleConnsPerHost:   16,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// url returns the url of the object key, or of the bucket if key is empty.
+func (s *S3) url(key string) *url.URL {
+	u := *s.base
+	if key != "" {
+		u.Path += "/" + s.cfg.Prefix + key
+	} else if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+// do sends a signed request and returns the response if its status is one of
+// ok, otherwise the error sent by the service.
+func (s *S3) do(req *http.Request, payloadHash string, ok ...int) (*http.Response, error) {
+	if s.cfg.AccessKey != "" || s.cfg.SecretKey != "" {
+		s.signer.sign(req, payloadHash, time.Now())
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range ok {
+		if res.StatusCode == c {
+			return res, nil
+		}
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	var e s3Error
+	if b, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10)); err == nil && xml.Unmarshal(b, &e) == nil {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, e.Code, e.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", req.Method, req.URL.Path, res.Status)
+}
+
+// Put uploads r as a single object, S3 makes it visible only once complete.
+func (s *S3) Put(key string, r io.Reader, size int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("%s: s3 requires the size of a blob", key)
+	}
+	req, err := http.NewRequest(http.MethodPut, s.url(key).String(), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", ContentType(key))
+	res, err := s.do(req, sigUnsignedBody, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return res.Body.Close()
+}
+
+// Get streams the object key, the reader doesn't implement io.Seeker.
+func (s *S3) Get(key string) (io.ReadCloser, Info, error) {
+	if err := checkKey(key); err != nil {
+		return nil, Info{}, err
+	}
+	req, err := http.NewRequest(http.MethodGet, s.url(key).String(), nil)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	res, err := s.do(req, sigEmptyBody, http.StatusOK)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info := Info{Key: key, Size: res.ContentLength}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.Modified = t
+	}
+	return res.Body, info, nil
+}
+
+func (s *S3) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodDelete, s.url(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, sigEmptyBody, http.StatusNoContent, http.StatusOK)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *S3) DeletePrefix(prefix string) error {
+	infos, err := s.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, i := range infos {
+		if err := s.Delete(i.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List pages through ListObjectsV2, S3 returns the keys in order.
+func (s *S3) List(prefix string) ([]Info, error) {
+	infos := make([]Info, 0)
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", s.cfg.Prefix+prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u := s.url("")
+		u.RawQuery = canonicalQuery(q)
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req, sigEmptyBody, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var l listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&l)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+		for _, c := range l.Contents {
+			infos = append(infos, Info{
+				Key:      strings.TrimPrefix(c.Key, s.cfg.Prefix),
+				Size:     c.Size,
+				Modified: c.LastModified,
+			})
+		}
+		if !l.IsTruncated || l.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = l.NextContinuationToken
+	}
+}
+
+// Ping checks that the bucket exists and is accessible.
+func (s *S3) Ping() error {
+	req, err := http.NewRequest(http.MethodHead, s.url("").String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, sigEmptyBody, http.StatusOK)
+	if err == ErrNotFound {
+		return fmt.Errorf("s3 bucket %s not found", s.cfg.Bucket)
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// PresignGet returns a url that allows downloading key for ttl, which
+// mustn't exceed seven days.
+func (s *S3) PresignGet(key string, ttl time.Duration) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	if ttl <= 0 || ttl > 7*24*time.Hour {
+		return "", fmt.Errorf("presigned urls must expire within 7 days, got %s", ttl)
+	}
+	if s.cfg.AccessKey == "" && s.cfg.SecretKey == "" {
+		return s.url(key).String(), nil
+	}
+	return s.signer.presign(s.url(key), ttl, time.Now()), nil
+}
+
+// String describes the bucket for logs.
+func (s *S3) String() string {
+	return s.url("").String() + " (" + s.cfg.Region + ")"
+}
@@ -0,0 +1,300 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeBucket    = "media"
+	fakeAccessKey = "AKIDTEST"
+	fakeSecretKey = "secret"
+	fakeRegion    = "eu-test-1"
+	// fakePageSize is the number of keys per page of the fake, small to
+	// force pagination.
+	fakePageSize = 2
+)
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modified    time.Time
+}
+
+// fakeS3 is a path style S3 bucket that checks the signature of every
+// request, presigned ones included.
+type fakeS3 struct {
+	t      *testing.T
+	mu     sync.Mutex
+	objs   map[string]fakeObject
+	lists  int
+	signer signer
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t:      t,
+		objs:   make(map[string]fakeObject),
+		signer: signer{accessKey: fakeAccessKey, secretKey: fakeSecretKey, region: fakeRegion},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.verify(r) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("<Error><Code>SignatureDoesNotMatch</Code><Message>bad signature</Message></Error>"))
+		return
+	}
+	bucketPath := "/" + fakeBucket
+	if r.URL.Path != bucketPath && !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("<Error><Code>NoSuchBucket</Code><Message>no such bucket</Message></Error>"))
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		if int64(len(data)) != r.ContentLength {
+			f.t.Errorf("put %s: got %d bytes, Content-Length %d", key, len(data), r.ContentLength)
+		}
+		f.objs[key] = fakeObject{data: data, contentType: r.Header.Get("Content-Type"), modified: time.Now()}
+	case r.Method == http.MethodGet:
+		o, ok := f.objs[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", o.contentType)
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		_, _ = w.Write(o.data)
+	case r.Method == http.MethodDelete:
+		delete(f.objs, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list answers ListObjectsV2, the continuation token is the last key of the
+// previous page.
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	f.lists++
+	if q.Get("list-type") != "2" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	keys := make([]string, 0)
+	for k := range f.objs {
+		if strings.HasPrefix(k, q.Get("prefix")) && k > q.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var res listBucketResult
+	if len(keys) > fakePageSize {
+		keys = keys[:fakePageSize]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		res.Contents = append(res.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{k, int64(len(f.objs[k].data)), f.objs[k].modified})
+	}
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+// verify signs a copy of r again and compares the signatures.
+func (f *fakeS3) verify(r *http.Request) bool {
+	q := r.URL.Query()
+	if sig := q.Get("X-Amz-Signature"); sig != "" {
+		t, err := time.Parse(sigDateFormat, q.Get("X-Amz-Date"))
+		if err != nil {
+			return false
+		}
+		expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || time.Now().After(t.Add(time.Duration(expires)*time.Second)) {
+			return false
+		}
+		q.Del("X-Amz-Signature")
+		u := &url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: q.Encode()}
+		p, err := url.Parse(f.signer.presign(u, time.Duration(expires)*time.Second, t))
+		return err == nil && p.Query().Get("X-Amz-Signature") == sig
+	}
+
+	auth := r.Header.Get("Authorization")
+	i := strings.Index(auth, "SignedHeaders=")
+	if i < 0 {
+		return false
+	}
+	signed := strings.Split(strings.SplitN(auth[i+len("SignedHeaders="):], ",", 2)[0], ";")
+	t, err := time.Parse(sigDateFormat, r.Header.Get(headerDate))
+	if err != nil {
+		return false
+	}
+	c, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for _, h := range signed {
+		if h != "host" {
+			c.Header[http.CanonicalHeaderKey(h)] = r.Header.Values(h)
+		}
+	}
+	f.signer.sign(c, r.Header.Get(headerContentHash), t)
+	return c.Header.Get("Authorization") == auth
+}
+
+func newTestS3(t *testing.T, endpoint, secret string) *S3 {
+	s, err := NewS3(S3Config{
+		Endpoint:  endpoint,
+		Region:    fakeRegion,
+		Bucket:    fakeBucket,
+		AccessKey: fakeAccessKey,
+		SecretKey: secret,
+		PathStyle: true,
+		Prefix:    "bwof",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestS3(t *testing.T) {
+	f, srv := newFakeS3(t)
+	s := newTestS3(t, srv.URL, fakeSecretKey)
+
+	if err := s.Ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	files := map[string]string{
+		"pictures/a/orig.jpg":        "original",
+		"pictures/a/thumb.jpg":       "thumbnail",
+		"pictures/b/w640 (1)+ä.png":  "rendition",
+		"pictures/b/orig.png":        "",
+		"instagram/c/thumb.jpg":      "instagram",
+		"pictures/a/crop_w1280.jpeg": "crop",
+	}
+	for k, v := range files {
+		if err := s.Put(k, strings.NewReader(v), int64(len(v))); err != nil {
+			t.Fatalf("put %s: %v", k, err)
+		}
+	}
+	if o := f.objs["bwof/pictures/a/orig.jpg"]; o.contentType != "image/jpeg" {
+		t.Errorf("content type of put: got %q, want image/jpeg", o.contentType)
+	}
+
+	for k, v := range files {
+		rc, info, err := s.Get(k)
+		if err != nil {
+			t.Errorf("get %s: %v", k, err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if string(b) != v || info.Size != int64(len(v)) || info.Key != k || info.Modified.IsZero() {
+			t.Errorf("get %s: got %q %+v, want %q", k, b, info, v)
+		}
+	}
+	if _, _, err := s.Get("pictures/missing"); err != ErrNotFound {
+		t.Errorf("get of missing object: got %v, want ErrNotFound", err)
+	}
+
+	f.lists = 0
+	infos, err := s.List("pictures/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(infos))
+	for i, info := range infos {
+		keys[i] = info.Key
+	}
+	want := []string{"pictures/a/crop_w1280.jpeg", "pictures/a/orig.jpg", "pictures/a/thumb.jpg",
+		"pictures/b/orig.png", "pictures/b/w640 (1)+ä.png"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("list: got %v, want %v", keys, want)
+	}
+	if f.lists != 3 {
+		t.Errorf("list: got %d requests, want 3 pages", f.lists)
+	}
+
+	u, err := s.PresignGet("pictures/b/w640 (1)+ä.png", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(b) != "rendition" {
+		t.Errorf("presigned get: got %d %q, want 200 rendition", res.StatusCode, b)
+	}
+	tampered := strings.Replace(u, "X-Amz-Expires=60", "X-Amz-Expires=600", 1)
+	if res, err := http.Get(tampered); err != nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("tampered presigned get: got %v %v, want 403", res, err)
+	} else {
+		_ = res.Body.Close()
+	}
+
+	if err := s.Delete("pictures/a/orig.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("pictures/a/orig.jpg"); err != nil {
+		t.Errorf("delete of missing object: %v", err)
+	}
+	if err := s.DeletePrefix("pictures/"); err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := s.List(""); err != nil || len(infos) != 1 || infos[0].Key != "instagram/c/thumb.jpg" {
+		t.Errorf("list after delete: got %+v %v, want only the instagram thumbnail", infos, err)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	_, srv := newFakeS3(t)
+
+	s := newTestS3(t, srv.URL, "wrong")
+	err := s.Put("pictures/a/orig.jpg", bytes.NewReader([]byte("x")), 1)
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("put with wrong key: got %v, want the error of the service", err)
+	}
+
+	s, err = NewS3(S3Config{Endpoint: srv.URL, Bucket: "other", AccessKey: fakeAccessKey,
+		SecretKey: fakeSecretKey, Region: fakeRegion, PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(); err == nil {
+		t.Error("ping of missing bucket: got no error")
+	}
+	if _, err := s.PresignGet("pictures/a", 8*24*time.Hour); err == nil {
+		t.Error("presign for more than 7 days: got no error")
+	}
+}
@@ -0,0 +1,157 @@
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS signature version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	sigAlgorithm      = "AWS4-HMAC-SHA256"
+	sigService        = "s3"
+	sigDateFormat     = "20060102T150405Z"
+	sigUnsignedBody   = "UNSIGNED-PAYLOAD"
+	sigEmptyBody      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	headerContentHash = "X-Amz-Content-Sha256"
+	headerDate        = "X-Amz-Date"
+)
+
+type signer struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+func (s signer) scope(t time.Time) string {
+	return strings.Join([]string{t.Format("20060102"), s.region, sigService, "aws4_request"}, "/")
+}
+
+// sign adds the Authorization header to req, payloadHash is the hex encoded
+// sha256 of the body or sigUnsignedBody.
+func (s signer) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set(headerDate, t.Format(sigDateFormat))
+	req.Header.Set(headerContentHash, payloadHash)
+
+	names := []string{"host"}
+	for k := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-type" || k == "content-md5" || k == "range" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	headers := make([]string, len(names))
+	for i, k := range names {
+		v := req.Host
+		if k != "host" {
+			v = strings.Join(req.Header.Values(k), ",")
+		} else if v == "" {
+			v = req.URL.Host
+		}
+		headers[i] = k + ":" + strings.TrimSpace(v)
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		strings.Join(headers, "\n") + "\n",
+		signed,
+		payloadHash,
+	}, "\n")
+	sig := s.signature(t, canonical)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigAlgorithm, s.accessKey, s.scope(t), signed, sig))
+}
+
+// presign returns u with the query parameters that authorize a GET request
+// until t plus ttl.
+func (s signer) presign(u *url.URL, ttl time.Duration, t time.Time) string {
+	t = t.UTC()
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", sigAlgorithm)
+	q.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(t))
+	q.Set("X-Amz-Date", t.Format(sigDateFormat))
+	q.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(ttl/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		sigUnsignedBody,
+	}, "\n")
+	q.Set("X-Amz-Signature", s.signature(t, canonical))
+
+	p := *u
+	p.RawQuery = canonicalQuery(q)
+	return p.String()
+}
+
+func (s signer) signature(t time.Time, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{sigAlgorithm, t.Format(sigDateFormat), s.scope(t),
+		hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSum([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	key = hmacSum(key, s.region)
+	key = hmacSum(key, sigService)
+	key = hmacSum(key, "aws4_request")
+	return hex.EncodeToString(hmacSum(key, toSign))
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes q sorted by name and value.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(q))
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything but the unreserved characters of RFC 3986,
+// slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
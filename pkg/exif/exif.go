@@ -0,0 +1,311 @@
+// Package exif reads the few EXIF tags of JPEG and PNG files that matter for
+// the wall, the orientation and when and with which camera a photo was taken,
+// without depending on a full EXIF library. Everything else, e.g. the GPS
+// position, is skipped.
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Tags that are read.
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+	tagOffsetOriginal   = 0x9011
+)
+
+const (
+	typeASCII = 2
+	typeShort = 3
+	typeLong  = 4
+
+	// maxSegment limits how much of a file is read as EXIF block.
+	maxSegment = 1 << 20
+	// maxEntries limits the entries of a directory, real files have a few
+	// dozens.
+	maxEntries = 1000
+
+	dateFormat = "2006:01:02 15:04:05"
+)
+
+var (
+	// ErrNotFound is returned if a file has no EXIF block.
+	ErrNotFound = errors.New("no exif data")
+	// ErrInvalid is returned if the EXIF block can't be parsed.
+	ErrInvalid = errors.New("invalid exif data")
+
+	exifHeader = []byte("Exif\x00\x00")
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// Data are the tags read from a file.
+type Data struct {
+	// Orientation is how the image has to be transformed to be upright, see
+	// Orient. It's 1 if the tag is missing.
+	Orientation int
+	Make        string
+	Model       string
+	// Taken is when the photo was taken, in UTC if the camera didn't record
+	// its time zone, or the zero time if unknown.
+	Taken time.Time
+}
+
+// Read reads the EXIF block of the JPEG or PNG file r, it stops at the image
+// data and reads no further.
+func Read(r io.Reader) (*Data, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(pngHeader))
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	var block []byte
+	switch {
+	case head[0] == 0xff && head[1] == 0xd8:
+		block, err = jpegBlock(br)
+	case bytes.Equal(head, pngHeader):
+		block, err = pngBlock(br)
+	default:
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parse(block)
+}
+
+// jpegBlock returns the TIFF structure of the APP1 segment of the JPEG r.
+func jpegBlock(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.Discard(2); err != nil {
+		return nil, ErrNotFound
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrNotFound
+		}
+		if b != 0xff {
+			return nil, ErrInvalid
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff {
+			// fill bytes
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return nil, ErrNotFound
+		}
+		switch {
+		case marker == 0xda || marker == 0xd9:
+			// start of scan or end of image, no exif before the image data
+			return nil, ErrNotFound
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// markers without length
+			continue
+		}
+
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil || n < 2 {
+			return nil, ErrInvalid
+		}
+		size := int64(n) - 2
+		if marker != 0xe1 {
+			if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+				return nil, ErrNotFound
+			}
+			continue
+		}
+		seg := make([]byte, size)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return nil, ErrInvalid
+		}
+		// APP1 is used by XMP as well
+		if bytes.HasPrefix(seg, exifHeader) {
+			return seg[len(exifHeader):], nil
+		}
+	}
+}
+
+// pngBlock returns the content of the eXIf chunk of the PNG r.
+func pngBlock(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.Discard(len(pngHeader)); err != nil {
+		return nil, ErrNotFound
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, ErrNotFound
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch string(hdr[4:]) {
+		case "IDAT", "IEND":
+			return nil, ErrNotFound
+		case "eXIf":
+			if size > maxSegment {
+				return nil, ErrInvalid
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return nil, ErrInvalid
+			}
+			// some writers keep the header of the JPEG segment
+			return bytes.TrimPrefix(chunk, exifHeader), nil
+		}
+		// the data and the crc
+		if _, err := io.CopyN(ioutil.Discard, r, size+4); err != nil {
+			return nil, ErrNotFound
+		}
+	}
+}
+
+// tiff is the TIFF structure of an EXIF block.
+type tiff struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+// entry is a field of an image file directory.
+type entry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// parse reads the tags from the TIFF structure b.
+func parse(b []byte) (*Data, error) {
+	if len(b) < 8 {
+		return nil, ErrInvalid
+	}
+	t := &tiff{buf: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrInvalid
+	}
+	if t.order.Uint16(b[2:]) != 42 {
+		return nil, ErrInvalid
+	}
+
+	ifd0, err := t.directory(t.order.Uint32(b[4:]))
+	if err != nil {
+		return nil, err
+	}
+	d := &Data{
+		Orientation: 1,
+		Make:        t.string(ifd0[tagMake]),
+		Model:       t.string(ifd0[tagModel]),
+	}
+	if o := t.uint(ifd0[tagOrientation]); o >= 1 && o <= 8 {
+		d.Orientation = int(o)
+	}
+
+	date := t.string(ifd0[tagDateTime])
+	offset := ""
+	if e, ok := ifd0[tagExifIFD]; ok {
+		// a broken sub directory leaves the tags of the main one
+		if sub, err := t.directory(t.uint(e)); err == nil {
+			if s := t.string(sub[tagDateTimeOriginal]); s != "" {
+				date = s
+			}
+			offset = t.string(sub[tagOffsetOriginal])
+		}
+	}
+	d.Taken = parseDate(date, offset)
+	return d, nil
+}
+
+// directory returns the entries of the image file directory at offset.
+func (t *tiff) directory(offset uint32) (map[uint16]entry, error) {
+	if offset == 0 || int64(offset)+2 > int64(len(t.buf)) {
+		return nil, ErrInvalid
+	}
+	n := int(t.order.Uint16(t.buf[offset:]))
+	if n > maxEntries || int64(offset)+2+int64(n)*12 > int64(len(t.buf)) {
+		return nil, ErrInvalid
+	}
+
+	entries := make(map[uint16]entry, n)
+	for i := 0; i < n; i++ {
+		raw := t.buf[int(offset)+2+i*12:][:12]
+		e := entry{typ: t.order.Uint16(raw[2:]), count: t.order.Uint32(raw[4:])}
+		var size int64
+		switch e.typ {
+		case typeASCII:
+			size = 1
+		case typeShort:
+			size = 2
+		case typeLong:
+			size = 4
+		default:
+			// not a type of the tags that are read
+			continue
+		}
+		size *= int64(e.count)
+		if size <= 4 {
+			e.value = raw[8 : 8+size]
+		} else {
+			start := int64(t.order.Uint32(raw[8:]))
+			if start+size > int64(len(t.buf)) {
+				continue
+			}
+			e.value = t.buf[start : start+size]
+		}
+		entries[t.order.Uint16(raw)] = e
+	}
+	return entries, nil
+}
+
+// uint returns the first value of a short or long entry, or 0.
+func (t *tiff) uint(e entry) uint32 {
+	switch {
+	case e.typ == typeShort && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value))
+	case e.typ == typeLong && len(e.value) >= 4:
+		return t.order.Uint32(e.value)
+	}
+	return 0
+}
+
+// string returns the value of an ASCII entry without the terminating and
+// padding zeros and spaces, or an empty string.
+func (t *tiff) string(e entry) string {
+	if e.typ != typeASCII {
+		return ""
+	}
+	if i := bytes.IndexByte(e.value, 0); i >= 0 {
+		e.value = e.value[:i]
+	}
+	return strings.TrimSpace(string(e.value))
+}
+
+// parseDate parses an EXIF date with the offset to UTC like "+02:00", if
+// known. It returns the zero time if date is missing or invalid.
+func parseDate(date, offset string) time.Time {
+	if date == "" {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse(dateFormat+"-07:00", date+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.Parse(dateFormat, date)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
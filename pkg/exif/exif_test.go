@@ -0,0 +1,203 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// field is an entry of a directory built by buildTIFF, value is a string,
+// uint16 or uint32.
+type field struct {
+	tag   uint16
+	value interface{}
+}
+
+// buildTIFF returns the TIFF structure of an EXIF block with the entries of
+// ifd0 and, if not nil, of the EXIF sub directory.
+func buildTIFF(order binary.ByteOrder, ifd0, sub []field) []byte {
+	dirSize := func(fs []field) int { return 2 + 12*len(fs) + 4 }
+	if sub != nil {
+		ifd0 = append(ifd0, field{tagExifIFD, uint32(0)})
+	}
+	subOffset := 8 + dirSize(ifd0)
+	dataOffset := subOffset
+	if sub != nil {
+		ifd0[len(ifd0)-1].value = uint32(subOffset)
+		dataOffset += dirSize(sub)
+	}
+
+	var data []byte
+	dir := func(fs []field) []byte {
+		b := make([]byte, dirSize(fs))
+		order.PutUint16(b, uint16(len(fs)))
+		for i, f := range fs {
+			raw := b[2+i*12:][:12]
+			order.PutUint16(raw, f.tag)
+			switch v := f.value.(type) {
+			case string:
+				s := append([]byte(v), 0)
+				order.PutUint16(raw[2:], typeASCII)
+				order.PutUint32(raw[4:], uint32(len(s)))
+				if len(s) <= 4 {
+					copy(raw[8:], s)
+				} else {
+					order.PutUint32(raw[8:], uint32(dataOffset+len(data)))
+					data = append(data, s...)
+				}
+			case uint16:
+				order.PutUint16(raw[2:], typeShort)
+				order.PutUint32(raw[4:], 1)
+				order.PutUint16(raw[8:], v)
+			case uint32:
+				order.PutUint16(raw[2:], typeLong)
+				order.PutUint32(raw[4:], 1)
+				order.PutUint32(raw[8:], v)
+			}
+		}
+		return b
+	}
+
+	b := []byte("II")
+	if order == binary.BigEndian {
+		b = []byte("MM")
+	}
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], 8)
+	b = append(b, dir(ifd0)...)
+	if sub != nil {
+		b = append(b, dir(sub)...)
+	}
+	return append(b, data...)
+}
+
+// jpegFile returns a JPEG head with the APP1 segments segs, followed by the
+// start of the image data.
+func jpegFile(segs ...[]byte) []byte {
+	b := []byte{0xff, 0xd8}
+	for _, s := range segs {
+		b = append(b, 0xff, 0xe1, byte((len(s)+2)>>8), byte(len(s)+2))
+		b = append(b, s...)
+	}
+	return append(b, 0xff, 0xda, 0x00, 0x02)
+}
+
+// pngFile returns a PNG head with the eXIf chunk exif.
+func pngFile(exif []byte) []byte {
+	chunk := func(typ string, data []byte) []byte {
+		c := make([]byte, 4, 12+len(data))
+		binary.BigEndian.PutUint32(c, uint32(len(data)))
+		c = append(append(c, typ...), data...)
+		return append(c, 0, 0, 0, 0)
+	}
+	b := append([]byte(nil), pngHeader...)
+	b = append(b, chunk("IHDR", make([]byte, 13))...)
+	b = append(b, chunk("eXIf", exif)...)
+	return append(b, chunk("IEND", nil)...)
+}
+
+func app1(tiff []byte) []byte {
+	return append(append([]byte(nil), exifHeader...), tiff...)
+}
+
+func TestRead(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	camera := []field{
+		{tagMake, "Canon"},
+		{tagModel, "EOS 5D"},
+		{tagOrientation, uint16(6)},
+		{tagDateTime, "2020:01:02 03:04:05"},
+	}
+	original := []field{
+		{tagDateTimeOriginal, "2019:05:06 07:08:09"},
+		{tagOffsetOriginal, "+02:00"},
+	}
+	taken := time.Date(2019, 5, 6, 7, 8, 9, 0, time.FixedZone("", 2*60*60))
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// a header whose first directory has more entries than the block
+	overflow := buildTIFF(le, nil, nil)
+	le.PutUint16(overflow[8:], 50)
+	// a Make whose value lies behind the end of the block
+	outside := buildTIFF(le, []field{{tagMake, "Nikon Corporation"}}, nil)
+	outside = outside[:len(outside)-4]
+	// an EXIF sub directory behind the end of the block
+	broken := buildTIFF(le, []field{{tagDateTime, "2020:01:02 03:04:05"}, {tagExifIFD, uint32(4096)}}, nil)
+
+	tests := []struct {
+		name string
+		file []byte
+		want *Data
+		err  error
+	}{
+		{"little endian", jpegFile(app1(buildTIFF(le, camera, original))),
+			&Data{Orientation: 6, Make: "Canon", Model: "EOS 5D", Taken: taken}, nil},
+		{"big endian", jpegFile(app1(buildTIFF(be, camera, original))),
+			&Data{Orientation: 6, Make: "Canon", Model: "EOS 5D", Taken: taken}, nil},
+		{"date without offset", jpegFile(app1(buildTIFF(le, camera, nil))),
+			&Data{Orientation: 6, Make: "Canon", Model: "EOS 5D", Taken: modified}, nil},
+		{"orientation as long", jpegFile(app1(buildTIFF(be, []field{{tagOrientation, uint32(8)}}, nil))),
+			&Data{Orientation: 8}, nil},
+		{"orientation out of range", jpegFile(app1(buildTIFF(le, []field{{tagOrientation, uint16(9)}}, nil))),
+			&Data{Orientation: 1}, nil},
+		{"padded strings", jpegFile(app1(buildTIFF(le, []field{{tagMake, "Apple  "}, {tagModel, "X"}}, nil))),
+			&Data{Orientation: 1, Make: "Apple", Model: "X"}, nil},
+		{"invalid date", jpegFile(app1(buildTIFF(le, []field{{tagDateTime, "yesterday"}}, nil))),
+			&Data{Orientation: 1}, nil},
+		{"xmp before exif", jpegFile([]byte("http://ns.adobe.com/xap/1.0/\x00<x/>"), app1(buildTIFF(le, camera, nil))),
+			&Data{Orientation: 6, Make: "Canon", Model: "EOS 5D", Taken: modified}, nil},
+		{"png", pngFile(buildTIFF(be, camera, original)),
+			&Data{Orientation: 6, Make: "Canon", Model: "EOS 5D", Taken: taken}, nil},
+		{"png with segment header", pngFile(app1(buildTIFF(le, camera, original))),
+			&Data{Orientation: 6, Make: "Canon", Model: "EOS 5D", Taken: taken}, nil},
+		{"value outside of the block", jpegFile(app1(outside)), &Data{Orientation: 1}, nil},
+		{"broken sub directory", jpegFile(app1(broken)), &Data{Orientation: 1, Taken: modified}, nil},
+
+		{"empty", nil, nil, ErrNotFound},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), nil, ErrNotFound},
+		{"jpeg without exif", jpegFile(), nil, ErrNotFound},
+		{"xmp only", jpegFile([]byte("http://ns.adobe.com/xap/1.0/\x00<x/>")), nil, ErrNotFound},
+		{"truncated length", []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x02, 0xff, 0xe1, 0x00}, nil, ErrInvalid},
+		{"truncated segment", []byte("\xff\xd8\xff\xe1\x00\x40Exif\x00\x00II*\x00"), nil, ErrInvalid},
+		{"segment length below 2", []byte("\xff\xd8\xff\xe1\x00\x01Exif\x00\x00"), nil, ErrInvalid},
+		{"garbage instead of marker", []byte("\xff\xd8\x00\x00\x00\x00\x00\x00"), nil, ErrInvalid},
+		{"short tiff", jpegFile(app1([]byte("II*\x00"))), nil, ErrInvalid},
+		{"unknown byte order", jpegFile(app1([]byte("XX*\x00\x08\x00\x00\x00\x00\x00"))), nil, ErrInvalid},
+		{"wrong magic", jpegFile(app1([]byte("II+\x00\x08\x00\x00\x00\x00\x00"))), nil, ErrInvalid},
+		{"directory outside of the block", jpegFile(app1([]byte("II*\x00\x00\x10\x00\x00"))), nil, ErrInvalid},
+		{"directory without offset", jpegFile(app1([]byte("II*\x00\x00\x00\x00\x00"))), nil, ErrInvalid},
+		{"too many entries", jpegFile(app1(overflow)), nil, ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Read(bytes.NewReader(tt.file))
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("got %+v, want nil", got)
+				}
+				return
+			}
+			if got.Orientation != tt.want.Orientation || got.Make != tt.want.Make ||
+				got.Model != tt.want.Model || !got.Taken.Equal(tt.want.Taken) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadStopsAtImageData(t *testing.T) {
+	file := append(jpegFile(app1(buildTIFF(binary.LittleEndian, []field{{tagOrientation, uint16(3)}}, nil))),
+		bytes.Repeat([]byte{0x42}, 1<<16)...)
+	r := bytes.NewReader(file)
+	if _, err := Read(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() == 0 {
+		t.Error("read the whole file, want to stop at the image data")
+	}
+}
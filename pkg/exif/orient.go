@@ -0,0 +1,49 @@
+package exif
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Orient returns img transformed as the EXIF orientation requires to be
+// upright, img itself is returned for 1 and unknown values.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		// 5 to 8 swap width and height
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotate by 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertically
+				dx, dy = x, h-1-y
+			case 5: // mirror along the top left to bottom right diagonal
+				dx, dy = y, x
+			case 6: // rotate by 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirror along the top right to bottom left diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate by 90° counterclockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,64 @@
+package exif
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOrient(t *testing.T) {
+	// the pixels of a 3x2 image, each labelled by its red value
+	//
+	//	a b c
+	//	d e f
+	const a, b, c, d, e, f = 10, 20, 30, 40, 50, 60
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i, v := range []uint8{a, b, c, d, e, f} {
+		src.SetNRGBA(i%3, i/3, color.NRGBA{R: v, A: 255})
+	}
+
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{0, [][]uint8{{a, b, c}, {d, e, f}}},
+		{1, [][]uint8{{a, b, c}, {d, e, f}}},
+		{2, [][]uint8{{c, b, a}, {f, e, d}}},
+		{3, [][]uint8{{f, e, d}, {c, b, a}}},
+		{4, [][]uint8{{d, e, f}, {a, b, c}}},
+		{5, [][]uint8{{a, d}, {b, e}, {c, f}}},
+		{6, [][]uint8{{d, a}, {e, b}, {f, c}}},
+		{7, [][]uint8{{f, c}, {e, b}, {d, a}}},
+		{8, [][]uint8{{c, f}, {b, e}, {a, d}}},
+		{9, [][]uint8{{a, b, c}, {d, e, f}}},
+	}
+	for _, tt := range tests {
+		img := Orient(src, tt.orientation)
+		bounds := img.Bounds()
+		if bounds.Dx() != len(tt.want[0]) || bounds.Dy() != len(tt.want) {
+			t.Errorf("orientation %d: got size %dx%d, want %dx%d", tt.orientation,
+				bounds.Dx(), bounds.Dy(), len(tt.want[0]), len(tt.want))
+			continue
+		}
+		for y, row := range tt.want {
+			for x, v := range row {
+				if got := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA); got.R != v {
+					t.Errorf("orientation %d: got %d at %d,%d, want %d", tt.orientation, got.R, x, y, v)
+				}
+			}
+		}
+	}
+}
+
+func TestOrientOffsetBounds(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(5, 5, 7, 6))
+	src.SetNRGBA(5, 5, color.NRGBA{R: 1, A: 255})
+	src.SetNRGBA(6, 5, color.NRGBA{R: 2, A: 255})
+	img := Orient(src, 6)
+	if img.Bounds() != image.Rect(0, 0, 1, 2) {
+		t.Fatalf("got bounds %v, want (0,0)-(1,2)", img.Bounds())
+	}
+	if r, _, _, _ := img.At(0, 1).RGBA(); r>>8 != 2 {
+		t.Errorf("got red %d at 0,1, want 2", r>>8)
+	}
+}
@@ -0,0 +1,8 @@
+package helper
+
+import "fmt"
+
+// FreeDiskSpace isn't implemented on windows.
+func FreeDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("free disk space not supported on windows")
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Number of\nrequests.", "method", "path")
+	c.Inc("GET", "/")
+	c.Add(2, "GET", `/a"b\c`)
+	c.Add(-1, "GET", "/")
+	h := r.NewHistogramVec("test_duration_seconds", "Duration.", []float64{1, 0.5}, "op")
+	h.Observe(0.25, "read")
+	h.Observe(0.75, "read")
+	h.Observe(3, "read")
+	r.NewGaugeFunc("test_temperature", "Temperature.", func() float64 { return math.Inf(-1) })
+	r.NewCounterFunc("test_bytes_total", "Bytes.", func() float64 { return 1.5e9 })
+
+	want := `# HELP test_requests_total Number of\nrequests.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",path="/"} 1
+test_requests_total{method="GET",path="/a\"b\\c"} 2
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="read",le="0.5"} 1
+test_duration_seconds_bucket{op="read",le="1"} 2
+test_duration_seconds_bucket{op="read",le="+Inf"} 3
+test_duration_seconds_sum{op="read"} 4
+test_duration_seconds_count{op="read"} 3
+# HELP test_temperature Temperature.
+# TYPE test_temperature gauge
+test_temperature -Inf
+# HELP test_bytes_total Bytes.
+# TYPE test_bytes_total counter
+test_bytes_total 1.5e+09
+`
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("WriteTo:\n%s\nwant:\n%s", got, want)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo: returned %d bytes, wrote %d", n, buf.Len())
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type: got %q, want %q", ct, ContentType)
+	}
+	if want := "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 1\n"; w.Body.String() != want {
+		t.Errorf("body: got %q, want %q", w.Body.String(), want)
+	}
+}
+
+func TestCounterVecLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Inc with missing label value: no panic")
+		}
+	}()
+	NewRegistry().NewCounterVec("test_total", "Test.", "a", "b").Inc("x")
+}
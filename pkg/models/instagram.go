@@ -23,6 +23,8 @@ type Instagram struct {
   Id              uuid.UUID       `json:"id"`
   Edited          time.Time       `json:"edited"`
   Disabled        bool            `json:"disabled"`
+  DeletedAt       time.Time       `json:"deleted_at"`
+  DeletedBy       string          `json:"deleted_by"`
   PostUrl         string          `json:"post_url"`
   ThumbnailBounds image.Rectangle `json:"thumbnail_bounds"`
   ThumbnailPath   string          `json:"thumbnail_path"`
@@ -30,4 +32,5 @@ type Instagram struct {
   Uploaded        time.Time       `json:"uploaded"`
   Uploader        string          `json:"uploader"`
   Data            InstaData       `json:"data"`
+  Version         int             `json:"version"`
 }
@@ -12,11 +12,16 @@ type Picture struct {
 	CroppedBounds    image.Rectangle `json:"cropped_bounds"`
 	CroppedPath      string          `json:"crop_path"`
 	CroppedUrl       string          `json:"cropped_url"`
+	DeletedAt        time.Time       `json:"deleted_at"`
+	DeletedBy        string          `json:"deleted_by"`
 	Disabled         bool            `json:"disabled"`
 	Edited           time.Time       `json:"edited"`
+	Hash             string          `json:"hash,omitempty"`
+	Metadata         Metadata        `json:"metadata"`
 	OriginalBounds   image.Rectangle `json:"original_bounds"`
 	OriginalPath     string          `json:"original_path"`
 	OriginalUrl      string          `json:"original_url"`
+	Renditions       []Rendition     `json:"renditions"`
 	ThumbnailPath    string          `json:"thumbnail_path"`
 	ThumbnailUrl     string          `json:"thumbnail_url"`
 	ThumbCroppedPath string          `json:"thumb_crop_path"`
@@ -26,9 +31,38 @@ type Picture struct {
 	UploadedFilename string          `json:"uploaded_filename"`
 	Uploader         string          `json:"uploader"`
 	UseCropped       bool            `json:"useCropped"`
+	Version          int             `json:"version"`
 }
 
 type Content struct {
 	Title string `json:"title"`
 	Text  string `json:"text"`
 }
+
+// Metadata describes the uploaded file of a picture. Nothing else of the
+// file is kept, the stored files are encoded again and carry no metadata, so
+// e.g. the GPS position of a photo is never stored.
+type Metadata struct {
+	// Taken is when the photo was taken according to its EXIF data.
+	Taken       time.Time `json:"taken"`
+	CameraMake  string    `json:"camera_make"`
+	CameraModel string    `json:"camera_model"`
+	// Width and Height are the dimensions after Orientation was applied.
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	// Orientation is the EXIF orientation the upload was turned upright
+	// from, 1 if it already was.
+	Orientation int `json:"orientation"`
+}
+
+// Rendition is a copy of the original or, if Cropped, of the crop that is
+// downscaled to Width.
+type Rendition struct {
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Path    string `json:"path"`
+	Url     string `json:"url"`
+	Cropped bool   `json:"cropped"`
+}
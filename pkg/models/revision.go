@@ -0,0 +1,48 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"image"
+	"time"
+)
+
+// Revision actions.
+const (
+	RevisionOriginal = "original"
+	RevisionContent  = "content"
+	RevisionCrop     = "crop"
+	RevisionDisable  = "disable"
+	RevisionRollback = "rollback"
+)
+
+// Revision records one change of a post. State is the complete editable state
+// after the change, so a post can be rolled back to any revision, Changes is
+// the difference to the revision before.
+type Revision struct {
+	PostId  uuid.UUID     `json:"post_id"`
+	Number  int           `json:"number"`
+	Action  string        `json:"action"`
+	Author  string        `json:"author"`
+	Created time.Time     `json:"created"`
+	Changes []Change      `json:"changes"`
+	State   RevisionState `json:"state"`
+	// Rollback is the number of the revision that was restored by a
+	// RevisionRollback.
+	Rollback int `json:"rollback,omitempty"`
+}
+
+// Change is the old and new value of a field.
+type Change struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// RevisionState holds the fields of a post that can be changed after the
+// upload, Instagram posts only use Disabled.
+type RevisionState struct {
+	Content       Content         `json:"content"`
+	Disabled      bool            `json:"disabled"`
+	UseCropped    bool            `json:"use_cropped"`
+	CroppedBounds image.Rectangle `json:"cropped_bounds"`
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleViewer      Role = "viewer"
+	RoleContributor Role = "contributor"
+	RoleModerator   Role = "moderator"
+	RoleAdmin       Role = "admin"
+)
+
+// Valid reports whether r is one of the known roles.
+func (r Role) Valid() bool {
+	switch r {
+	case RoleViewer, RoleContributor, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+type User struct {
+	Id           uuid.UUID `json:"id"`
+	Name         string    `json:"name"`
+	Role         Role      `json:"role"`
+	PasswordHash []byte    `json:"password_hash"`
+	Created      time.Time `json:"created"`
+	LastLogin    time.Time `json:"last_login"`
+}
+
+type Session struct {
+	Token   string    `json:"token"`
+	UserId  uuid.UUID `json:"user_id"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+type KeyScope string
+
+const (
+	ScopeRead   KeyScope = "read"
+	ScopeUpload KeyScope = "upload"
+	// ScopeMetrics only allows scraping `/metrics`, for Prometheus.
+	ScopeMetrics KeyScope = "metrics"
+)
+
+// Valid reports whether s is one of the known key scopes.
+func (s KeyScope) Valid() bool {
+	return s == ScopeRead || s == ScopeUpload || s == ScopeMetrics
+}
+
+type ApiKey struct {
+	Id        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Scope     KeyScope  `json:"scope"`
+	Hash      []byte    `json:"hash"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+	LastUsed  time.Time `json:"last_used"`
+	Revoked   time.Time `json:"revoked"`
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"goji.io/pat"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix       = "bwk_"
+	apiKeySecretLength = 48
+	// apiKeyUsedInterval limits how often the last used timestamp of a key is
+	// written, so polling screens don't cause a db write on every request.
+	apiKeyUsedInterval = time.Minute
+)
+
+var (
+	keyScopeRoles = map[models.KeyScope]models.Role{
+		models.ScopeRead:    models.RoleViewer,
+		models.ScopeUpload:  models.RoleContributor,
+		models.ScopeMetrics: roleMetrics,
+	}
+)
+
+type createApiKeyBody struct {
+	Name  string          `json:"name"`
+	Scope models.KeyScope `json:"scope"`
+}
+
+type apiKeyResponse struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scope     string    `json:"scope"`
+	Key       string    `json:"key,omitempty"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+	LastUsed  time.Time `json:"last_used"`
+	Revoked   time.Time `json:"revoked"`
+}
+
+func fromApiKey(k models.ApiKey) apiKeyResponse {
+	return apiKeyResponse{
+		Id:        k.Id.String(),
+		Name:      k.Name,
+		Scope:     string(k.Scope),
+		Created:   k.Created,
+		CreatedBy: k.CreatedBy,
+		LastUsed:  k.LastUsed,
+		Revoked:   k.Revoked,
+	}
+}
+
+func hashApiKeySecret(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+	return h[:]
+}
+
+// isApiKey reports whether token has the format of an api key rather than
+// a session token.
+func isApiKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// authenticateApiKey resolves a key of the format `bwk_<id>_<secret>` to a
+// pseudo user whose role is derived from the scope of the key.
+func (s *Server) authenticateApiKey(token string) (*models.User, error) {
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, errUnauthorized
+	}
+	id, err := uuid.Parse(parts[0])
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	k, err := s.store.GetApiKey(id)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	if !k.Revoked.IsZero() ||
+		subtle.ConstantTimeCompare(k.Hash, hashApiKeySecret(parts[1])) != 1 {
+		return nil, errUnauthorized
+	}
+
+	now := time.Now()
+	if now.Sub(k.LastUsed) > apiKeyUsedInterval {
+		k.LastUsed = now
+		if err := s.store.UpdateApiKey(k); err != nil {
+			log.Error().Err(err).Str("key", k.Name).Msg("update api key last used")
+		}
+	}
+
+	// the prefix keeps keys from matching the uploader of a user's posts
+	return &models.User{
+		Id:   k.Id,
+		Name: "key:" + k.Name,
+		Role: keyScopeRoles[k.Scope],
+	}, nil
+}
+
+func (s *Server) getApiKeys(w http.ResponseWriter, _ *http.Request) {
+	keys, err := s.store.GetApiKeys()
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.After(keys[j].Created)
+	})
+
+	list := make([]apiKeyResponse, len(keys))
+	for i, k := range keys {
+		list[i] = fromApiKey(k)
+	}
+
+	_, _ = helper.WriteJson(w, http.StatusOK, list)
+}
+
+func (s *Server) createApiKey(w http.ResponseWriter, r *http.Request) {
+	var body createApiKeyBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("name", body.Name).Str("scope", string(body.Scope)).Msg("createApiKey")
+
+	if body.Name == "" || !plainTextRegex.MatchString(body.Name) {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, "invalid key name")
+		return
+	}
+	if !body.Scope.Valid() {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid scope: %s", body.Scope))
+		return
+	}
+
+	secret, err := helper.GenString(apiKeySecretLength)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	k := &models.ApiKey{
+		Id:        uuid.New(),
+		Name:      body.Name,
+		Scope:     body.Scope,
+		Hash:      hashApiKeySecret(secret),
+		Created:   time.Now(),
+		CreatedBy: uploaderName(r),
+	}
+	err = s.store.InsertApiKey(k)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the plain key is only returned once, just the hash is stored
+	res := fromApiKey(*k)
+	res.Key = fmt.Sprintf("%s%s_%s", apiKeyPrefix, k.Id.String(), secret)
+	_, _ = helper.WriteJson(w, http.StatusOK, res)
+}
+
+func (s *Server) revokeApiKey(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Msg("revokeApiKey")
+
+	k, err := s.store.GetApiKey(id)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if k.Revoked.IsZero() {
+		k.Revoked = time.Now()
+		err = s.store.UpdateApiKey(k)
+		if err != nil {
+			_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	_, _ = helper.WriteJson(w, http.StatusOK, fromApiKey(*k))
+}
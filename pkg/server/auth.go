@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ctxKey int
+
+const (
+	ctxKeyUser ctxKey = iota
+)
+
+const (
+	sessionTokenLength = 64
+)
+
+var (
+	errUnauthorized = fmt.Errorf("invalid or missing credentials")
+)
+
+type loginBody struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token   string       `json:"token"`
+	Expires time.Time    `json:"expires"`
+	User    userResponse `json:"user"`
+}
+
+type userResponse struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Created   time.Time `json:"created"`
+	LastLogin time.Time `json:"last_login"`
+}
+
+func fromUser(u models.User) userResponse {
+	return userResponse{
+		Id:        u.Id.String(),
+		Name:      u.Name,
+		Role:      string(u.Role),
+		Created:   u.Created,
+		LastLogin: u.LastLogin,
+	}
+}
+
+// userFromContext returns the authenticated user stored in ctx by the auth
+// middleware, or nil if the request is anonymous.
+func userFromContext(ctx context.Context) *models.User {
+	u, _ := ctx.Value(ctxKeyUser).(*models.User)
+	return u
+}
+
+// uploaderName returns the name that is recorded as uploader of a post.
+func uploaderName(r *http.Request) string {
+	if u := userFromContext(r.Context()); u != nil {
+		return u.Name
+	}
+	return "anonymous"
+}
+
+// bootstrapAdmin makes sure there is at least one admin account. If there is
+// none, the account given by the environment is created or, if it already
+// exists, promoted to admin. Otherwise there would be no way to manage users.
+func (s *Server) bootstrapAdmin(name, password string) error {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		return err
+	}
+	var existing *models.User
+	for i, u := range users {
+		if u.Role == models.RoleAdmin {
+			return nil
+		}
+		if strings.EqualFold(u.Name, name) {
+			existing = &users[i]
+		}
+	}
+
+	if existing != nil {
+		existing.Role = models.RoleAdmin
+		log.Info().Str("name", existing.Name).Msg("promoted user to admin")
+		return s.store.UpdateUser(existing)
+	}
+
+	if name == "" || password == "" {
+		log.Warn().Msgf("no admin in database, set %s and %s to create one", EnvAdminUser, EnvAdminPassword)
+		return nil
+	}
+
+	u, err := newUser(name, password, models.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("name", u.Name).Msg("created initial admin")
+	return s.store.InsertUser(u)
+}
+
+func newUser(name, password string, role models.Role) (*models.User, error) {
+	if name == "" || !plainTextRegex.MatchString(name) {
+		return nil, fmt.Errorf("invalid user name")
+	}
+	if !role.Valid() {
+		return nil, fmt.Errorf("invalid role: %s", role)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return &models.User{
+		Id:           uuid.New(),
+		Name:         name,
+		Role:         role,
+		PasswordHash: hash,
+		Created:      time.Now(),
+	}, nil
+}
+
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < 8 {
+		return nil, fmt.Errorf("password must be at least 8 characters")
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// bearerToken extracts the token of an `Authorization: Bearer <token>` header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// authenticate resolves the bearer token of the request, either a session
+// token or an api key, to a user.
+func (s *Server) authenticate(r *http.Request) (*models.User, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errUnauthorized
+	}
+	if isApiKey(token) {
+		return s.authenticateApiKey(token)
+	}
+
+	sess, err := s.store.GetSession(token)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	if sess.Expires.Before(time.Now()) {
+		_ = s.store.DeleteSession(token)
+		return nil, errUnauthorized
+	}
+
+	u, err := s.store.GetUser(sess.UserId)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	return u, nil
+}
+
+// auth rejects requests without a valid session and stores the user in the
+// request context for the wrapped handler.
+func (s *Server) auth(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			_, _ = helper.WriteError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if ai := accessFromContext(r.Context()); ai != nil {
+			ai.user = u.Name
+		}
+		f(w, r.WithContext(context.WithValue(r.Context(), ctxKeyUser, u)))
+	}
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	var body loginBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u, err := s.store.GetUserByName(body.Name)
+	if err != nil {
+		log.Ctx(r.Context()).Warn().Str("name", body.Name).Msg("login: unknown user")
+		_, _ = helper.WriteError(w, http.StatusUnauthorized, errUnauthorized.Error())
+		return
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(body.Password)) != nil {
+		log.Ctx(r.Context()).Warn().Str("name", body.Name).Msg("login: wrong password")
+		_, _ = helper.WriteError(w, http.StatusUnauthorized, errUnauthorized.Error())
+		return
+	}
+
+	token, err := helper.GenString(sessionTokenLength)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now()
+	sess := &models.Session{
+		Token:   token,
+		UserId:  u.Id,
+		Created: now,
+		Expires: now.Add(s.cfg.SessionTTL),
+	}
+	err = s.store.InsertSession(sess)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	u.LastLogin = now
+	err = s.store.UpdateUser(u)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("login: update last login")
+	}
+
+	if err := s.store.DeleteExpiredSessions(now); err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("login: delete expired sessions")
+	}
+
+	log.Ctx(r.Context()).Info().Str("name", u.Name).Msg("login")
+	_, _ = helper.WriteJson(w, http.StatusOK, loginResponse{
+		Token:   sess.Token,
+		Expires: sess.Expires,
+		User:    fromUser(*u),
+	})
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	err := s.store.DeleteSession(bearerToken(r))
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getMe(w http.ResponseWriter, r *http.Request) {
+	_, _ = helper.WriteJson(w, http.StatusOK, fromUser(*userFromContext(r.Context())))
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/blob"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backupPrefix     = "bwof-"
+	backupTimeFormat = "20060102T150405Z"
+	backupExtDb      = ".db"
+	backupExtArchive = ".tar.gz"
+)
+
+var errBackupUnsupported = errors.New("the store does not support backups")
+
+// backupName returns the file name of a backup taken at t.
+func backupName(t time.Time, withFiles bool) string {
+	ext := backupExtDb
+	if withFiles {
+		ext = backupExtArchive
+	}
+	return backupPrefix + t.UTC().Format(backupTimeFormat) + ext
+}
+
+// writeBackup writes a consistent snapshot of the database to w, with
+// withFiles as tar.gz archive together with the media files. The files are
+// listed while the snapshot is held, files are written before the records
+// that refer to them, so every file of a post in the snapshot is listed.
+// Files deleted before they are copied, i.e. of posts purged while the
+// archive is written, are missing in the archive.
+func (s *Server) writeBackup(w io.Writer, withFiles bool) error {
+	b, ok := s.store.(store.Backuper)
+	if !ok {
+		return errBackupUnsupported
+	}
+	if !withFiles {
+		return b.Backup(func(_ int64, snapshot io.WriterTo) error {
+			_, err := snapshot.WriteTo(w)
+			return err
+		})
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	files := make([]blob.Info, 0)
+	err := b.Backup(func(size int64, snapshot io.WriterTo) error {
+		for _, kind := range []string{kindPictures, kindInstagram} {
+			infos, err := s.blobs.List(kind + "/")
+			if err != nil {
+				return err
+			}
+			files = append(files, infos...)
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     s.cfg.DbFile,
+			Mode:     0600,
+			Size:     size,
+			ModTime:  time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = snapshot.WriteTo(tw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := copyBlobsToTar(tw, s.blobs, files); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// addBlobsToTar adds all blobs whose keys start with prefix to tw, see
+// copyBlobsToTar.
+func addBlobsToTar(tw *tar.Writer, blobs blob.Store, prefix string) error {
+	infos, err := blobs.List(prefix)
+	if err != nil {
+		return err
+	}
+	return copyBlobsToTar(tw, blobs, infos)
+}
+
+// copyBlobsToTar adds the blobs infos to tw, named by their keys. Blobs
+// removed since they were listed are skipped.
+func copyBlobsToTar(tw *tar.Writer, blobs blob.Store, infos []blob.Info) error {
+	for _, i := range infos {
+		err := func() error {
+			rc, info, err := blobs.Get(i.Key)
+			if err == blob.ErrNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			defer helper.CloseRC(rc, i.Key)
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     i.Key,
+				Mode:     0644,
+				Size:     info.Size,
+				ModTime:  info.Modified,
+			})
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(tw, rc, info.Size)
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getBackup streams a backup, the database only or, with `?files=true`, a
+// tar.gz archive that includes the media directories.
+func (s *Server) getBackup(w http.ResponseWriter, r *http.Request) {
+	withFiles := false
+	if v := r.URL.Query().Get("files"); v != "" {
+		var err error
+		if withFiles, err = strconv.ParseBool(v); err != nil {
+			_, _ = helper.WriteError(w, http.StatusBadRequest, "files must be true or false")
+			return
+		}
+	}
+	if _, ok := s.store.(store.Backuper); !ok {
+		_, _ = helper.WriteError(w, http.StatusNotImplemented, errBackupUnsupported.Error())
+		return
+	}
+
+	name := backupName(time.Now(), withFiles)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if withFiles {
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	liftDeadlines(w, r)
+
+	// the response has started once the first byte is written, errors can
+	// only be logged from then on
+	err := s.writeBackup(w, withFiles)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("file", name).Msg("backup failed")
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("file", name).Msg("backup")
+}
+
+// RunBackups writes a snapshot to BackupDir every BackupInterval until ctx is
+// done and removes all but the newest BackupRetention snapshots. It returns
+// immediately if scheduled backups aren't configured.
+func (s *Server) RunBackups(ctx context.Context) {
+	if s.cfg.BackupInterval <= 0 || s.cfg.BackupDir == "" {
+		return
+	}
+	if err := os.MkdirAll(s.cfg.BackupDir, 0770); err != nil {
+		log.Error().Err(err).Msg("unable to create backup directory")
+		return
+	}
+	log.Info().Str("dir", s.cfg.BackupDir).Dur("interval", s.cfg.BackupInterval).
+		Int("retention", s.cfg.BackupRetention).Msg("scheduled backups enabled")
+
+	t := time.NewTicker(s.cfg.BackupInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			name, err := s.writeBackupFile(now)
+			if err != nil {
+				log.Error().Err(err).Msg("scheduled backup failed")
+				continue
+			}
+			log.Info().Str("file", name).Msg("scheduled backup")
+			if err := pruneBackups(s.cfg.BackupDir, s.cfg.BackupRetention); err != nil {
+				log.Error().Err(err).Msg("unable to remove old backups")
+			}
+		}
+	}
+}
+
+// writeBackupFile writes a snapshot to a temporary file in BackupDir that is
+// renamed once complete, so a crash never leaves a partial backup behind.
+func (s *Server) writeBackupFile(t time.Time) (string, error) {
+	name := path.Join(s.cfg.BackupDir, backupName(t, s.cfg.BackupFiles))
+	f, err := ioutil.TempFile(s.cfg.BackupDir, ".backup-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	defer func() {
+		_ = os.Remove(tmp)
+	}()
+
+	if err := s.writeBackup(f, s.cfg.BackupFiles); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return name, os.Rename(tmp, name)
+}
+
+// pruneBackups removes all but the newest keep backups in dir.
+func pruneBackups(dir string, keep int) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	for _, fi := range infos {
+		n := fi.Name()
+		if fi.Mode().IsRegular() && strings.HasPrefix(n, backupPrefix) &&
+			(strings.HasSuffix(n, backupExtDb) || strings.HasSuffix(n, backupExtArchive)) {
+			names = append(names, n)
+		}
+	}
+	if len(names) <= keep {
+		return nil
+	}
+
+	// the timestamp sorts the names chronologically
+	sort.Strings(names)
+	for _, n := range names[:len(names)-keep] {
+		if err := os.Remove(path.Join(dir, n)); err != nil {
+			return err
+		}
+		log.Info().Str("file", n).Msg("removed old backup")
+	}
+	return nil
+}
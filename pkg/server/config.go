@@ -0,0 +1,715 @@
+package server
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/rs/zerolog"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EnvConfigFile           = "CONFIG"
+	EnvDataDir              = "DATA"
+	EnvDbFile               = "DB"
+	EnvInstagramAccessToken = "INSTA_TOKEN"
+	EnvAdminUser            = "ADMIN_USER"
+	EnvAdminPassword        = "ADMIN_PASSWORD"
+	EnvSessionTTL           = "SESSION_TTL_HOURS"
+	EnvPublicDir            = "PUBLIC_DIR"
+	EnvAddr                 = "ADDR"
+	EnvTLSCert              = "TLS_CERT"
+	EnvTLSKey               = "TLS_KEY"
+	EnvReadTimeout          = "READ_TIMEOUT_SECONDS"
+	EnvWriteTimeout         = "WRITE_TIMEOUT_SECONDS"
+	EnvIdleTimeout          = "IDLE_TIMEOUT_SECONDS"
+	EnvShutdownTimeout      = "SHUTDOWN_TIMEOUT_SECONDS"
+	EnvThumbnailSize        = "THUMBNAIL_SIZE"
+	EnvRenditionWidths      = "RENDITION_WIDTHS"
+	EnvResizeSizes          = "RESIZE_SIZES"
+	EnvResizeCacheDir       = "RESIZE_CACHE_DIR"
+	EnvResizeCacheSize      = "RESIZE_CACHE_MB"
+	EnvTargetRatio          = "TARGET_RATIO"
+	EnvCORSOrigins          = "CORS_ORIGINS"
+	EnvCORSMaxAge           = "CORS_MAX_AGE_SECONDS"
+	EnvMinFreeDisk          = "MIN_FREE_DISK_MB"
+	EnvLogLevel             = "LOG_LEVEL"
+	EnvLogFormat            = "LOG_FORMAT"
+	EnvBackupDir            = "BACKUP_DIR"
+	EnvBackupInterval       = "BACKUP_INTERVAL_HOURS"
+	EnvBackupRetention      = "BACKUP_RETENTION"
+	EnvBackupFiles          = "BACKUP_FILES"
+	EnvTrashRetention       = "TRASH_RETENTION_HOURS"
+	EnvMediaStore           = "MEDIA_STORE"
+	EnvMediaUrls            = "MEDIA_URLS"
+	EnvMediaUrlTTL          = "MEDIA_URL_TTL_MINUTES"
+	EnvS3Endpoint           = "S3_ENDPOINT"
+	EnvS3Region             = "S3_REGION"
+	EnvS3Bucket             = "S3_BUCKET"
+	EnvS3AccessKey          = "S3_ACCESS_KEY"
+	EnvS3SecretKey          = "S3_SECRET_KEY"
+	EnvS3PathStyle          = "S3_PATH_STYLE"
+	EnvS3Prefix             = "S3_PREFIX"
+
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+
+	MediaStoreFS = "fs"
+	MediaStoreS3 = "s3"
+
+	MediaUrlsProxy   = "proxy"
+	MediaUrlsPresign = "presign"
+
+	redacted = "<redacted>"
+)
+
+// Config holds everything a Server needs, see DefaultConfig for the defaults.
+type Config struct {
+	// DataDir contains the database and, with MediaStoreFS, the uploaded
+	// media.
+	DataDir string
+	// DbFile is the name of the bolt database file inside DataDir.
+	DbFile string
+	// PublicDir is served as static frontend at `/`.
+	PublicDir string
+	// Addr is the bind address and port used by ListenAndServe.
+	Addr string
+	// TLSCert and TLSKey enable https if both are set, the files are reloaded
+	// when they change.
+	TLSCert string
+	TLSKey  string
+	// ReadTimeout, WriteTimeout and IdleTimeout are passed to the http.Server,
+	// ShutdownTimeout limits how long in-flight requests are drained.
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	// CORSOrigins are the origins allowed to access the api from a browser,
+	// `*` allows any origin but without credentials. CORSMaxAge is how long
+	// browsers may cache preflight results.
+	CORSOrigins []string
+	CORSMaxAge  time.Duration
+
+	InstagramToken string
+	// AdminUser and AdminPassword are used to create the initial admin
+	// account if the database has none.
+	AdminUser     string
+	AdminPassword string
+	SessionTTL    time.Duration
+
+	// MinFreeDisk is the free space in bytes the filesystem of DataDir needs
+	// for the server to be ready.
+	MinFreeDisk uint64
+
+	// LogLevel is one of zerolog's levels (trace, debug, info, ...), LogFormat
+	// is either LogFormatConsole or LogFormatJSON.
+	LogLevel  string
+	LogFormat string
+
+	// BackupDir receives a snapshot every BackupInterval if both are set,
+	// only the newest BackupRetention snapshots are kept. With BackupFiles
+	// the snapshots are tar.gz archives that include the media directories.
+	BackupDir       string
+	BackupInterval  time.Duration
+	BackupRetention int
+	BackupFiles     bool
+
+	// TrashRetention is how long deleted posts stay in the trash, where they
+	// can be restored, before they are purged for good.
+	TrashRetention time.Duration
+
+	// MediaStore is where the media files are kept, MediaStoreFS for the
+	// pictures and instagram directories inside DataDir or MediaStoreS3 for
+	// the bucket configured by the S3 fields. Replicas that share a bucket
+	// share the media.
+	MediaStore  string
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool
+	S3Prefix    string
+	// MediaUrls decides how media is served: MediaUrlsProxy streams it
+	// through the server, MediaUrlsPresign redirects to a presigned url of
+	// the bucket that is valid for MediaUrlTTL.
+	MediaUrls   string
+	MediaUrlTTL time.Duration
+
+	// ThumbnailSize is the maximum width and height of thumbnails.
+	ThumbnailSize uint
+	// RenditionWidths are the widths pictures and their crops are downscaled
+	// to in addition to the thumbnail, an empty list disables renditions.
+	RenditionWidths []int
+	// ResizeSizes are the widths and heights pictures can be resized to on
+	// request, other sizes are rejected so that clients can't make the server
+	// render arbitrarily many images. The results are kept in ResizeCacheDir,
+	// `resize-cache` inside DataDir if empty, which is limited to
+	// ResizeCacheSize bytes.
+	ResizeSizes     []int
+	ResizeCacheDir  string
+	ResizeCacheSize uint64
+	// TargetRatio is the aspect ratio (width / height) of the wall, it's used
+	// to suggest a crop for new pictures.
+	TargetRatio float64
+
+	// envErrors are the environment variables withEnv couldn't parse, they
+	// are reported by Validate.
+	envErrors []string
+}
+
+// fileConfig is the representation of Config in a config file.
+type fileConfig struct {
+	DataDir         string   `toml:"data_dir"`
+	DbFile          string   `toml:"db_file"`
+	PublicDir       string   `toml:"public_dir"`
+	Addr            string   `toml:"addr"`
+	TLSCert         string   `toml:"tls_cert"`
+	TLSKey          string   `toml:"tls_key"`
+	ReadTimeout     duration `toml:"read_timeout"`
+	WriteTimeout    duration `toml:"write_timeout"`
+	IdleTimeout     duration `toml:"idle_timeout"`
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+	CORSOrigins     []string `toml:"cors_origins"`
+	CORSMaxAge      duration `toml:"cors_max_age"`
+	InstagramToken  string   `toml:"instagram_token"`
+	AdminUser       string   `toml:"admin_user"`
+	AdminPassword   string   `toml:"admin_password"`
+	SessionTTL      duration `toml:"session_ttl"`
+	MinFreeDiskMB   uint64   `toml:"min_free_disk_mb"`
+	LogLevel        string   `toml:"log_level"`
+	LogFormat       string   `toml:"log_format"`
+	BackupDir       string   `toml:"backup_dir"`
+	BackupInterval  duration `toml:"backup_interval"`
+	BackupRetention int      `toml:"backup_retention"`
+	BackupFiles     bool     `toml:"backup_files"`
+	TrashRetention  duration `toml:"trash_retention"`
+	MediaStore      string   `toml:"media_store"`
+	S3Endpoint      string   `toml:"s3_endpoint"`
+	S3Region        string   `toml:"s3_region"`
+	S3Bucket        string   `toml:"s3_bucket"`
+	S3AccessKey     string   `toml:"s3_access_key"`
+	S3SecretKey     string   `toml:"s3_secret_key"`
+	S3PathStyle     bool     `toml:"s3_path_style"`
+	S3Prefix        string   `toml:"s3_prefix"`
+	MediaUrls       string   `toml:"media_urls"`
+	MediaUrlTTL     duration `toml:"media_url_ttl"`
+	ThumbnailSize   uint     `toml:"thumbnail_size"`
+	RenditionWidths []int    `toml:"rendition_widths"`
+	ResizeSizes     []int    `toml:"resize_sizes"`
+	ResizeCacheDir  string   `toml:"resize_cache_dir"`
+	ResizeCacheMB   uint64   `toml:"resize_cache_mb"`
+	TargetRatio     float64  `toml:"target_ratio"`
+}
+
+// duration is a time.Duration written as string like "1m30s" in config files.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// DefaultConfig returns the configuration used if neither a config file nor
+// the environment sets a value.
+func DefaultConfig() Config {
+	return Config{
+		DataDir:         "/data",
+		DbFile:          "data.db",
+		PublicDir:       "/app/public",
+		Addr:            ":8000",
+		ReadTimeout:     2 * time.Minute,
+		WriteTimeout:    2 * time.Minute,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		CORSOrigins:     []string{"*"},
+		CORSMaxAge:      10 * time.Minute,
+		SessionTTL:      7 * 24 * time.Hour,
+		MinFreeDisk:     100 << 20,
+		LogLevel:        zerolog.InfoLevel.String(),
+		LogFormat:       LogFormatConsole,
+		BackupRetention: 7,
+		TrashRetention:  30 * 24 * time.Hour,
+		MediaStore:      MediaStoreFS,
+		MediaUrls:       MediaUrlsProxy,
+		MediaUrlTTL:     time.Hour,
+		ThumbnailSize:   helper.ThumbnailSize,
+		RenditionWidths: []int{640, 1280, 1920, 3840},
+		ResizeSizes:     []int{160, 320, 480, 640, 720, 960, 1080, 1280, 1440, 1920, 2160, 2560, 3840},
+		ResizeCacheSize: 512 << 20,
+		TargetRatio:     helper.TargetRatio,
+	}
+}
+
+// ConfigFromEnv returns the default configuration overridden by the
+// environment.
+func ConfigFromEnv() Config {
+	return DefaultConfig().withEnv()
+}
+
+// LoadConfig layers the defaults, the config file (if file isn't empty) and
+// the environment, in this order, and validates the result.
+func LoadConfig(file string) (Config, error) {
+	cfg := DefaultConfig()
+	if file != "" {
+		fc := cfg.toFile()
+		md, err := toml.DecodeFile(file, &fc)
+		if err != nil {
+			return cfg, fmt.Errorf("unable to read config file %s: %w", file, err)
+		}
+		if u := md.Undecoded(); len(u) > 0 {
+			return cfg, fmt.Errorf("unknown keys in config file %s: %v", file, u)
+		}
+		cfg = fc.toConfig()
+	}
+	cfg = cfg.withEnv()
+	return cfg, cfg.Validate()
+}
+
+// withEnv returns a copy of c with all values that are set in the
+// environment replaced. Values that can't be parsed leave the field unchanged
+// and are reported by Validate.
+func (c Config) withEnv() Config {
+	e := &envReader{}
+	c.DataDir = helper.GetStringEnv(EnvDataDir, c.DataDir)
+	c.DbFile = helper.GetStringEnv(EnvDbFile, c.DbFile)
+	c.PublicDir = helper.GetStringEnv(EnvPublicDir, c.PublicDir)
+	c.Addr = helper.GetStringEnv(EnvAddr, c.Addr)
+	c.TLSCert = helper.GetStringEnv(EnvTLSCert, c.TLSCert)
+	c.TLSKey = helper.GetStringEnv(EnvTLSKey, c.TLSKey)
+	c.ReadTimeout = e.duration(EnvReadTimeout, c.ReadTimeout, time.Second)
+	c.WriteTimeout = e.duration(EnvWriteTimeout, c.WriteTimeout, time.Second)
+	c.IdleTimeout = e.duration(EnvIdleTimeout, c.IdleTimeout, time.Second)
+	c.ShutdownTimeout = e.duration(EnvShutdownTimeout, c.ShutdownTimeout, time.Second)
+	if v := os.Getenv(EnvCORSOrigins); v != "" {
+		c.CORSOrigins = strings.Split(v, ",")
+		for i := range c.CORSOrigins {
+			c.CORSOrigins[i] = strings.TrimSpace(c.CORSOrigins[i])
+		}
+	}
+	c.CORSMaxAge = e.duration(EnvCORSMaxAge, c.CORSMaxAge, time.Second)
+	c.InstagramToken = helper.GetStringEnv(EnvInstagramAccessToken, c.InstagramToken)
+	c.AdminUser = helper.GetStringEnv(EnvAdminUser, c.AdminUser)
+	c.AdminPassword = helper.GetStringEnv(EnvAdminPassword, c.AdminPassword)
+	c.SessionTTL = e.duration(EnvSessionTTL, c.SessionTTL, time.Hour)
+	c.MinFreeDisk = e.uint64(EnvMinFreeDisk, c.MinFreeDisk>>20) << 20
+	c.LogLevel = helper.GetStringEnv(EnvLogLevel, c.LogLevel)
+	c.LogFormat = helper.GetStringEnv(EnvLogFormat, c.LogFormat)
+	c.BackupDir = helper.GetStringEnv(EnvBackupDir, c.BackupDir)
+	c.BackupInterval = e.duration(EnvBackupInterval, c.BackupInterval, time.Hour)
+	c.BackupRetention = int(e.int64(EnvBackupRetention, int64(c.BackupRetention)))
+	c.BackupFiles = e.bool(EnvBackupFiles, c.BackupFiles)
+	c.TrashRetention = e.duration(EnvTrashRetention, c.TrashRetention, time.Hour)
+	c.MediaStore = helper.GetStringEnv(EnvMediaStore, c.MediaStore)
+	c.S3Endpoint = helper.GetStringEnv(EnvS3Endpoint, c.S3Endpoint)
+	c.S3Region = helper.GetStringEnv(EnvS3Region, c.S3Region)
+	c.S3Bucket = helper.GetStringEnv(EnvS3Bucket, c.S3Bucket)
+	c.S3AccessKey = helper.GetStringEnv(EnvS3AccessKey, c.S3AccessKey)
+	c.S3SecretKey = helper.GetStringEnv(EnvS3SecretKey, c.S3SecretKey)
+	c.S3PathStyle = e.bool(EnvS3PathStyle, c.S3PathStyle)
+	c.S3Prefix = helper.GetStringEnv(EnvS3Prefix, c.S3Prefix)
+	c.MediaUrls = helper.GetStringEnv(EnvMediaUrls, c.MediaUrls)
+	c.MediaUrlTTL = e.duration(EnvMediaUrlTTL, c.MediaUrlTTL, time.Minute)
+	c.ThumbnailSize = uint(e.uint64(EnvThumbnailSize, uint64(c.ThumbnailSize)))
+	c.RenditionWidths = e.ints(EnvRenditionWidths, c.RenditionWidths)
+	c.ResizeSizes = e.ints(EnvResizeSizes, c.ResizeSizes)
+	c.ResizeCacheDir = helper.GetStringEnv(EnvResizeCacheDir, c.ResizeCacheDir)
+	c.ResizeCacheSize = e.uint64(EnvResizeCacheSize, c.ResizeCacheSize>>20) << 20
+	c.TargetRatio = e.float64(EnvTargetRatio, c.TargetRatio)
+	c.envErrors = append(c.envErrors, e.errs...)
+	return c
+}
+
+// envReader reads typed values from the environment. Unset and empty
+// variables return the default, variables that can't be parsed too but are
+// collected in errs.
+type envReader struct {
+	errs []string
+}
+
+func (e *envReader) invalid(key, value, want string) {
+	e.errs = append(e.errs, fmt.Sprintf("%s must be %s, got %q", key, want, value))
+}
+
+func (e *envReader) int64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		e.invalid(key, v, "a whole number")
+		return def
+	}
+	return n
+}
+
+func (e *envReader) uint64(key string, def uint64) uint64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		e.invalid(key, v, "a positive whole number")
+		return def
+	}
+	return n
+}
+
+func (e *envReader) float64(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		e.invalid(key, v, "a number")
+		return def
+	}
+	return f
+}
+
+func (e *envReader) bool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		e.invalid(key, v, "true or false")
+		return def
+	}
+	return b
+}
+
+// duration reads the variable as a whole number of units.
+func (e *envReader) duration(key string, def time.Duration, unit time.Duration) time.Duration {
+	return time.Duration(e.int64(key, int64(def/unit))) * unit
+}
+
+// ints reads the variable as comma separated list of whole numbers, a set
+// but empty variable is an empty list.
+func (e *envReader) ints(key string, def []int) []int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	ints := make([]int, 0)
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			e.invalid(key, v, "a comma separated list of whole numbers")
+			return def
+		}
+		ints = append(ints, n)
+	}
+	return ints
+}
+
+// withDefaults returns a copy of c with all zero values replaced by the
+// defaults.
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if len(c.DataDir) > 1 && c.DataDir[0] == '.' && c.DataDir[1] == '/' {
+		c.DataDir = c.DataDir[2:]
+	}
+	if c.DbFile == "" {
+		c.DbFile = d.DbFile
+	}
+	if c.PublicDir == "" {
+		c.PublicDir = d.PublicDir
+	}
+	if c.Addr == "" {
+		c.Addr = d.Addr
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = d.ShutdownTimeout
+	}
+	if c.SessionTTL == 0 {
+		c.SessionTTL = d.SessionTTL
+	}
+	if c.ThumbnailSize == 0 {
+		c.ThumbnailSize = d.ThumbnailSize
+	}
+	if c.TargetRatio == 0 {
+		c.TargetRatio = d.TargetRatio
+	}
+	if c.RenditionWidths == nil {
+		c.RenditionWidths = d.RenditionWidths
+	}
+	if c.ResizeSizes == nil {
+		c.ResizeSizes = d.ResizeSizes
+	}
+	if c.ResizeCacheSize == 0 {
+		c.ResizeCacheSize = d.ResizeCacheSize
+	}
+	if c.BackupRetention == 0 {
+		c.BackupRetention = d.BackupRetention
+	}
+	if c.TrashRetention == 0 {
+		c.TrashRetention = d.TrashRetention
+	}
+	if c.MediaStore == "" {
+		c.MediaStore = d.MediaStore
+	}
+	if c.MediaUrls == "" {
+		c.MediaUrls = d.MediaUrls
+	}
+	if c.MediaUrlTTL == 0 {
+		c.MediaUrlTTL = d.MediaUrlTTL
+	}
+	return c
+}
+
+// Validate checks c and returns an error listing every invalid value.
+func (c Config) Validate() error {
+	errs := make([]string, 0)
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+	errs = append(errs, c.envErrors...)
+
+	if c.DataDir == "" {
+		add("data_dir must not be empty")
+	} else if fi, err := os.Stat(c.DataDir); err != nil {
+		add("data_dir: %s", err)
+	} else if !fi.IsDir() {
+		add("data_dir: %s is not a directory", c.DataDir)
+	}
+	if c.DbFile == "" || strings.ContainsAny(c.DbFile, `/\`) {
+		add("db_file must be a plain file name, got %q", c.DbFile)
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		add("addr: %s", err)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		add("tls_cert and tls_key must be set together")
+	}
+	for _, f := range []string{c.TLSCert, c.TLSKey} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			add("tls: %s", err)
+		}
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		add("read_timeout, write_timeout and idle_timeout must not be negative")
+	}
+	for _, o := range c.CORSOrigins {
+		if err := validateOrigin(o); err != nil {
+			add("cors_origins: %s", err)
+		}
+	}
+	if c.CORSMaxAge < 0 {
+		add("cors_max_age must not be negative, got %s", c.CORSMaxAge)
+	}
+	if c.ShutdownTimeout <= 0 {
+		add("shutdown_timeout must be positive, got %s", c.ShutdownTimeout)
+	}
+	if c.SessionTTL <= 0 {
+		add("session_ttl must be positive, got %s", c.SessionTTL)
+	}
+	if c.AdminPassword != "" && len(c.AdminPassword) < 8 {
+		add("admin_password must be at least 8 characters")
+	}
+	if _, err := zerolog.ParseLevel(c.LogLevel); err != nil {
+		add("log_level: %s", err)
+	}
+	if c.LogFormat != LogFormatConsole && c.LogFormat != LogFormatJSON {
+		add("log_format must be %q or %q, got %q", LogFormatConsole, LogFormatJSON, c.LogFormat)
+	}
+	if c.BackupInterval < 0 {
+		add("backup_interval must not be negative, got %s", c.BackupInterval)
+	} else if c.BackupInterval > 0 && c.BackupDir == "" {
+		add("backup_dir is required if backup_interval is set")
+	}
+	if c.BackupRetention < 1 {
+		add("backup_retention must be at least 1, got %d", c.BackupRetention)
+	}
+	if c.TrashRetention <= 0 {
+		add("trash_retention must be positive, got %s", c.TrashRetention)
+	}
+	switch c.MediaStore {
+	case MediaStoreFS:
+	case MediaStoreS3:
+		if _, err := c.blobStore(); err != nil {
+			add("%s", err)
+		}
+		if (c.S3AccessKey == "") != (c.S3SecretKey == "") {
+			add("s3_access_key and s3_secret_key must be set together")
+		}
+	default:
+		add("media_store must be %q or %q, got %q", MediaStoreFS, MediaStoreS3, c.MediaStore)
+	}
+	switch c.MediaUrls {
+	case MediaUrlsProxy:
+	case MediaUrlsPresign:
+		if c.MediaStore != MediaStoreS3 {
+			add("media_urls %q requires media_store %q", MediaUrlsPresign, MediaStoreS3)
+		}
+	default:
+		add("media_urls must be %q or %q, got %q", MediaUrlsProxy, MediaUrlsPresign, c.MediaUrls)
+	}
+	if c.MediaUrlTTL <= 0 || c.MediaUrlTTL > 7*24*time.Hour {
+		add("media_url_ttl must be between 1m and 168h, got %s", c.MediaUrlTTL)
+	}
+	if c.ThumbnailSize == 0 || c.ThumbnailSize > 4096 {
+		add("thumbnail_size must be between 1 and 4096, got %d", c.ThumbnailSize)
+	}
+	for _, w := range c.RenditionWidths {
+		if w <= 0 || w > 8192 {
+			add("rendition_widths must be between 1 and 8192, got %d", w)
+		}
+	}
+	for _, n := range c.ResizeSizes {
+		if n <= 0 || n > 8192 {
+			add("resize_sizes must be between 1 and 8192, got %d", n)
+		}
+	}
+	if c.TargetRatio <= 0 {
+		add("target_ratio must be positive, got %g", c.TargetRatio)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config:\n  - %s", strings.Join(errs, "\n  - "))
+}
+
+// Logger returns a logger writing to w as configured by LogLevel and
+// LogFormat, invalid values fall back to info and console.
+func (c Config) Logger(w io.Writer) zerolog.Logger {
+	lvl, err := zerolog.ParseLevel(c.LogLevel)
+	if err != nil || c.LogLevel == "" {
+		lvl = zerolog.InfoLevel
+	}
+	if c.LogFormat != LogFormatJSON {
+		w = zerolog.ConsoleWriter{Out: w}
+	}
+	return zerolog.New(w).Level(lvl).With().Timestamp().Logger()
+}
+
+// Print writes c in config file format to w, secrets are redacted.
+func (c Config) Print(w io.Writer) error {
+	fc := c.toFile()
+	if fc.InstagramToken != "" {
+		fc.InstagramToken = redacted
+	}
+	if fc.AdminPassword != "" {
+		fc.AdminPassword = redacted
+	}
+	if fc.S3AccessKey != "" {
+		fc.S3AccessKey = redacted
+	}
+	if fc.S3SecretKey != "" {
+		fc.S3SecretKey = redacted
+	}
+	return toml.NewEncoder(w).Encode(fc)
+}
+
+func (c Config) toFile() fileConfig {
+	return fileConfig{
+		DataDir:         c.DataDir,
+		DbFile:          c.DbFile,
+		PublicDir:       c.PublicDir,
+		Addr:            c.Addr,
+		TLSCert:         c.TLSCert,
+		TLSKey:          c.TLSKey,
+		ReadTimeout:     duration{c.ReadTimeout},
+		WriteTimeout:    duration{c.WriteTimeout},
+		IdleTimeout:     duration{c.IdleTimeout},
+		ShutdownTimeout: duration{c.ShutdownTimeout},
+		CORSOrigins:     c.CORSOrigins,
+		CORSMaxAge:      duration{c.CORSMaxAge},
+		InstagramToken:  c.InstagramToken,
+		AdminUser:       c.AdminUser,
+		AdminPassword:   c.AdminPassword,
+		SessionTTL:      duration{c.SessionTTL},
+		MinFreeDiskMB:   c.MinFreeDisk >> 20,
+		LogLevel:        c.LogLevel,
+		LogFormat:       c.LogFormat,
+		BackupDir:       c.BackupDir,
+		BackupInterval:  duration{c.BackupInterval},
+		BackupRetention: c.BackupRetention,
+		BackupFiles:     c.BackupFiles,
+		TrashRetention:  duration{c.TrashRetention},
+		MediaStore:      c.MediaStore,
+		S3Endpoint:      c.S3Endpoint,
+		S3Region:        c.S3Region,
+		S3Bucket:        c.S3Bucket,
+		S3AccessKey:     c.S3AccessKey,
+		S3SecretKey:     c.S3SecretKey,
+		S3PathStyle:     c.S3PathStyle,
+		S3Prefix:        c.S3Prefix,
+		MediaUrls:       c.MediaUrls,
+		MediaUrlTTL:     duration{c.MediaUrlTTL},
+		ThumbnailSize:   c.ThumbnailSize,
+		RenditionWidths: c.RenditionWidths,
+		ResizeSizes:     c.ResizeSizes,
+		ResizeCacheDir:  c.ResizeCacheDir,
+		ResizeCacheMB:   c.ResizeCacheSize >> 20,
+		TargetRatio:     c.TargetRatio,
+	}
+}
+
+func (f fileConfig) toConfig() Config {
+	return Config{
+		DataDir:         f.DataDir,
+		DbFile:          f.DbFile,
+		PublicDir:       f.PublicDir,
+		Addr:            f.Addr,
+		TLSCert:         f.TLSCert,
+		TLSKey:          f.TLSKey,
+		ReadTimeout:     f.ReadTimeout.Duration,
+		WriteTimeout:    f.WriteTimeout.Duration,
+		IdleTimeout:     f.IdleTimeout.Duration,
+		ShutdownTimeout: f.ShutdownTimeout.Duration,
+		CORSOrigins:     f.CORSOrigins,
+		CORSMaxAge:      f.CORSMaxAge.Duration,
+		InstagramToken:  f.InstagramToken,
+		AdminUser:       f.AdminUser,
+		AdminPassword:   f.AdminPassword,
+		SessionTTL:      f.SessionTTL.Duration,
+		MinFreeDisk:     f.MinFreeDiskMB << 20,
+		LogLevel:        f.LogLevel,
+		LogFormat:       f.LogFormat,
+		BackupDir:       f.BackupDir,
+		BackupInterval:  f.BackupInterval.Duration,
+		BackupRetention: f.BackupRetention,
+		BackupFiles:     f.BackupFiles,
+		TrashRetention:  f.TrashRetention.Duration,
+		MediaStore:      f.MediaStore,
+		S3Endpoint:      f.S3Endpoint,
+		S3Region:        f.S3Region,
+		S3Bucket:        f.S3Bucket,
+		S3AccessKey:     f.S3AccessKey,
+		S3SecretKey:     f.S3SecretKey,
+		S3PathStyle:     f.S3PathStyle,
+		S3Prefix:        f.S3Prefix,
+		MediaUrls:       f.MediaUrls,
+		MediaUrlTTL:     f.MediaUrlTTL.Duration,
+		ThumbnailSize:   f.ThumbnailSize,
+		RenditionWidths: f.RenditionWidths,
+		ResizeSizes:     f.ResizeSizes,
+		ResizeCacheDir:  f.ResizeCacheDir,
+		ResizeCacheSize: f.ResizeCacheMB << 20,
+		TargetRatio:     f.TargetRatio,
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigInvalidEnv(t *testing.T) {
+	env := map[string]string{
+		EnvReadTimeout:     "abc",
+		EnvMinFreeDisk:     "x",
+		EnvTargetRatio:     "foo",
+		EnvBackupFiles:     "maybe",
+		EnvRenditionWidths: "640,big",
+	}
+	for k, v := range env {
+		old, ok := os.LookupEnv(k)
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				_ = os.Setenv(k, old)
+			} else {
+				_ = os.Unsetenv(k)
+			}
+		})
+	}
+
+	_, err := LoadConfig("")
+	if err == nil {
+		t.Fatal("LoadConfig: got no error for invalid environment")
+	}
+	for k, v := range env {
+		if !strings.Contains(err.Error(), k) || !strings.Contains(err.Error(), v) {
+			t.Errorf("LoadConfig: error %q doesn't mention %s=%s", err, k, v)
+		}
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	c := DefaultConfig()
+	c.InstagramToken = "insta-token"
+	c.AdminPassword = "admin-password"
+	c.S3AccessKey = "AKIDEXAMPLE"
+	c.S3SecretKey = "s3-secret"
+	c.S3Bucket = "media"
+
+	var b strings.Builder
+	if err := c.Print(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{c.InstagramToken, c.AdminPassword, c.S3AccessKey, c.S3SecretKey} {
+		if strings.Contains(b.String(), secret) {
+			t.Errorf("Print: %q is in the output", secret)
+		}
+	}
+	if !strings.Contains(b.String(), "media") {
+		t.Errorf("Print: got %s, want the bucket", b.String())
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	goji "goji.io"
+	"goji.io/pat"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	corsAllowHeaders  = "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Request-ID, If-Match, If-None-Match"
+	corsExposeHeaders = "X-Request-ID, X-Next-Cursor, ETag"
+)
+
+// corsPolicy decides which origins may access the api from a browser.
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+	maxAge    int
+}
+
+func newCorsPolicy(cfg Config) corsPolicy {
+	c := corsPolicy{
+		origins: make(map[string]bool),
+		maxAge:  int(cfg.CORSMaxAge.Seconds()),
+	}
+	for _, o := range cfg.CORSOrigins {
+		if o == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		c.origins[strings.ToLower(strings.TrimRight(o, "/"))] = true
+	}
+	return c
+}
+
+// validateOrigin returns an error if o isn't `*` or a plain origin like
+// `https://example.com:8080`.
+func validateOrigin(o string) error {
+	if o == "*" {
+		return nil
+	}
+	u, err := url.Parse(o)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		strings.TrimRight(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%q is not an origin like https://example.com", o)
+	}
+	return nil
+}
+
+// setOrigin sets the allow origin headers if origin is allowed. A wildcard
+// policy can't be combined with credentials, so those are only allowed for
+// explicitly listed origins.
+func (c corsPolicy) setOrigin(w http.ResponseWriter, origin string) bool {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+	if c.origins[strings.ToLower(origin)] {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		return true
+	}
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		return true
+	}
+	return false
+}
+
+func (s *Server) cors(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.corsPolicy.setOrigin(w, r.Header.Get("Origin"))
+		f(w, r) // original function call
+	}
+}
+
+// preflight answers OPTIONS requests for a route that supports methods.
+func (s *Server) preflight(methods []string) func(http.ResponseWriter, *http.Request) {
+	allowed := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Allow", allowed)
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if s.corsPolicy.setOrigin(w, r.Header.Get("Origin")) {
+			h.Set("Access-Control-Allow-Methods", allowed)
+			h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			if s.corsPolicy.maxAge > 0 {
+				h.Set("Access-Control-Max-Age", fmt.Sprint(s.corsPolicy.maxAge))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// routeMux records the methods of every pattern registered with HandleFunc,
+// so preflight requests can answer with what is actually routed.
+type routeMux struct {
+	*goji.Mux
+	patterns []string
+	methods  map[string]map[string]bool
+}
+
+func newRouteMux() *routeMux {
+	return &routeMux{
+		Mux:     goji.NewMux(),
+		methods: make(map[string]map[string]bool),
+	}
+}
+
+func (m *routeMux) HandleFunc(p *pat.Pattern, h func(http.ResponseWriter, *http.Request)) {
+	k := p.String()
+	if _, ok := m.methods[k]; !ok {
+		m.patterns = append(m.patterns, k)
+		m.methods[k] = map[string]bool{http.MethodOptions: true}
+	}
+	for method := range p.HTTPMethods() {
+		m.methods[k][method] = true
+	}
+	m.Mux.HandleFunc(p, withRoute(k, h))
+}
+
+// Handle registers h without recording methods for preflight requests.
+func (m *routeMux) Handle(p *pat.Pattern, h http.Handler) {
+	m.Mux.HandleFunc(p, withRoute(p.String(), h.ServeHTTP))
+}
+
+// withRoute stores the pattern that matched the request for the access log
+// and the metrics.
+func withRoute(pattern string, h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ai := accessFromContext(r.Context()); ai != nil {
+			ai.route = pattern
+		}
+		h(w, r)
+	}
+}
+
+// handlePreflight registers an OPTIONS handler for every recorded pattern.
+func (m *routeMux) handlePreflight(f func(methods []string) func(http.ResponseWriter, *http.Request)) {
+	for _, k := range m.patterns {
+		methods := make([]string, 0, len(m.methods[k]))
+		for method := range m.methods[k] {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		m.Mux.HandleFunc(pat.Options(k), withRoute(k, f(methods)))
+	}
+}
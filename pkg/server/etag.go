@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"net/http"
+	"strings"
+)
+
+const errChanged = "the post was changed in the meantime, reload it and try again"
+
+// versionETag returns the strong entity tag of a post with version.
+func versionETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// contentETag returns a weak entity tag for the JSON encoding of v, or an
+// empty string if v can't be encoded.
+func contentETag(v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(buf)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setETag sends the entity tag of a post with version.
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", versionETag(version))
+}
+
+// etagList returns the entity tags of the header name of r.
+func etagList(r *http.Request, name string) []string {
+	tags := make([]string, 0)
+	for _, h := range r.Header.Values(name) {
+		for _, t := range strings.Split(h, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+// ifMatch reports whether the If-Match header of r, if any, matches a post
+// with version, otherwise it answers with 412.
+func ifMatch(w http.ResponseWriter, r *http.Request, version int) bool {
+	tags := etagList(r, "If-Match")
+	if len(tags) == 0 {
+		return true
+	}
+	etag := versionETag(version)
+	for _, t := range tags {
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	w.Header().Set("ETag", etag)
+	_, _ = helper.WriteError(w, http.StatusPreconditionFailed, errChanged)
+	return false
+}
+
+// notModified sends etag and reports whether it matches the If-None-Match
+// header of r, the request is answered with 304 then.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	for _, t := range etagList(r, "If-None-Match") {
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// writeUpdateError answers a request whose update of a post failed with err.
+// A concurrent change is a failed precondition if the client sent If-Match,
+// restoring a picture whose content was uploaded again is a conflict.
+func writeUpdateError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case store.ErrConflict:
+		status := http.StatusConflict
+		if len(etagList(r, "If-Match")) > 0 {
+			status = http.StatusPreconditionFailed
+		}
+		_, _ = helper.WriteError(w, status, errChanged)
+	case store.ErrNotFound:
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+	case store.ErrDuplicate:
+		_, _ = helper.WriteError(w, http.StatusConflict, "a picture with the same content exists")
+	default:
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	exportFormat = "bwof-export"
+	// exportVersion is raised whenever the layout of the archive or the
+	// exported records change incompatibly. Version 2 added the revisions,
+	// archives of version 1 are imported without history.
+	exportVersion = 2
+
+	exportManifest  = "manifest.json"
+	exportPictures  = "pictures.json"
+	exportInstagram = "instagram.json"
+	exportRevisions = "revisions.json"
+
+	kindPictures  = "pictures"
+	kindInstagram = "instagram"
+
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictReId      = "reid"
+)
+
+// manifest describes an export archive, it's always the first entry.
+type manifest struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	Created   time.Time `json:"created"`
+	Pictures  int       `json:"pictures"`
+	Instagram int       `json:"instagram"`
+	Revisions int       `json:"revisions"`
+}
+
+type importResult struct {
+	Imported    int `json:"imported"`
+	Overwritten int `json:"overwritten"`
+	Reassigned  int `json:"reassigned"`
+	Skipped     int `json:"skipped"`
+}
+
+// importPost is a post of an archive and what the import does with it.
+type importPost struct {
+	kind      string
+	id        uuid.UUID
+	skip      bool
+	picture   *models.Picture
+	instagram *models.Instagram
+	// revisions are nil if the archive has none, i.e. is of version 1
+	revisions []models.Revision
+}
+
+var errInvalidArchive = errors.New("invalid export archive")
+
+// writeExport writes all posts with their revisions and media files as
+// tar.gz archive to w. The archive starts with the manifest followed by the
+// records, the media files come last.
+func (s *Server) writeExport(w io.Writer) error {
+	pics, err := s.store.GetPictures()
+	if err != nil {
+		return err
+	}
+	inst, err := s.store.GetInstagrams()
+	if err != nil {
+		return err
+	}
+	ids := make([]uuid.UUID, 0, len(pics)+len(inst))
+	for _, p := range pics {
+		ids = append(ids, p.Id)
+	}
+	for _, i := range inst {
+		ids = append(ids, i.Id)
+	}
+	revs := make([]models.Revision, 0)
+	for _, id := range ids {
+		list, err := s.store.GetRevisions(id)
+		if err != nil {
+			return err
+		}
+		revs = append(revs, list...)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	m := manifest{
+		Format:    exportFormat,
+		Version:   exportVersion,
+		Created:   now.UTC(),
+		Pictures:  len(pics),
+		Instagram: len(inst),
+		Revisions: len(revs),
+	}
+	for _, x := range []struct {
+		name string
+		v    interface{}
+	}{
+		{exportManifest, m},
+		{exportPictures, pics},
+		{exportInstagram, inst},
+		{exportRevisions, revs},
+	} {
+		buf, err := json.MarshalIndent(x.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     x.name,
+			Mode:     0644,
+			Size:     int64(len(buf)),
+			ModTime:  now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range pics {
+		if err := addBlobsToTar(tw, s.blobs, mediaPrefix(kindPictures, p.Id)); err != nil {
+			return err
+		}
+	}
+	for _, i := range inst {
+		if err := addBlobsToTar(tw, s.blobs, mediaPrefix(kindInstagram, i.Id)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// getExport streams all posts as export archive.
+func (s *Server) getExport(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("bwof-export-%s.tar.gz", time.Now().UTC().Format(backupTimeFormat))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Content-Type", "application/gzip")
+	liftDeadlines(w, r)
+
+	if err := s.writeExport(w); err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("file", name).Msg("export failed")
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("file", name).Msg("export")
+}
+
+// postImport recreates the posts of an export archive sent as request body.
+// `conflict` decides what happens with posts whose id already exists: skip
+// them (default), overwrite the existing post or import them with a new id.
+// Imported posts get the revisions of the archive, replacing their own.
+func (s *Server) postImport(w http.ResponseWriter, r *http.Request) {
+	conflict := r.URL.Query().Get("conflict")
+	switch conflict {
+	case "":
+		conflict = conflictSkip
+	case conflictSkip, conflictOverwrite, conflictReId:
+	default:
+		_, _ = helper.WriteError(w, http.StatusBadRequest,
+			fmt.Sprintf("conflict must be %s, %s or %s", conflictSkip, conflictOverwrite, conflictReId))
+		return
+	}
+
+	liftDeadlines(w, r)
+	res, err := s.importArchive(r.Body, conflict)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("import failed")
+		status := http.StatusInternalServerError
+		if errors.Is(err, errInvalidArchive) {
+			status = http.StatusBadRequest
+		}
+		_, _ = helper.WriteError(w, status, err.Error())
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Interface("result", res).Msg("import")
+	_, _ = helper.WriteJson(w, http.StatusOK, res)
+}
+
+// importArchive reads an export archive from r. The media files are
+// extracted into a staging directory first, the posts are only stored after
+// the whole archive was read successfully.
+func (s *Server) importArchive(r io.Reader, conflict string) (*importResult, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidArchive, err)
+	}
+	tr := tar.NewReader(gz)
+
+	var m manifest
+	if err := readTarJson(tr, exportManifest, &m); err != nil {
+		return nil, err
+	}
+	if m.Format != exportFormat {
+		return nil, fmt.Errorf("%w: unknown format %q", errInvalidArchive, m.Format)
+	}
+	if m.Version < 1 || m.Version > exportVersion {
+		return nil, fmt.Errorf("%w: version %d, this build supports up to %d",
+			errInvalidArchive, m.Version, exportVersion)
+	}
+
+	var pics []models.Picture
+	var inst []models.Instagram
+	if err := readTarJson(tr, exportPictures, &pics); err != nil {
+		return nil, err
+	}
+	if err := readTarJson(tr, exportInstagram, &inst); err != nil {
+		return nil, err
+	}
+	var revs []models.Revision
+	if m.Version >= 2 {
+		if err := readTarJson(tr, exportRevisions, &revs); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &importResult{}
+	posts := make(map[string]*importPost)
+	for i := range pics {
+		p := &pics[i]
+		_, err := s.store.GetPicture(p.Id)
+		ip := planImport(kindPictures, p.Id, err == nil, conflict, res)
+		ip.picture = p
+		posts[kindPictures+"/"+p.Id.String()] = ip
+	}
+	for i := range inst {
+		p := &inst[i]
+		_, err := s.store.GetInstagram(p.Id)
+		ip := planImport(kindInstagram, p.Id, err == nil, conflict, res)
+		ip.instagram = p
+		posts[kindInstagram+"/"+p.Id.String()] = ip
+	}
+	if revs != nil {
+		for _, ip := range posts {
+			ip.revisions = make([]models.Revision, 0)
+		}
+	}
+	for _, rev := range revs {
+		ip, ok := posts[kindPictures+"/"+rev.PostId.String()]
+		if !ok {
+			ip, ok = posts[kindInstagram+"/"+rev.PostId.String()]
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: revision %d of %s belongs to no post",
+				errInvalidArchive, rev.Number, rev.PostId)
+		}
+		ip.revisions = append(ip.revisions, rev)
+	}
+
+	staging, err := ioutil.TempDir(s.cfg.DataDir, ".import-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(staging)
+	}()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errInvalidArchive, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		parts := strings.Split(hdr.Name, "/")
+		if len(parts) != 3 || parts[2] != path.Base(parts[2]) || strings.HasPrefix(parts[2], ".") {
+			return nil, fmt.Errorf("%w: unexpected entry %q", errInvalidArchive, hdr.Name)
+		}
+		ip, ok := posts[parts[0]+"/"+parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q belongs to no post", errInvalidArchive, hdr.Name)
+		}
+		if ip.skip {
+			continue
+		}
+		if err := extractFile(tr, path.Join(staging, ip.kind, ip.id.String()), parts[2]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ip := range posts {
+		if ip.skip {
+			continue
+		}
+		if err := s.storeImport(ip, staging); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// planImport decides what happens with a post of the archive and counts it.
+func planImport(kind string, id uuid.UUID, exists bool, conflict string, res *importResult) *importPost {
+	ip := &importPost{kind: kind, id: id}
+	switch {
+	case !exists:
+		res.Imported++
+	case conflict == conflictOverwrite:
+		res.Overwritten++
+	case conflict == conflictReId:
+		ip.id = uuid.New()
+		res.Reassigned++
+	default:
+		ip.skip = true
+		res.Skipped++
+	}
+	return ip
+}
+
+// storeImport copies the staged media of a post into the media store and
+// stores the post with its urls pointing to this instance and its revisions.
+func (s *Server) storeImport(ip *importPost, staging string) error {
+	unlock := s.postLocks.lock(ip.id)
+	defer unlock()
+
+	if err := s.blobs.DeletePrefix(mediaPrefix(ip.kind, ip.id)); err != nil {
+		return err
+	}
+	src := path.Join(staging, ip.kind, ip.id.String())
+	files, err := ioutil.ReadDir(src)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range files {
+		if err := s.putFile(mediaKey(ip.kind, ip.id, fi.Name()), path.Join(src, fi.Name())); err != nil {
+			return err
+		}
+	}
+
+	id := ip.id.String()
+	if p := ip.picture; p != nil {
+		p.Id = ip.id
+		// the hash stays with the post that already has the same content,
+		// e.g. the original of a post imported with a new id
+		if o, err := s.store.GetPictureByHash(p.Hash); err == nil && o.Id != p.Id {
+			p.Hash = ""
+		}
+		p.OriginalUrl = mediaUrl(kindPictures, id, p.OriginalUrl)
+		p.ThumbnailUrl = mediaUrl(kindPictures, id, p.ThumbnailUrl)
+		p.CroppedUrl = mediaUrl(kindPictures, id, p.CroppedUrl)
+		p.ThumbCroppedUrl = mediaUrl(kindPictures, id, p.ThumbCroppedUrl)
+		for i := range p.Renditions {
+			p.Renditions[i].Url = mediaUrl(kindPictures, id, p.Renditions[i].Url)
+		}
+		// insert replaces an existing post and continues its version
+		if err := s.store.InsertPicture(p); err != nil {
+			return err
+		}
+	} else {
+		i := ip.instagram
+		i.Id = ip.id
+		i.ThumbnailUrl = mediaUrl(kindInstagram, id, i.ThumbnailUrl)
+		if err := s.store.InsertInstagram(i); err != nil {
+			return err
+		}
+	}
+	return s.importRevisions(ip)
+}
+
+// importRevisions replaces the revisions of an imported post with the ones
+// of the archive, they are numbered again in their order. Posts of archives
+// without revisions keep theirs.
+func (s *Server) importRevisions(ip *importPost) error {
+	if ip.revisions == nil {
+		return nil
+	}
+	if err := s.store.DeleteRevisions(ip.id); err != nil {
+		return err
+	}
+	sort.Slice(ip.revisions, func(i, j int) bool {
+		return ip.revisions[i].Number < ip.revisions[j].Number
+	})
+	for i := range ip.revisions {
+		rev := ip.revisions[i]
+		rev.PostId = ip.id
+		if err := s.store.AddRevision(&rev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mediaUrl rewrites the url of a media file, absolute or relative, to the
+// path it's served from by this instance.
+func mediaUrl(kind, id, u string) string {
+	if u == "" {
+		return ""
+	}
+	return fmt.Sprintf("/%s/%s/%s", kind, id, path.Base(u))
+}
+
+// putFile stores the file name as key.
+func (s *Server) putFile(key, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer helper.Close(f, name)
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.blobs.Put(key, f, fi.Size())
+}
+
+// readTarJson decodes the next entry of tr, which must be called name, into v.
+func readTarJson(tr *tar.Reader, name string, v interface{}) error {
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidArchive, err)
+	}
+	if hdr.Name != name {
+		return fmt.Errorf("%w: expected %s, got %s", errInvalidArchive, name, hdr.Name)
+	}
+	if err := json.NewDecoder(tr).Decode(v); err != nil {
+		return fmt.Errorf("%w: %s: %s", errInvalidArchive, name, err)
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, dir, name string) error {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
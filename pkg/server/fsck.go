@@ -0,0 +1,424 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nfnt/resize"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/blob"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Types of FsckIssue.
+const (
+	IssueOrphan         = "orphan"
+	IssueDanglingRecord = "dangling_record"
+	IssueMissingFile    = "missing_file"
+	IssueStaleFile      = "stale_file"
+	IssueUndecodable    = "undecodable_record"
+	IssueIndex          = "index"
+
+	// fsckGracePeriod protects files of uploads that are still in progress,
+	// newer files are never reported as orphan or stale.
+	fsckGracePeriod = 10 * time.Minute
+
+	quarantineDir = "quarantine"
+)
+
+// FsckIssue is an inconsistency between the records and the media store.
+type FsckIssue struct {
+	Type string `json:"type"`
+	// Path is the key of the affected file or directory in the media store,
+	// or bucket and key of a record.
+	Path     string `json:"path"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+// FsckReport is the result of Fsck.
+type FsckReport struct {
+	Started   time.Time   `json:"started"`
+	Repair    bool        `json:"repair"`
+	Pictures  int         `json:"pictures"`
+	Instagram int         `json:"instagram"`
+	Issues    []FsckIssue `json:"issues"`
+}
+
+// Ok reports whether no issue is left unrepaired.
+func (r *FsckReport) Ok() bool {
+	for _, i := range r.Issues {
+		if !i.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// postFile is a file of a post, thumbnails and renditions name the file
+// they're generated from as source, renditions also their width.
+type postFile struct {
+	name   string
+	source string
+	width  int
+}
+
+// fsck holds the state of one run.
+type fsck struct {
+	s          *Server
+	report     *FsckReport
+	quarantine string
+}
+
+// Fsck compares the records with the media store and reports orphan
+// directories and files, records without directory, missing files and
+// records that can't be decoded. With repair missing thumbnails and
+// renditions are regenerated, indexes rebuilt and orphan and stale files moved
+// below `quarantine/` of the media store, each post while holding its lock.
+// Records are never changed.
+func (s *Server) Fsck(repair bool) (*FsckReport, error) {
+	now := time.Now()
+	c := &fsck{
+		s: s,
+		report: &FsckReport{
+			Started: now.UTC(),
+			Repair:  repair,
+			Issues:  make([]FsckIssue, 0),
+		},
+		quarantine: path.Join(quarantineDir, now.UTC().Format(backupTimeFormat)),
+	}
+
+	recErrs, err := s.store.CheckRecords()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]map[string][]postFile{
+		kindPictures:  make(map[string][]postFile),
+		kindInstagram: make(map[string][]postFile),
+	}
+	indexBroken := false
+	for _, e := range recErrs {
+		if e.Index {
+			indexBroken = true
+			c.add(FsckIssue{Type: IssueIndex, Path: e.Bucket + "/" + e.Key, Detail: e.Error}, repair)
+			continue
+		}
+		c.add(FsckIssue{Type: IssueUndecodable, Path: e.Bucket + "/" + e.Key, Detail: e.Error}, false)
+		// the media of undecodable posts are neither orphan nor stale
+		if m, ok := known[e.Bucket]; ok {
+			m[e.Key] = nil
+		}
+	}
+	if indexBroken && repair {
+		if err := s.store.RepairIndexes(); err != nil {
+			return nil, err
+		}
+	}
+
+	pics, err := s.store.GetPictures()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pics {
+		known[kindPictures][p.Id.String()] = picturePostFiles(p)
+	}
+	inst, err := s.store.GetInstagrams()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range inst {
+		known[kindInstagram][i.Id.String()] = instagramPostFiles(i)
+	}
+	c.report.Pictures, c.report.Instagram = len(pics), len(inst)
+
+	for _, kind := range []string{kindPictures, kindInstagram} {
+		if err := c.checkMedia(kind, known[kind], repair); err != nil {
+			return nil, err
+		}
+	}
+	return c.report, nil
+}
+
+// picturePostFiles returns the files of the picture p.
+func picturePostFiles(p models.Picture) []postFile {
+	files := pictureFiles(p.OriginalPath, p.ThumbnailPath, p.CroppedPath, p.ThumbCroppedPath)
+	for _, r := range p.Renditions {
+		source := p.OriginalPath
+		if r.Cropped {
+			source = p.CroppedPath
+		}
+		files = append(files, postFile{name: filepath.Base(r.Path), source: source, width: r.Width})
+	}
+	return files
+}
+
+// instagramPostFiles returns the files of the Instagram post i.
+func instagramPostFiles(i models.Instagram) []postFile {
+	return pictureFiles("", i.ThumbnailPath, "", "")
+}
+
+// pictureFiles returns the files of a post, thumb is generated from orig and
+// thumbCrop from crop.
+func pictureFiles(orig, thumb, crop, thumbCrop string) []postFile {
+	files := make([]postFile, 0, 4)
+	for _, f := range []postFile{{orig, "", 0}, {thumb, orig, 0}, {crop, "", 0}, {thumbCrop, crop, 0}} {
+		if f.name != "" {
+			files = append(files, postFile{name: filepath.Base(f.name), source: f.source})
+		}
+	}
+	return files
+}
+
+func (c *fsck) add(i FsckIssue, repaired bool) {
+	i.Repaired = repaired
+	c.report.Issues = append(c.report.Issues, i)
+}
+
+// addErr records an issue whose repair failed or wasn't attempted.
+func (c *fsck) addErr(i FsckIssue, repair bool, err error) {
+	if repair && err != nil {
+		log.Error().Err(err).Str("path", i.Path).Msg("fsck repair failed")
+		i.Detail = fmt.Sprintf("%s, repair failed: %s", i.Detail, err)
+	}
+	c.add(i, repair && err == nil)
+}
+
+// checkMedia compares the stored media of kind, grouped by post, with the
+// records of kind.
+func (c *fsck) checkMedia(kind string, known map[string][]postFile, repair bool) error {
+	infos, err := c.s.blobs.List(kind + "/")
+	if err != nil {
+		return err
+	}
+	posts := make(map[string][]blob.Info)
+	ids := make([]string, 0)
+	for _, i := range infos {
+		rest := strings.TrimPrefix(i.Key, kind+"/")
+		n := strings.Index(rest, "/")
+		if n < 0 {
+			if time.Since(i.Modified) >= fsckGracePeriod {
+				f := FsckIssue{Type: IssueOrphan, Path: i.Key, Detail: "file outside of a post directory"}
+				c.addErr(f, repair, c.quarantineBlob(i.Key, repair))
+			}
+			continue
+		}
+		id := rest[:n]
+		if _, ok := posts[id]; !ok {
+			ids = append(ids, id)
+		}
+		posts[id] = append(posts[id], i)
+	}
+	for id := range known {
+		if _, ok := posts[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		files, found := known[id]
+		if found && files == nil {
+			// undecodable
+			continue
+		}
+		if err := c.checkPostDir(kind, id, files, found, posts[id], repair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPostDir checks the directory of the post id. With repair it holds
+// the lock of the post and reads its record and files again, the state read
+// at the start of the run may be outdated by changes of the post since.
+func (c *fsck) checkPostDir(kind, id string, files []postFile, found bool, infos []blob.Info, repair bool) error {
+	if uid, err := uuid.Parse(id); err == nil && repair {
+		unlock := c.s.postLocks.lock(uid)
+		defer unlock()
+		if files, found, infos, err = c.reload(kind, uid); err != nil {
+			return err
+		}
+		if found && files == nil {
+			return nil
+		}
+	}
+
+	rel := path.Join(kind, id)
+	switch {
+	case !found:
+		for _, i := range infos {
+			if time.Since(i.Modified) < fsckGracePeriod {
+				return nil
+			}
+		}
+		f := FsckIssue{Type: IssueOrphan, Path: rel, Detail: "no post for this directory"}
+		c.addErr(f, repair, c.quarantinePost(rel+"/", infos, repair))
+	case len(infos) == 0:
+		c.add(FsckIssue{Type: IssueDanglingRecord, Path: rel, Detail: "post directory is missing"}, false)
+	default:
+		c.checkPost(rel, infos, files, repair)
+	}
+	return nil
+}
+
+// reload reads the files of the post id of kind and its stored media. found
+// is false if there is no such post, files nil if its record can't be
+// decoded.
+func (c *fsck) reload(kind string, id uuid.UUID) (files []postFile, found bool, infos []blob.Info, err error) {
+	if infos, err = c.s.blobs.List(mediaPrefix(kind, id)); err != nil {
+		return nil, false, nil, err
+	}
+	if kind == kindPictures {
+		var p *models.Picture
+		p, err = c.s.store.GetPicture(id)
+		if err == nil {
+			files = picturePostFiles(*p)
+		}
+	} else {
+		var i *models.Instagram
+		i, err = c.s.store.GetInstagram(id)
+		if err == nil {
+			files = instagramPostFiles(*i)
+		}
+	}
+	switch {
+	case err == store.ErrNotFound:
+		return nil, false, infos, nil
+	case err != nil:
+		log.Warn().Err(err).Str("id", id.String()).Msg("fsck: unable to read post")
+		return nil, true, infos, nil
+	}
+	return files, true, infos, nil
+}
+
+// checkPost reports missing files of a post and files that don't belong to
+// it.
+func (c *fsck) checkPost(rel string, infos []blob.Info, files []postFile, repair bool) {
+	referenced := make(map[string]bool)
+	for _, f := range files {
+		referenced[f.name] = true
+	}
+	exists := make(map[string]bool)
+	for _, i := range infos {
+		name := strings.TrimPrefix(i.Key, rel+"/")
+		exists[name] = true
+		if referenced[name] || time.Since(i.Modified) < fsckGracePeriod {
+			continue
+		}
+		f := FsckIssue{Type: IssueStaleFile, Path: i.Key, Detail: "not referenced by the post"}
+		c.addErr(f, repair, c.quarantineBlob(i.Key, repair))
+	}
+
+	for _, f := range files {
+		if exists[f.name] {
+			continue
+		}
+		i := FsckIssue{Type: IssueMissingFile, Path: path.Join(rel, f.name)}
+		if f.source == "" || !exists[filepath.Base(f.source)] {
+			i.Detail = "can't be regenerated"
+			c.add(i, false)
+			continue
+		}
+		src := path.Join(rel, filepath.Base(f.source))
+		var err error
+		if f.width > 0 {
+			i.Detail = "rendition"
+			if repair {
+				err = c.s.writeRendition(src, i.Path, f.width)
+			}
+		} else {
+			i.Detail = "thumbnail"
+			if repair {
+				err = c.s.writeThumbnail(src, i.Path)
+			}
+		}
+		c.addErr(i, repair, err)
+	}
+}
+
+// quarantineBlob moves key into the quarantine prefix of this run, it does
+// nothing unless repair is set.
+func (c *fsck) quarantineBlob(key string, repair bool) error {
+	if !repair {
+		return nil
+	}
+	rc, info, err := c.s.blobs.Get(key)
+	if err != nil {
+		return err
+	}
+	err = c.s.blobs.Put(path.Join(c.quarantine, key), rc, info.Size)
+	helper.CloseRC(rc, key)
+	if err != nil {
+		return err
+	}
+	return c.s.blobs.Delete(key)
+}
+
+// quarantinePost moves all files of an orphan post into quarantine.
+func (c *fsck) quarantinePost(prefix string, infos []blob.Info, repair bool) error {
+	if !repair {
+		return nil
+	}
+	for _, i := range infos {
+		if err := c.quarantineBlob(i.Key, repair); err != nil {
+			return err
+		}
+	}
+	return c.s.blobs.DeletePrefix(prefix)
+}
+
+// writeThumbnail generates the thumbnail dst from the image src, the format
+// follows the extension of dst.
+func (s *Server) writeThumbnail(src, dst string) error {
+	img, err := s.decodeBlob(src)
+	if err != nil {
+		return err
+	}
+	thumb := resize.Thumbnail(s.cfg.ThumbnailSize, s.cfg.ThumbnailSize, img, resize.Lanczos3)
+	buf, err := encodeImage(thumb, dst)
+	if err != nil {
+		return err
+	}
+	return s.putBlob(dst, buf)
+}
+
+// writeRendition generates the rendition dst of width from the image src, the
+// format follows the extension of dst.
+func (s *Server) writeRendition(src, dst string, width int) error {
+	img, err := s.decodeBlob(src)
+	if err != nil {
+		return err
+	}
+	buf, err := encodeImage(resize.Resize(uint(width), 0, img, resize.Lanczos3), dst)
+	if err != nil {
+		return err
+	}
+	return s.putBlob(dst, buf)
+}
+
+// getFsck reports inconsistencies without changing anything.
+func (s *Server) getFsck(w http.ResponseWriter, r *http.Request) {
+	s.runFsck(w, r, false)
+}
+
+// postFsck reports inconsistencies and repairs what can be repaired.
+func (s *Server) postFsck(w http.ResponseWriter, r *http.Request) {
+	s.runFsck(w, r, true)
+}
+
+func (s *Server) runFsck(w http.ResponseWriter, r *http.Request, repair bool) {
+	report, err := s.Fsck(repair)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("fsck failed")
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Ctx(r.Context()).Info().Bool("repair", repair).Int("issues", len(report.Issues)).
+		Bool("ok", report.Ok()).Msg("fsck")
+	_, _ = helper.WriteJson(w, http.StatusOK, report)
+}
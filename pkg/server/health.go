@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"net/http"
+)
+
+const (
+	healthOk   = "ok"
+	healthFail = "fail"
+)
+
+type healthCheck struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+func newHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+	return healthCheck{Ok: true}
+}
+
+// getHealth reports that the process is alive and serving requests.
+func (s *Server) getHealth(w http.ResponseWriter, _ *http.Request) {
+	_, _ = helper.WriteJson(w, http.StatusOK, healthResponse{Status: healthOk})
+}
+
+// getReady reports whether the server is able to handle requests, it answers
+// with 503 if any check fails.
+func (s *Server) getReady(w http.ResponseWriter, _ *http.Request) {
+	checks := map[string]healthCheck{
+		"database":        newHealthCheck(s.store.Ping()),
+		"media_store":     newHealthCheck(s.blobs.Ping()),
+		"disk_space":      newHealthCheck(s.checkDiskSpace()),
+		"instagram_token": newHealthCheck(s.checkInstagramToken()),
+	}
+
+	res := healthResponse{
+		Status: healthOk,
+		Checks: checks,
+	}
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.Ok {
+			res.Status = healthFail
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	_, _ = helper.WriteJson(w, status, res)
+}
+
+func (s *Server) checkDiskSpace() error {
+	free, err := helper.FreeDiskSpace(s.cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	if free < s.cfg.MinFreeDisk {
+		return fmt.Errorf("%d MB free, need at least %d MB", free>>20, s.cfg.MinFreeDisk>>20)
+	}
+	return nil
+}
+
+func (s *Server) checkInstagramToken() error {
+	if s.cfg.InstagramToken == "" {
+		return fmt.Errorf("no instagram access token configured")
+	}
+	return nil
+}
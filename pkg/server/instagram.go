@@ -7,22 +7,21 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/rverst/bwof-backend/pkg/helper"
 	"github.com/rverst/bwof-backend/pkg/models"
+	"github.com/rverst/bwof-backend/pkg/store"
 	"goji.io/pat"
 	"net/http"
-	"os"
-	"path"
-	"sort"
+	"time"
 )
 
-func getInstagram(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getInstagram(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(pat.Param(r, "id"))
 	if err != nil {
-		log.Error().Err(err).Msgf("unable to parse id: %s", id)
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
 		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
 		return
 	}
 
-	post, err := getDbInstagram(id)
+	post, err := s.store.GetInstagram(id)
 	if err != nil {
 		res := models.Response{
 			Status: http.StatusNotFound,
@@ -31,90 +30,111 @@ func getInstagram(w http.ResponseWriter, r *http.Request) {
 		_, _ = helper.WriteJson(w, res.Status, res)
 		return
 	}
-
-	_, _ = helper.WriteJson(w, http.StatusOK, fromInsta(*post))
-}
-
-func getInstagrams(w http.ResponseWriter, _ *http.Request) {
-	posts, err := getDbInstagrams()
-	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusNotFound, "")
+	if !post.DeletedAt.IsZero() && !canModify(r, post.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusNotFound, store.ErrNotFound.Error())
 		return
 	}
-
-	if len(posts) == 0 {
-		_, _ = helper.WriteError(w, http.StatusNotFound, "no pictures found in database")
+	if notModified(w, r, versionETag(post.Version)) {
 		return
 	}
 
-	sort.Slice(posts, func(i, j int) bool {
-		return posts[i].Uploaded.After(posts[j].Uploaded)
-	})
-
-	list := make([]pictureResponse, len(posts))
-	for i, p := range posts {
-		list[i] = fromInsta(p)
-	}
+	_, _ = helper.WriteJson(w, http.StatusOK, fromInsta(*post))
+}
 
-	_, _ = helper.WriteJson(w, http.StatusOK, list)
+func (s *Server) getInstagrams(w http.ResponseWriter, r *http.Request) {
+	s.listPosts(w, r, store.TypeInstagram, "no pictures found in database")
 }
 
-func disableInstagram(w http.ResponseWriter, r *http.Request) {
+func (s *Server) disableInstagram(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(pat.Param(r, "id"))
 	if err != nil {
-		log.Error().Err(err).Msgf("unable to parse id: %s", id)
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
 		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
 		return
 	}
+	unlock := s.postLocks.lock(id)
+	defer unlock()
 	var body disableBody
 	err = json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
 		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	log.Info().Str("id", id.String()).Interface("body", body).Msg("disableInstagram")
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Interface("body", body).Msg("disableInstagram")
 
-	post, err := getDbInstagram(id)
+	post, err := s.store.GetInstagram(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	if err != nil {
 		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !canModify(r, post.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, post.Version) {
+		return
+	}
+	if !post.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, errTrashed)
+		return
+	}
 
+	before := instaState(post)
 	post.Disabled = body.Disable
-	err = updateInstagram(post)
+	err = s.updatePost(r, store.Post{Instagram: post}, models.RevisionDisable, before, 0)
 	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeUpdateError(w, r, err)
 		return
 	}
 
+	setETag(w, post.Version)
 	_, _ = helper.WriteJson(w, http.StatusOK, fromInsta(*post))
 }
 
-func deleteInstagram(w http.ResponseWriter, r *http.Request) {
+func (s *Server) deleteInstagram(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(pat.Param(r, "id"))
 	if err != nil {
-		log.Error().Err(err).Msgf("unable to parse id: %s", id)
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
 		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
 		return
 	}
-	log.Info().Str("id", id.String()).Msg("deleteInstagram")
+	unlock := s.postLocks.lock(id)
+	defer unlock()
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Msg("deleteInstagram")
 
-	post, err := getDbInstagram(id)
-	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+	post, err := s.store.GetInstagram(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
 		return
 	}
-
-	err = deleteDbInstagram(post.Id)
 	if err != nil {
 		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !canModify(r, post.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, post.Version) {
+		return
+	}
+	if !post.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, errTrashed)
+		return
+	}
 
-	p := path.Join(instaPostDir, post.Id.String())
-	err = os.RemoveAll(p)
+	post.DeletedAt = time.Now()
+	post.DeletedBy = uploaderName(r)
+	err = s.store.UpdateInstagram(post)
 	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeUpdateError(w, r, err)
 		return
 	}
+
+	setETag(w, post.Version)
+	_, _ = helper.WriteJson(w, http.StatusOK, fromInsta(*post))
 }
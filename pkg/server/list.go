@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	headerNextCursor = "X-Next-Cursor"
+
+	defaultListLimit = 50
+	maxListLimit     = 200
+
+	sortUploadedAsc  = "uploaded"
+	sortUploadedDesc = "-uploaded"
+)
+
+// parseListOptions reads the paging, filter and sort parameters of a list
+// request:
+//
+//	limit     number of posts per page, 1 to maxListLimit, defaultListLimit
+//	          if only cursor is given and all posts if neither is
+//	cursor    the X-Next-Cursor of the previous page
+//	sort      "-uploaded" (newest first, default) or "uploaded"
+//	type      "picture" or "instagram"
+//	disabled  true or false
+//	uploader  name of the uploader
+//	from, to  upload time range as RFC 3339 time or date, both inclusive
+//
+// The filters are applied while walking the posts in upload order, a page of
+// a rare match may have to look at many posts, from and to don't.
+func parseListOptions(r *http.Request) (store.ListOptions, error) {
+	q := r.URL.Query()
+	o := store.ListOptions{
+		Cursor:   q.Get("cursor"),
+		Uploader: q.Get("uploader"),
+	}
+	if o.Cursor != "" {
+		o.Limit = defaultListLimit
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return o, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		o.Limit = n
+	}
+
+	switch q.Get("sort") {
+	case "", sortUploadedDesc:
+	case sortUploadedAsc:
+		o.Ascending = true
+	default:
+		return o, fmt.Errorf("sort must be %q or %q", sortUploadedDesc, sortUploadedAsc)
+	}
+
+	switch strings.ToLower(q.Get("type")) {
+	case "":
+	case "picture", strconv.Itoa(store.TypePicture):
+		o.Type = store.TypePicture
+	case "instagram", strconv.Itoa(store.TypeInstagram):
+		o.Type = store.TypeInstagram
+	default:
+		return o, fmt.Errorf("type must be picture or instagram")
+	}
+
+	if v := q.Get("disabled"); v != "" {
+		d, err := strconv.ParseBool(v)
+		if err != nil {
+			return o, fmt.Errorf("disabled must be true or false")
+		}
+		o.Disabled = &d
+	}
+
+	var err error
+	if o.From, err = parseListTime(q.Get("from"), false); err != nil {
+		return o, fmt.Errorf("invalid from: %s", err)
+	}
+	if o.To, err = parseListTime(q.Get("to"), true); err != nil {
+		return o, fmt.Errorf("invalid to: %s", err)
+	}
+	return o, nil
+}
+
+// hasListFilters reports whether r restricts the posts it lists, an empty
+// result then is a valid answer and not a missing resource.
+func hasListFilters(r *http.Request) bool {
+	q := r.URL.Query()
+	for _, k := range []string{"type", "disabled", "uploader", "from", "to"} {
+		if q.Get(k) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseListTime parses an RFC 3339 time or a date, a date given as upper
+// bound includes the whole day.
+func parseListTime(v string, upper bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return t, fmt.Errorf("expected RFC 3339 time or date, got %q", v)
+	}
+	if upper {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// listPosts answers a list request with the page of posts selected by its
+// parameters, typ overrides the type parameter unless it's 0. The cursor of
+// the next page is sent in the X-Next-Cursor header.
+func (s *Server) listPosts(w http.ResponseWriter, r *http.Request, typ int, notFound string) {
+	o, err := parseListOptions(r)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if typ != 0 {
+		o.Type = typ
+	}
+	s.writePosts(w, r, o, notFound)
+}
+
+// writePosts answers a list request with the page of posts selected by o, it
+// answers with 304 if the page matches If-None-Match. A listing without any
+// posts is answered with 404 and notFound, unless the request has filters or
+// a cursor.
+func (s *Server) writePosts(w http.ResponseWriter, r *http.Request, o store.ListOptions, notFound string) {
+	posts, next, err := s.store.ListPosts(o)
+	if err == store.ErrInvalidCursor {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error listing posts")
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, "unable to list posts")
+		return
+	}
+
+	if len(posts) == 0 && o.Cursor == "" && !hasListFilters(r) {
+		_, _ = helper.WriteError(w, http.StatusNotFound, notFound)
+		return
+	}
+
+	list := make([]pictureResponse, len(posts))
+	for i, p := range posts {
+		if p.Picture != nil {
+			list[i] = fromPicture(*p.Picture)
+		} else {
+			list[i] = fromInsta(*p.Instagram)
+		}
+	}
+
+	if next != "" {
+		w.Header().Set(headerNextCursor, next)
+	}
+	if notModified(w, r, contentETag([]interface{}{list, next})) {
+		return
+	}
+	_, _ = helper.WriteJson(w, http.StatusOK, list)
+}
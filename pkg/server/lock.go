@@ -0,0 +1,46 @@
+package server
+
+import (
+	"github.com/google/uuid"
+	"sync"
+)
+
+// postLocks serializes changes of the same post within this process, e.g. two
+// crops that would otherwise write the renditions at the same time. Changes
+// by other replicas are caught by the versions of the store. The zero value
+// is ready to use.
+type postLocks struct {
+	mu    sync.Mutex
+	locks map[uuid.UUID]*postLock
+}
+
+type postLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock blocks until no other request holds the lock of the post id and
+// returns the function that releases it.
+func (l *postLocks) lock(id uuid.UUID) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[uuid.UUID]*postLock)
+	}
+	pl, ok := l.locks[id]
+	if !ok {
+		pl = &postLock{}
+		l.locks[id] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	pl.mu.Lock()
+	return func() {
+		pl.mu.Unlock()
+		l.mu.Lock()
+		if pl.refs--; pl.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+const (
+	headerRequestId = "X-Request-ID"
+	// maxRequestIdLength limits the size of request ids accepted from
+	// clients or proxies.
+	maxRequestIdLength = 128
+)
+
+// accessInfo collects details about a request while it is handled, handlers
+// deeper in the chain fill in what the access log can't see from outside.
+type accessInfo struct {
+	route string
+	user  string
+	// quiet suppresses the access log line, e.g. for frequent probes.
+	quiet bool
+}
+
+type ctxKeyAccess struct{}
+
+func accessFromContext(ctx context.Context) *accessInfo {
+	a, _ := ctx.Value(ctxKeyAccess{}).(*accessInfo)
+	return a
+}
+
+// statusWriter records the status code and the number of bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap lets liftDeadlines reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// quiet excludes requests handled by f from the access log.
+func quiet(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ai := accessFromContext(r.Context()); ai != nil {
+			ai.quiet = true
+		}
+		f(w, r)
+	}
+}
+
+// validRequestId reports whether id, as sent by a client, can be used as is.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequests assigns every request an id, stores a logger carrying the id
+// in the request context (see log.Ctx) and writes one access log line and the
+// request metrics per request after it was handled.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(headerRequestId)
+		if !validRequestId(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(headerRequestId, id)
+
+		l := log.With().Str("request_id", id).Logger()
+		ai := &accessInfo{}
+		ctx := context.WithValue(l.WithContext(r.Context()), ctxKeyAccess{}, ai)
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		s.metrics.observeRequest(ai.route, r.Method, sw.status, time.Since(start))
+
+		if ai.quiet {
+			return
+		}
+
+		var e *zerolog.Event
+		switch {
+		case sw.status >= 500:
+			e = l.Error()
+		case sw.status >= 400:
+			e = l.Warn()
+		default:
+			e = l.Info()
+		}
+		e.Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("route", ai.route).
+			Int("status", sw.status).
+			Int("bytes", sw.bytes).
+			Dur("latency", time.Since(start)).
+			Str("remote", r.RemoteAddr).
+			Str("user_agent", r.UserAgent())
+		if ai.user != "" {
+			e.Str("user", ai.user)
+		}
+		e.Msg("access")
+	})
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/blob"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blobStore returns the media store configured by c.
+func (c Config) blobStore() (blob.Store, error) {
+	if c.MediaStore == MediaStoreS3 {
+		return blob.NewS3(blob.S3Config{
+			Endpoint:  c.S3Endpoint,
+			Region:    c.S3Region,
+			Bucket:    c.S3Bucket,
+			AccessKey: c.S3AccessKey,
+			SecretKey: c.S3SecretKey,
+			PathStyle: c.S3PathStyle,
+			Prefix:    c.S3Prefix,
+		})
+	}
+	return blob.NewFS(c.DataDir)
+}
+
+// mediaKey returns the blob key of a file of a post, which is also the path
+// the file is served at.
+func mediaKey(kind string, id uuid.UUID, name string) string {
+	return path.Join(kind, id.String(), path.Base(name))
+}
+
+// mediaPrefix returns the common prefix of the keys of all files of a post.
+func mediaPrefix(kind string, id uuid.UUID) string {
+	return kind + "/" + id.String() + "/"
+}
+
+// encodeImage encodes img as png if name has that extension and as jpeg
+// otherwise.
+func encodeImage(img image.Image, name string) (*bytes.Buffer, error) {
+	buf := &bytes.Buffer{}
+	var err error
+	if strings.EqualFold(path.Ext(name), ".png") {
+		err = png.Encode(buf, img)
+	} else {
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: 100})
+	}
+	return buf, err
+}
+
+// imageHash returns the sha256 of the decoded pixels of img, so a picture is
+// recognized regardless of file name and metadata.
+func imageHash(img image.Image) string {
+	h := sha256.New()
+	b := img.Bounds()
+	_, _ = fmt.Fprintf(h, "%T %d %d\n", img, b.Dx(), b.Dy())
+	switch i := img.(type) {
+	case *image.YCbCr:
+		_, _ = fmt.Fprintf(h, "%d\n", i.SubsampleRatio)
+		_, _ = h.Write(i.Y)
+		_, _ = h.Write(i.Cb)
+		_, _ = h.Write(i.Cr)
+	case *image.NRGBA:
+		_, _ = h.Write(i.Pix)
+	case *image.RGBA:
+		_, _ = h.Write(i.Pix)
+	case *image.Gray:
+		_, _ = h.Write(i.Pix)
+	default:
+		px := make([]byte, 8)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				cr, cg, cb, ca := img.At(x, y).RGBA()
+				binary.BigEndian.PutUint16(px[0:], uint16(cr))
+				binary.BigEndian.PutUint16(px[2:], uint16(cg))
+				binary.BigEndian.PutUint16(px[4:], uint16(cb))
+				binary.BigEndian.PutUint16(px[6:], uint16(ca))
+				_, _ = h.Write(px)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// putBlob stores the content of buf as key.
+func (s *Server) putBlob(key string, buf *bytes.Buffer) error {
+	return s.blobs.Put(key, buf, int64(buf.Len()))
+}
+
+// decodeBlob decodes the image stored as key.
+func (s *Server) decodeBlob(key string) (image.Image, error) {
+	rc, _, err := s.blobs.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer helper.CloseRC(rc, key)
+	img, _, err := image.Decode(rc)
+	return img, err
+}
+
+// trashed reports whether the post of kind with id is in the trash, files
+// without a post are left to the media store.
+func (s *Server) trashed(kind string, id uuid.UUID) (bool, error) {
+	var deleted time.Time
+	switch kind {
+	case kindPictures:
+		p, err := s.store.GetPicture(id)
+		if err == store.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		deleted = p.DeletedAt
+	case kindInstagram:
+		i, err := s.store.GetInstagram(id)
+		if err == store.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		deleted = i.DeletedAt
+	}
+	return !deleted.IsZero(), nil
+}
+
+// serveMedia serves the files of posts at `/<kind>/<id>/<name>`, either
+// streamed from the media store or as redirect to a presigned url. Files of
+// trashed posts are hidden like in serveVariant.
+func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || parts[2] == "" || strings.HasPrefix(parts[2], ".") {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil || id.String() != parts[1] {
+		http.NotFound(w, r)
+		return
+	}
+	trashed, err := s.trashed(parts[0], id)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("key", key).Msg("get post of media")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if trashed {
+		http.NotFound(w, r)
+		return
+	}
+
+	if p, ok := s.blobs.(blob.Presigner); ok && s.cfg.MediaUrls == MediaUrlsPresign {
+		u, err := p.PresignGet(key, s.cfg.MediaUrlTTL)
+		if err != nil {
+			log.Ctx(r.Context()).Error().Err(err).Str("key", key).Msg("presign media url")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+		return
+	}
+
+	rc, info, err := s.blobs.Get(key)
+	if err == blob.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("key", key).Msg("get media")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer helper.CloseRC(rc, key)
+
+	w.Header().Set("Content-Type", blob.ContentType(key))
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, info.Modified, rs)
+		return
+	}
+
+	if !info.Modified.IsZero() {
+		if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil &&
+			!info.Modified.Truncate(time.Second).After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", info.Modified.UTC().Format(http.TimeFormat))
+	}
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Ctx(r.Context()).Warn().Err(err).Str("key", key).Msg("stream media")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/rverst/bwof-backend/pkg/metrics"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	routeUnmatched = "unmatched"
+	methodOther    = "other"
+
+	imageSourceUpload = "upload"
+	imageSourceCrop   = "crop"
+	imageSourceResize = "resize"
+
+	oembedOk             = "ok"
+	oembedRequestError   = "request_error"
+	oembedBadStatus      = "bad_status"
+	oembedDecodeError    = "decode_error"
+	oembedThumbnailError = "thumbnail_error"
+)
+
+type serverMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	uploadSize      *metrics.HistogramVec
+	imageDuration   *metrics.HistogramVec
+	oembedRequests  *metrics.CounterVec
+	resizeCache     *metrics.CounterVec
+}
+
+func newServerMetrics(st store.Store) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		requests: r.NewCounterVec("bwof_http_requests_total",
+			"Number of handled http requests.", "route", "method", "status"),
+		requestDuration: r.NewHistogramVec("bwof_http_request_duration_seconds",
+			"Latency of http requests.", metrics.DefBuckets, "route", "method"),
+		uploadSize: r.NewHistogramVec("bwof_upload_size_bytes",
+			"Size of uploaded picture files.", metrics.ExponentialBuckets(64<<10, 2, 10)),
+		imageDuration: r.NewHistogramVec("bwof_image_processing_duration_seconds",
+			"Duration of image processing steps.", metrics.DefBuckets, "source", "op"),
+		oembedRequests: r.NewCounterVec("bwof_instagram_oembed_requests_total",
+			"Number of Instagram oEmbed lookups by outcome.", "outcome"),
+		resizeCache: r.NewCounterVec("bwof_resize_cache_requests_total",
+			"Number of resize requests by whether the result was cached.", "result"),
+	}
+
+	if db, ok := st.(*store.Bolt); ok {
+		registerBoltMetrics(r, db)
+	}
+	return m
+}
+
+// registerBoltMetrics exposes the statistics of the bolt database.
+func registerBoltMetrics(r *metrics.Registry, db *store.Bolt) {
+	stats := func(f func(s bolt.Stats) int) func() float64 {
+		return func() float64 {
+			return float64(f(db.Stats()))
+		}
+	}
+	r.NewGaugeFunc("bwof_bolt_free_pages", "Number of free pages on the freelist.",
+		stats(func(s bolt.Stats) int { return s.FreePageN }))
+	r.NewGaugeFunc("bwof_bolt_pending_pages", "Number of pending pages on the freelist.",
+		stats(func(s bolt.Stats) int { return s.PendingPageN }))
+	r.NewGaugeFunc("bwof_bolt_free_alloc_bytes", "Bytes allocated in free pages.",
+		stats(func(s bolt.Stats) int { return s.FreeAlloc }))
+	r.NewGaugeFunc("bwof_bolt_freelist_inuse_bytes", "Bytes used by the freelist.",
+		stats(func(s bolt.Stats) int { return s.FreelistInuse }))
+	r.NewGaugeFunc("bwof_bolt_open_read_tx", "Number of currently open read transactions.",
+		stats(func(s bolt.Stats) int { return s.OpenTxN }))
+	r.NewCounterFunc("bwof_bolt_read_tx_total", "Number of started read transactions.",
+		stats(func(s bolt.Stats) int { return s.TxN }))
+	r.NewCounterFunc("bwof_bolt_page_alloc_bytes_total", "Bytes allocated for pages.",
+		stats(func(s bolt.Stats) int { return s.TxStats.PageAlloc }))
+	r.NewCounterFunc("bwof_bolt_writes_total", "Number of writes performed.",
+		stats(func(s bolt.Stats) int { return s.TxStats.Write }))
+	r.NewCounterFunc("bwof_bolt_write_seconds_total", "Time spent writing to disk.",
+		func() float64 { return db.Stats().TxStats.WriteTime.Seconds() })
+}
+
+// observeRequest records a handled request. Methods that aren't standard
+// are counted as other, they are chosen by the client and would grow the
+// number of series without bound.
+func (m *serverMetrics) observeRequest(route, method string, status int, d time.Duration) {
+	if route == "" {
+		route = routeUnmatched
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+	default:
+		method = methodOther
+	}
+	m.requests.Inc(route, method, strconv.Itoa(status))
+	m.requestDuration.Observe(d.Seconds(), route, method)
+}
+
+// observeImage records the duration of an image processing step op that
+// started at start.
+func (m *serverMetrics) observeImage(source, op string, start time.Time) {
+	m.imageDuration.Observe(time.Since(start).Seconds(), source, op)
+}
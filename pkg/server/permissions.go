@@ -0,0 +1,92 @@
+package server
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"net/http"
+	"strings"
+)
+
+type permission int
+
+const (
+	// permRead allows reading the public wall (`/api/list`, `/api/posts`).
+	permRead permission = iota
+	// permBrowse allows reading single posts and the per type post lists.
+	permBrowse
+	// permUpload allows creating new posts.
+	permUpload
+	// permEditOwn allows editing, disabling and deleting posts uploaded by
+	// the same user.
+	permEditOwn
+	// permModerate allows disabling and deleting posts of any user.
+	permModerate
+	// permManageUsers allows creating, changing and deleting accounts.
+	permManageUsers
+	// permBackup allows downloading backups and exports of the database and
+	// media.
+	permBackup
+	// permImport allows importing posts from an export archive.
+	permImport
+	// permMaintenance allows checking and repairing the consistency of the
+	// database and the media directories.
+	permMaintenance
+	// permMetrics allows scraping the Prometheus metrics at `/metrics`.
+	permMetrics
+)
+
+// roleMetrics is the role of api keys with the metrics scope. It isn't a
+// valid role for accounts.
+const roleMetrics models.Role = "metrics"
+
+var (
+	rolePermissions = map[models.Role][]permission{
+		models.RoleViewer:      {permRead},
+		models.RoleContributor: {permRead, permBrowse, permUpload, permEditOwn},
+		models.RoleModerator:   {permRead, permBrowse, permUpload, permEditOwn, permModerate},
+		models.RoleAdmin: {permRead, permBrowse, permUpload, permEditOwn, permModerate,
+			permManageUsers, permBackup, permImport, permMaintenance, permMetrics},
+		roleMetrics: {permMetrics},
+	}
+
+	errForbidden = "insufficient permissions"
+)
+
+// hasPermission reports whether u's role grants p. Unknown roles grant nothing.
+func hasPermission(u *models.User, p permission) bool {
+	if u == nil {
+		return false
+	}
+	for _, x := range rolePermissions[u.Role] {
+		if x == p {
+			return true
+		}
+	}
+	return false
+}
+
+// canModify reports whether the user of the request may change a post that
+// was uploaded by uploader.
+func canModify(r *http.Request, uploader string) bool {
+	u := userFromContext(r.Context())
+	if hasPermission(u, permModerate) {
+		return true
+	}
+	return hasPermission(u, permEditOwn) && strings.EqualFold(u.Name, uploader)
+}
+
+// allow authenticates the request and rejects it with 403 if the user lacks
+// permission p.
+func (s *Server) allow(p permission, f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return s.auth(func(w http.ResponseWriter, r *http.Request) {
+		u := userFromContext(r.Context())
+		if !hasPermission(u, p) {
+			log.Ctx(r.Context()).Warn().Str("user", u.Name).Str("role", string(u.Role)).
+				Str("path", r.URL.Path).Msg("forbidden")
+			_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+			return
+		}
+		f(w, r)
+	})
+}
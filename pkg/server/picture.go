@@ -9,15 +9,11 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/rverst/bwof-backend/pkg/helper"
 	"github.com/rverst/bwof-backend/pkg/models"
+	"github.com/rverst/bwof-backend/pkg/store"
 	"goji.io/pat"
 	"image"
-	"image/jpeg"
-	"image/png"
 	"net/http"
-	"os"
-	"path"
 	"path/filepath"
-	"sort"
 	"time"
 )
 
@@ -41,15 +37,15 @@ type crop struct {
 	Height int `json:"height"`
 }
 
-func getPicture(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getPicture(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(pat.Param(r, "id"))
 	if err != nil {
-		log.Error().Err(err).Msgf("unable to parse id: %s", id)
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
 		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
 		return
 	}
 
-	pic, err := getDbPicture(id)
+	pic, err := s.store.GetPicture(id)
 	if err != nil {
 		res := models.Response{
 			Status: http.StatusNotFound,
@@ -58,41 +54,30 @@ func getPicture(w http.ResponseWriter, r *http.Request) {
 		_, _ = helper.WriteJson(w, res.Status, res)
 		return
 	}
-
-	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
-}
-
-func getPictures(w http.ResponseWriter, _ *http.Request) {
-	pics, err := getDbPictures()
-	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusNotFound, "")
+	if !pic.DeletedAt.IsZero() && !canModify(r, pic.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusNotFound, store.ErrNotFound.Error())
 		return
 	}
-
-	if len(pics) == 0 {
-		_, _ = helper.WriteError(w, http.StatusNotFound, "no pictures found in database")
+	if notModified(w, r, versionETag(pic.Version)) {
 		return
 	}
 
-	sort.Slice(pics, func(i, j int) bool {
-		return pics[i].Uploaded.After(pics[j].Uploaded)
-	})
-
-	list := make([]pictureResponse, len(pics))
-	for i, p := range pics {
-		list[i] = fromPicture(p)
-	}
+	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
+}
 
-	_, _ = helper.WriteJson(w, http.StatusOK, list)
+func (s *Server) getPictures(w http.ResponseWriter, r *http.Request) {
+	s.listPosts(w, r, store.TypePicture, "no pictures found in database")
 }
 
-func cropPicture(w http.ResponseWriter, r *http.Request) {
+func (s *Server) cropPicture(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(pat.Param(r, "id"))
 	if err != nil {
-		log.Error().Err(err).Msgf("unable to parse id: %s", id)
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
 		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
 		return
 	}
+	unlock := s.postLocks.lock(id)
+	defer unlock()
 
 	var body cropBody
 	err = json.NewDecoder(r.Body).Decode(&body)
@@ -101,13 +86,28 @@ func cropPicture(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info().Str("id", id.String()).Interface("body", body).Msg("cropPicture")
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Interface("body", body).Msg("cropPicture")
 
-	pic, err := getDbPicture(id)
+	pic, err := s.store.GetPicture(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	if err != nil {
 		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !canModify(r, pic.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, pic.Version) {
+		return
+	}
+	if !pic.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, errTrashed)
+		return
+	}
 
 	oW := pic.OriginalBounds.Dx()
 	oH := pic.OriginalBounds.Dy()
@@ -115,38 +115,27 @@ func cropPicture(w http.ResponseWriter, r *http.Request) {
 	body.Crop.Width = min(body.Crop.Width, oW)
 	body.Crop.Height = min(body.Crop.Height, oH)
 
-	log.Info().Interface("crop", body.Crop).Msg("crop")
+	log.Ctx(r.Context()).Info().Interface("crop", body.Crop).Msg("crop")
 
+	before := pictureState(pic)
 	if body.Crop.Width == 0 || body.Crop.Height == 0 ||
 		(body.Crop.Width >= oW && body.Crop.Height >= oH) {
-		pic.UseCropped = false
+		stale := clearCrop(pic)
 		pic.Edited = time.Now()
 
-		err = updatePicture(pic)
+		err = s.updatePost(r, store.Post{Picture: pic}, models.RevisionCrop, before, 0)
 		if err != nil {
-			_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+			writeUpdateError(w, r, err)
 			return
 		}
+		s.deleteBlobs(stale)
 
-		log.Info().Msg("crop disabled")
+		log.Ctx(r.Context()).Info().Msg("crop disabled")
+		setETag(w, pic.Version)
 		_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
 		return
 	}
 
-	dir := path.Join(pictureDir, id.String())
-	ext := filepath.Ext(pic.OriginalPath)
-	fileName := fmt.Sprintf("crop%s", ext)
-	thumbName := fmt.Sprintf("thumb_crop%s", ext)
-	cropName := path.Join(dir, fileName)
-	thumbCropName := path.Join(dir, thumbName)
-
-	f, _ := os.Open(path.Join(dir, pic.OriginalPath))
-	img, _, err := image.Decode(f)
-	if err != nil {
-		log.Error().Err(err).Send()
-	}
-	defer helper.Close(f, pic.OriginalPath)
-
 	x0 := body.Crop.X
 	y0 := body.Crop.Y
 	x1 := body.Crop.X + body.Crop.Width
@@ -155,71 +144,145 @@ func cropPicture(w http.ResponseWriter, r *http.Request) {
 	if x0 < 0 {
 		t := x0 * -1
 		x0 = 0
-		if (x1 + t) <= img.Bounds().Max.X {
+		if (x1 + t) <= pic.OriginalBounds.Max.X {
 			x1 += t
 		}
 	}
 	if y0 < 0 {
 		t := y0 * -1
 		y0 = 0
-		if (y1 + t) <= img.Bounds().Max.Y {
+		if (y1 + t) <= pic.OriginalBounds.Max.Y {
 			y1 += t
 		}
 	}
 
-	cb := image.Rect(x0, y0, x1, y1)
-	log.Info().Interface("bounds", cb).Msg("crop")
+	// the crop may still reach over the right or bottom edge, keep only the
+	// part the cutter can copy
+	cb := image.Rect(x0, y0, x1, y1).Intersect(pic.OriginalBounds)
+	if cb.Empty() {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, "crop is outside of the picture")
+		return
+	}
+	log.Ctx(r.Context()).Info().Interface("bounds", cb).Msg("crop")
+	fresh, stale, err := s.renderCrop(pic, cb)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("crop")
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	pic.UseCropped = true
+	pic.Edited = time.Now()
+
+	err = s.updatePost(r, store.Post{Picture: pic}, models.RevisionCrop, before, 0)
+	if err != nil {
+		s.deleteBlobs(fresh)
+		writeUpdateError(w, r, err)
+		return
+	}
+	s.deleteBlobs(stale)
+
+	setETag(w, pic.Version)
+	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
+}
+
+// renderCrop cuts cb out of the original of pic, stores the crop with its
+// thumbnail and renditions and sets the crop fields of pic. The files are
+// named after the version pic is stored with next, so the previous crop stays
+// intact until pic is stored. It returns the keys of the new files, which the
+// caller deletes if storing pic fails, and of the files of the previous crop,
+// which the caller deletes once pic is stored. The caller holds the lock of
+// the post.
+func (s *Server) renderCrop(pic *models.Picture, cb image.Rectangle) (fresh, stale []string, err error) {
+	ext := filepath.Ext(pic.OriginalPath)
+	base := fmt.Sprintf("crop_v%d", pic.Version+1)
+	cropName := base + ext
+	thumbCropName := "thumb_" + cropName
+
+	start := time.Now()
+	img, err := s.decodeBlob(mediaKey(kindPictures, pic.Id, pic.OriginalPath))
+	if err != nil {
+		return nil, nil, err
+	}
+	s.metrics.observeImage(imageSourceCrop, "decode", start)
+
+	start = time.Now()
 	cropped, err := cutter.Crop(img, cutter.Config{
-		Width:  x1 - x0,
-		Height: y1 - y0,
-		Anchor: image.Point{
-			X: x0,
-			Y: y0,
-		},
+		Width:   cb.Dx(),
+		Height:  cb.Dy(),
+		Anchor:  cb.Min,
 		Options: cutter.Copy,
 	})
+	if err != nil {
+		return nil, nil, err
+	}
+	s.metrics.observeImage(imageSourceCrop, "crop", start)
 
-	cf, _ := os.OpenFile(cropName, os.O_WRONLY|os.O_CREATE, 0660)
-	defer helper.Close(cf, cropName)
-
-	ct, _ := os.OpenFile(thumbCropName, os.O_WRONLY|os.O_CREATE, 0660)
-	defer helper.Close(cf, thumbCropName)
+	start = time.Now()
+	thumb := resize.Thumbnail(s.cfg.ThumbnailSize, s.cfg.ThumbnailSize, cropped, resize.Lanczos3)
+	rends, imgs := s.resizeRenditions(pic.Id, cropped, ext, base)
+	s.metrics.observeImage(imageSourceCrop, "resize", start)
 
-	thumb := resize.Thumbnail(helper.ThumbnailSize, helper.ThumbnailSize, cropped, resize.Lanczos3)
+	start = time.Now()
+	cf, err := encodeImage(cropped, cropName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode %s: %w", cropName, err)
+	}
+	ct, err := encodeImage(thumb, thumbCropName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encode %s: %w", thumbCropName, err)
+	}
+	files, err := encodeRenditions(rends, imgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.metrics.observeImage(imageSourceCrop, "encode", start)
 
-	if ext == ".png" {
-		_ = png.Encode(cf, cropped)
-		_ = png.Encode(ct, thumb)
-	} else if ext == ".jpg" {
-		o := &jpeg.Options{Quality: 100}
-		_ = jpeg.Encode(cf, cropped, o)
-		_ = jpeg.Encode(ct, thumb, o)
+	files = append([]encodedFile{{cropName, cf}, {thumbCropName, ct}}, files...)
+	for _, f := range files {
+		fresh = append(fresh, mediaKey(kindPictures, pic.Id, f.name))
+	}
+	if err := s.putFiles(mediaPrefix(kindPictures, pic.Id), files); err != nil {
+		s.deleteBlobs(fresh)
+		return nil, nil, err
 	}
 
+	stale = clearCrop(pic)
 	pic.CroppedBounds = cb
-	pic.CroppedUrl = fmt.Sprintf("/pictures/%s/%s", pic.Id.String(), filepath.Base(cropName))
+	pic.CroppedUrl = fmt.Sprintf("/pictures/%s/%s", pic.Id.String(), cropName)
 	pic.CroppedPath = cropName
-	pic.ThumbCroppedUrl = fmt.Sprintf("/pictures/%s/%s", pic.Id.String(), filepath.Base(thumbCropName))
+	pic.ThumbCroppedUrl = fmt.Sprintf("/pictures/%s/%s", pic.Id.String(), thumbCropName)
 	pic.ThumbCroppedPath = thumbCropName
-	pic.UseCropped = true
-	pic.Edited = time.Now()
+	pic.Renditions = append(pic.Renditions, rends...)
+	return fresh, stale, nil
+}
 
-	err = updatePicture(pic)
-	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
-		return
+// clearCrop removes the crop from pic and returns the keys of its files, the
+// caller deletes them once pic is stored.
+func clearCrop(pic *models.Picture) []string {
+	stale := replaceRenditions(pic, true, nil)
+	for _, name := range []string{pic.CroppedPath, pic.ThumbCroppedPath} {
+		if name != "" {
+			stale = append(stale, mediaKey(kindPictures, pic.Id, name))
+		}
 	}
-
-	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
+	pic.UseCropped = false
+	pic.CroppedBounds = image.Rectangle{}
+	pic.CroppedUrl = ""
+	pic.CroppedPath = ""
+	pic.ThumbCroppedUrl = ""
+	pic.ThumbCroppedPath = ""
+	return stale
 }
 
-func editPictureContent(w http.ResponseWriter, r *http.Request) {
+func (s *Server) editPictureContent(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(pat.Param(r, "id"))
 	if err != nil {
-		log.Error().Err(err).Msgf("unable to parse id: %s", id)
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
 		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
 		return
 	}
+	unlock := s.postLocks.lock(id)
+	defer unlock()
 
 	var body editBody
 	err = json.NewDecoder(r.Body).Decode(&body)
@@ -228,91 +291,145 @@ func editPictureContent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info().Str("id", id.String()).Interface("body", body).Msg("editPictureContent")
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Interface("body", body).Msg("editPictureContent")
 
 	if !plainTextRegex.MatchString(body.Title) ||
 		!plainTextRegex.MatchString(body.Text) {
 		err := fmt.Errorf("only plain text allowed in title/text")
-		log.Warn().Err(err).Msg("editPictureContent")
+		log.Ctx(r.Context()).Warn().Err(err).Msg("editPictureContent")
 		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	pic, err := getDbPicture(id)
+	pic, err := s.store.GetPicture(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	if err != nil {
 		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !canModify(r, pic.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, pic.Version) {
+		return
+	}
+	if !pic.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, errTrashed)
+		return
+	}
 
+	before := pictureState(pic)
 	pic.Content.Title = body.Title
 	pic.Content.Text = body.Text
-	err = updatePicture(pic)
+	if pic.Content != before.Content {
+		pic.Edited = time.Now()
+	}
+	err = s.updatePost(r, store.Post{Picture: pic}, models.RevisionContent, before, 0)
 	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeUpdateError(w, r, err)
 		return
 	}
 
+	setETag(w, pic.Version)
 	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
 }
 
-func disablePicture(w http.ResponseWriter, r *http.Request) {
+func (s *Server) disablePicture(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(pat.Param(r, "id"))
 	if err != nil {
-		log.Error().Err(err).Msgf("unable to parse id: %s", id)
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
 		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
 		return
 	}
+	unlock := s.postLocks.lock(id)
+	defer unlock()
 	var body disableBody
 	err = json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
 		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	log.Info().Str("id", id.String()).Interface("body", body).Msg("disablePicture")
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Interface("body", body).Msg("disablePicture")
 
-	pic, err := getDbPicture(id)
+	pic, err := s.store.GetPicture(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	if err != nil {
 		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !canModify(r, pic.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, pic.Version) {
+		return
+	}
+	if !pic.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, errTrashed)
+		return
+	}
 
+	before := pictureState(pic)
 	pic.Disabled = body.Disable
-	err = updatePicture(pic)
+	err = s.updatePost(r, store.Post{Picture: pic}, models.RevisionDisable, before, 0)
 	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeUpdateError(w, r, err)
 		return
 	}
 
+	setETag(w, pic.Version)
 	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
 }
 
-func deletePicture(w http.ResponseWriter, r *http.Request) {
+func (s *Server) deletePicture(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(pat.Param(r, "id"))
 	if err != nil {
-		log.Error().Err(err).Msgf("unable to parse id: %s", id)
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
 		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
 		return
 	}
-	log.Info().Str("id", id.String()).Msg("deletePicture")
+	unlock := s.postLocks.lock(id)
+	defer unlock()
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Msg("deletePicture")
 
-	pic, err := getDbPicture(id)
-	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+	pic, err := s.store.GetPicture(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
 		return
 	}
-
-	err = deleteDbPicture(pic.Id)
 	if err != nil {
 		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !canModify(r, pic.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, pic.Version) {
+		return
+	}
+	if !pic.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, errTrashed)
+		return
+	}
 
-	p := path.Join(pictureDir, pic.Id.String())
-	err = os.RemoveAll(p)
+	pic.DeletedAt = time.Now()
+	pic.DeletedBy = uploaderName(r)
+	err = s.store.UpdatePicture(pic)
 	if err != nil {
-		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		writeUpdateError(w, r, err)
 		return
 	}
+
+	setETag(w, pic.Version)
+	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
 }
 
 func min(x1 int, x2 int) int {
@@ -5,7 +5,6 @@ import (
 	"github.com/rverst/bwof-backend/pkg/helper"
 	"math/rand"
 	"net/http"
-  "sort"
   "time"
 )
 
@@ -18,23 +17,23 @@ type item struct {
 	Height int    `json:"height"`
 }
 
-func getList(w http.ResponseWriter, _ *http.Request) {
+func (s *Server) getList(w http.ResponseWriter, r *http.Request) {
 
-	pics, err := getDbPictures()
+	pics, err := s.store.GetPictures()
 	if err != nil {
-		log.Error().Err(err).Msg("error fetching picture posts")
+		log.Ctx(r.Context()).Error().Err(err).Msg("error fetching picture posts")
 	}
 
-	inst, err := getDbInstagrams()
+	inst, err := s.store.GetInstagrams()
 	if err != nil {
-		log.Error().Err(err).Msg("error fetching instagram posts")
+		log.Ctx(r.Context()).Error().Err(err).Msg("error fetching instagram posts")
 	}
 
 	list := make([]item, 0)
 
 	if pics != nil {
 		for _, p := range pics {
-			if p.Disabled {
+			if p.Disabled || !p.DeletedAt.IsZero() {
 				continue
 			}
 			x := item{
@@ -58,7 +57,7 @@ func getList(w http.ResponseWriter, _ *http.Request) {
 
 	if inst != nil {
 		for _, i := range inst {
-			if i.Disabled {
+			if i.Disabled || !i.DeletedAt.IsZero() {
 				continue
 			}
 			x := item{
@@ -73,6 +72,12 @@ func getList(w http.ResponseWriter, _ *http.Request) {
 
 	if len(list) == 0 {
 		_, _ = helper.WriteError(w, http.StatusNoContent, "unable to fetch posts")
+		return
+	}
+
+	// the tag is taken before shuffling, the order is irrelevant to displays
+	if notModified(w, r, contentETag(list)) {
+		return
 	}
 
 	rand.Seed(time.Now().UnixNano())
@@ -82,33 +87,6 @@ func getList(w http.ResponseWriter, _ *http.Request) {
 	_, _ = helper.WriteJson(w, http.StatusOK, list)
 }
 
-func getPosts(w http.ResponseWriter, r *http.Request)  {
-  pics, err1 := getDbPictures()
-  inst, err2 := getDbInstagrams()
-  if err1 != nil && err2 != nil {
-    _, _ = helper.WriteError(w, http.StatusNotFound, "")
-    return
-  }
-
-  if len(pics) == 0 && len(inst) == 0 {
-    _, _ = helper.WriteError(w, http.StatusNotFound, "no posts found in database")
-    return
-  }
-
-  list := make([]pictureResponse, 0)
-  for _, p := range pics {
-    list = append(list, fromPicture(p))
-  }
-  for _, p := range inst {
-    list = append(list, fromInsta(p))
-  }
-
-  sort.Slice(list, func(i, j int) bool {
-    return list[i].Created.After(list[j].Created)
-  })
-
-
-
-
-  _, _ = helper.WriteJson(w, http.StatusOK, list)
+func (s *Server) getPosts(w http.ResponseWriter, r *http.Request)  {
+  s.listPosts(w, r, 0, "no posts found in database")
 }
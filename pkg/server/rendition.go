@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nfnt/resize"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"image"
+	"sort"
+	"strings"
+)
+
+// encodedFile is an encoded image waiting to be stored as file of a post.
+type encodedFile struct {
+	name string
+	buf  *bytes.Buffer
+}
+
+// renditionName returns the file name of the rendition of width, crop is the
+// name of the crop without extension for its renditions and empty for those
+// of the original, ext is the extension of the original including the dot.
+func renditionName(width int, crop string, ext string) string {
+	if crop != "" {
+		return fmt.Sprintf("%s_w%d%s", crop, width, ext)
+	}
+	return fmt.Sprintf("w%d%s", width, ext)
+}
+
+// renditionWidths returns the widths of the ladder img is downscaled to,
+// sizes that aren't smaller than img are left out since img itself serves
+// them.
+func (s *Server) renditionWidths(img image.Image) []int {
+	ws := append([]int(nil), s.cfg.RenditionWidths...)
+	sort.Ints(ws)
+	widths := make([]int, 0, len(ws))
+	for _, w := range ws {
+		if w < img.Bounds().Dx() && (len(widths) == 0 || widths[len(widths)-1] != w) {
+			widths = append(widths, w)
+		}
+	}
+	return widths
+}
+
+// resizeRenditions downscales img, the original or the crop of the post id,
+// to the widths of the ladder, crop is passed on to renditionName.
+func (s *Server) resizeRenditions(id uuid.UUID, img image.Image, ext string, crop string) ([]models.Rendition, []image.Image) {
+	widths := s.renditionWidths(img)
+	rends := make([]models.Rendition, len(widths))
+	imgs := make([]image.Image, len(widths))
+	for i, w := range widths {
+		imgs[i] = resize.Resize(uint(w), 0, img, resize.Lanczos3)
+		name := renditionName(w, crop, ext)
+		rends[i] = models.Rendition{
+			Width:   w,
+			Height:  imgs[i].Bounds().Dy(),
+			Path:    name,
+			Url:     fmt.Sprintf("/pictures/%s/%s", id.String(), name),
+			Cropped: crop != "",
+		}
+	}
+	return rends, imgs
+}
+
+// encodeRenditions encodes the images returned by resizeRenditions.
+func encodeRenditions(rends []models.Rendition, imgs []image.Image) ([]encodedFile, error) {
+	files := make([]encodedFile, len(rends))
+	for i, r := range rends {
+		buf, err := encodeImage(imgs[i], r.Path)
+		if err != nil {
+			return nil, fmt.Errorf("encode %s: %w", r.Path, err)
+		}
+		files[i] = encodedFile{name: r.Path, buf: buf}
+	}
+	return files, nil
+}
+
+// putFiles stores files as files of the post with the key prefix.
+func (s *Server) putFiles(prefix string, files []encodedFile) error {
+	for _, f := range files {
+		if err := s.putBlob(prefix+f.name, f.buf); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// replaceRenditions sets the renditions of pic of one kind, original or
+// cropped, and returns the keys of files of the previous ones that are no
+// longer used.
+func replaceRenditions(pic *models.Picture, cropped bool, rends []models.Rendition) []string {
+	keep := make([]models.Rendition, 0, len(pic.Renditions)+len(rends))
+	used := make(map[string]bool)
+	for _, r := range rends {
+		used[r.Path] = true
+	}
+	stale := make([]string, 0)
+	for _, r := range pic.Renditions {
+		if r.Cropped != cropped {
+			keep = append(keep, r)
+		} else if !used[r.Path] {
+			stale = append(stale, mediaKey(kindPictures, pic.Id, r.Path))
+		}
+	}
+	pic.Renditions = append(keep, rends...)
+	return stale
+}
+
+// deleteBlobs removes files that are no longer referenced, failures only
+// leave stale files for fsck and are logged.
+func (s *Server) deleteBlobs(keys []string) {
+	for _, k := range keys {
+		if err := s.blobs.Delete(k); err != nil {
+			log.Warn().Err(err).Str("key", k).Msg("unable to delete stale file")
+		}
+	}
+}
+
+// srcset returns the candidates of the renditions and the full size image
+// that are shown, i.e. of the crop if cropped, in the format of the srcset
+// attribute.
+func srcset(p models.Picture, cropped bool) string {
+	parts := make([]string, 0, len(p.Renditions)+1)
+	for _, r := range p.Renditions {
+		if r.Cropped == cropped {
+			parts = append(parts, fmt.Sprintf("%s %dw", r.Url, r.Width))
+		}
+	}
+	if cropped && p.CroppedUrl != "" {
+		parts = append(parts, fmt.Sprintf("%s %dw", p.CroppedUrl, p.CroppedBounds.Dx()))
+	} else if !cropped && p.OriginalUrl != "" {
+		parts = append(parts, fmt.Sprintf("%s %dw", p.OriginalUrl, p.OriginalBounds.Dx()))
+	}
+	return strings.Join(parts, ", ")
+}
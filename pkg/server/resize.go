@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nfnt/resize"
+	"github.com/oliamb/cutter"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/blob"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"goji.io/pat"
+	"image"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Variants of a picture that can be resized on request.
+const (
+	variantOriginal = "original"
+	variantCrop     = "crop"
+	// variantAuto is the crop if the picture uses it and the original
+	// otherwise, i.e. what the wall shows.
+	variantAuto = "auto"
+
+	fitCover   = "cover"
+	fitContain = "contain"
+)
+
+// resizeOptions are the query parameters of a resize request.
+type resizeOptions struct {
+	width  int
+	height int
+	fit    string
+	// ext is the extension of the encoded result, the one of the source if
+	// empty.
+	ext string
+}
+
+// parseResizeOptions reads `w` and `h`, at least one of them is required and
+// both must be one of ResizeSizes, `fit` (cover or contain, defaults to
+// cover) and `fmt` (jpg or png, defaults to the format of the source).
+func (s *Server) parseResizeOptions(q url.Values) (resizeOptions, error) {
+	o := resizeOptions{fit: fitCover}
+	for _, x := range []struct {
+		key string
+		v   *int
+	}{{"w", &o.width}, {"h", &o.height}} {
+		v := q.Get(x.key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || !s.resizeAllowed(n) {
+			return o, fmt.Errorf("%s must be one of %s", x.key,
+				strings.Join(strings.Fields(strings.Trim(fmt.Sprint(s.cfg.ResizeSizes), "[]")), ", "))
+		}
+		*x.v = n
+	}
+	if o.width == 0 && o.height == 0 {
+		return o, fmt.Errorf("w or h is required")
+	}
+
+	switch f := q.Get("fit"); f {
+	case "":
+	case fitCover, fitContain:
+		o.fit = f
+	default:
+		return o, fmt.Errorf("fit must be %s or %s", fitCover, fitContain)
+	}
+
+	switch f := strings.ToLower(q.Get("fmt")); f {
+	case "":
+	case "jpg", "jpeg":
+		o.ext = ".jpg"
+	case "png":
+		o.ext = ".png"
+	default:
+		return o, fmt.Errorf("fmt must be jpg or png")
+	}
+	return o, nil
+}
+
+// resizeAllowed reports whether n is one of ResizeSizes.
+func (s *Server) resizeAllowed(n int) bool {
+	for _, a := range s.cfg.ResizeSizes {
+		if n == a {
+			return true
+		}
+	}
+	return false
+}
+
+// resizeImage scales img down to the box of o, it's never enlarged. If only
+// one dimension is given the other follows the aspect ratio. Otherwise cover
+// fills the box and cuts off what overflows around the center, while contain
+// fits the whole image into the box.
+func resizeImage(img image.Image, o resizeOptions) (image.Image, error) {
+	b := img.Bounds()
+	if o.width == 0 || o.height == 0 || o.fit == fitContain {
+		w, h := uint(o.width), uint(o.height)
+		if w == 0 {
+			w = uint(b.Dx())
+		}
+		if h == 0 {
+			h = uint(b.Dy())
+		}
+		return resize.Thumbnail(w, h, img, resize.Lanczos3), nil
+	}
+
+	scale := math.Min(1, math.Max(float64(o.width)/float64(b.Dx()), float64(o.height)/float64(b.Dy())))
+	w := int(math.Round(float64(b.Dx()) * scale))
+	h := int(math.Round(float64(b.Dy()) * scale))
+	scaled := resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+	return cutter.Crop(scaled, cutter.Config{
+		Width:  min(o.width, w),
+		Height: min(o.height, h),
+		Mode:   cutter.Centered,
+	})
+}
+
+// serveVariant serves a variant of a picture at `/pictures/:id/:variant`
+// resized as requested by the query, see parseResizeOptions. Results are
+// kept in the resize cache, renders run at most one per CPU at a time. Other
+// names below the post are its files and served by serveMedia.
+func (s *Server) serveVariant(w http.ResponseWriter, r *http.Request) {
+	variant := pat.Param(r, "variant")
+	if variant != variantOriginal && variant != variantCrop && variant != variantAuto {
+		s.serveMedia(w, r)
+		return
+	}
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	o, err := s.parseResizeOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pic, err := s.store.GetPicture(id)
+	if err == store.ErrNotFound || (err == nil && !pic.DeletedAt.IsZero()) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("id", id.String()).Msg("get picture")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	src, bounds := pic.OriginalPath, pic.OriginalBounds
+	if variant == variantCrop || (variant == variantAuto && pic.UseCropped) {
+		src, bounds = pic.CroppedPath, pic.CroppedBounds
+	}
+	if src == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if o.ext == "" {
+		o.ext = strings.ToLower(filepath.Ext(src))
+	}
+
+	// the bounds of the crop change whenever it's rendered again
+	key := mediaKey(kindPictures, id, src)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %v %d %d %s", key, bounds, o.width, o.height, o.fit)))
+	name := hex.EncodeToString(sum[:16]) + o.ext
+	w.Header().Set("ETag", `"`+name+`"`)
+	w.Header().Set("Content-Type", blob.ContentType(name))
+
+	if s.serveCached(w, r, name) {
+		return
+	}
+	select {
+	case s.renders <- struct{}{}:
+		defer func() { <-s.renders }()
+	case <-r.Context().Done():
+		return
+	}
+	// rendered by another request while this one waited
+	if s.serveCached(w, r, name) {
+		return
+	}
+	s.metrics.resizeCache.Inc("miss")
+
+	buf, err := s.renderVariant(pic, key, o)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("key", key).Msg("resize")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := s.resizeCache.put(name, buf); err != nil {
+		log.Ctx(r.Context()).Warn().Err(err).Str("name", name).Msg("cache resized picture")
+	}
+	http.ServeContent(w, r, name, time.Now(), bytes.NewReader(buf))
+}
+
+// serveCached serves the file name from the resize cache and reports whether
+// it was found.
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, name string) bool {
+	f, ok := s.resizeCache.open(name)
+	if !ok {
+		return false
+	}
+	defer helper.Close(f, name)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	s.metrics.resizeCache.Inc("hit")
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+	return true
+}
+
+// renderVariant decodes the image key of pic and returns it resized to o.
+func (s *Server) renderVariant(pic *models.Picture, key string, o resizeOptions) ([]byte, error) {
+	start := time.Now()
+	img, err := s.decodeBlob(key)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.observeImage(imageSourceResize, "decode", start)
+
+	start = time.Now()
+	img, err = resizeImage(img, o)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.observeImage(imageSourceResize, "resize", start)
+
+	start = time.Now()
+	buf, err := encodeImage(img, o.ext)
+	if err != nil {
+		return nil, fmt.Errorf("encode %s of %s: %w", o.ext, pic.Id, err)
+	}
+	s.metrics.observeImage(imageSourceResize, "encode", start)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// resizeCache keeps resized images as files in a directory that is limited to
+// maxBytes, the least recently used files are evicted first. The directory
+// only holds the cache and can be wiped at any time, after a restart the
+// files are ranked by their modification time.
+type resizeCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // of *cacheEntry, the most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// newResizeCache opens the cache in dir, creating it if needed, and evicts
+// files until it fits maxBytes.
+func newResizeCache(dir string, maxBytes int64) (*resizeCache, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &resizeCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			// leftover of a write that was interrupted
+			_ = os.Remove(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		c.entries[fi.Name()] = c.order.PushFront(&cacheEntry{name: fi.Name(), size: fi.Size()})
+		c.size += fi.Size()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// open returns the cached file name, opened for reading, and marks it as used.
+func (c *resizeCache) open(name string) (*os.File, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		c.order.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		// evicted in the meantime or removed from the outside
+		c.mu.Lock()
+		if e, ok := c.entries[name]; ok && os.IsNotExist(err) {
+			c.remove(e)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	return f, true
+}
+
+// put stores buf as file name and evicts the least recently used files until
+// the cache fits its limit again. Files larger than the whole cache are
+// silently not stored.
+func (c *resizeCache) put(name string, buf []byte) error {
+	size := int64(len(buf))
+	if size > c.maxBytes {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(c.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		e.Value.(*cacheEntry).size = size
+		c.order.MoveToFront(e)
+	} else {
+		c.entries[name] = c.order.PushFront(&cacheEntry{name: name, size: size})
+	}
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// bytes returns the size of all cached files.
+func (c *resizeCache) bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// evict removes the least recently used files while the cache is too large,
+// the caller holds mu.
+func (c *resizeCache) evict() {
+	for c.size > c.maxBytes {
+		e := c.order.Back()
+		if e == nil {
+			return
+		}
+		_ = os.Remove(filepath.Join(c.dir, e.Value.(*cacheEntry).name))
+		c.remove(e)
+	}
+}
+
+// remove forgets the entry e, the caller holds mu.
+func (c *resizeCache) remove(e *list.Element) {
+	ce := c.order.Remove(e).(*cacheEntry)
+	delete(c.entries, ce.name)
+	c.size -= ce.size
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"goji.io/pat"
+	"net/http"
+	"time"
+)
+
+type rollbackBody struct {
+	Revision int `json:"revision"`
+}
+
+// pictureState returns the fields of p that are kept in revisions.
+func pictureState(p *models.Picture) models.RevisionState {
+	return models.RevisionState{
+		Content:       p.Content,
+		Disabled:      p.Disabled,
+		UseCropped:    p.UseCropped,
+		CroppedBounds: p.CroppedBounds,
+	}
+}
+
+// instaState returns the fields of i that are kept in revisions.
+func instaState(i *models.Instagram) models.RevisionState {
+	return models.RevisionState{Disabled: i.Disabled}
+}
+
+// postState returns the fields of p that are kept in revisions.
+func postState(p store.Post) models.RevisionState {
+	if p.Picture != nil {
+		return pictureState(p.Picture)
+	}
+	return instaState(p.Instagram)
+}
+
+// diffState returns the fields that differ between a and b.
+func diffState(a, b models.RevisionState) []models.Change {
+	changes := make([]models.Change, 0)
+	add := func(field string, from, to interface{}) {
+		changes = append(changes, models.Change{Field: field, From: from, To: to})
+	}
+	if a.Content.Title != b.Content.Title {
+		add("title", a.Content.Title, b.Content.Title)
+	}
+	if a.Content.Text != b.Content.Text {
+		add("text", a.Content.Text, b.Content.Text)
+	}
+	if a.Disabled != b.Disabled {
+		add("disabled", a.Disabled, b.Disabled)
+	}
+	if a.UseCropped != b.UseCropped {
+		add("use_cropped", a.UseCropped, b.UseCropped)
+	}
+	if a.CroppedBounds != b.CroppedBounds {
+		add("cropped_bounds", a.CroppedBounds, b.CroppedBounds)
+	}
+	return changes
+}
+
+// updatePost stores the change of p from before to its current state by the
+// user of r together with its revision, nothing is recorded if no field
+// changed. The first revision of a post stores before as RevisionOriginal, so
+// the state before the first change can be restored too.
+func (s *Server) updatePost(r *http.Request, p store.Post, action string, before models.RevisionState, rollback int) error {
+	after := postState(p)
+	changes := diffState(before, after)
+	if len(changes) == 0 {
+		if p.Picture != nil {
+			return s.store.UpdatePicture(p.Picture)
+		}
+		return s.store.UpdateInstagram(p.Instagram)
+	}
+
+	var id uuid.UUID
+	var uploader string
+	if p.Picture != nil {
+		id, uploader = p.Picture.Id, p.Picture.Uploader
+	} else {
+		id, uploader = p.Instagram.Id, p.Instagram.Uploader
+	}
+	original := &models.Revision{
+		PostId:  id,
+		Action:  models.RevisionOriginal,
+		Author:  uploader,
+		Created: p.Uploaded(),
+		Changes: make([]models.Change, 0),
+		State:   before,
+	}
+	return s.store.UpdateWithRevision(p, original, &models.Revision{
+		PostId:   id,
+		Action:   action,
+		Author:   uploaderName(r),
+		Created:  time.Now(),
+		Changes:  changes,
+		State:    after,
+		Rollback: rollback,
+	})
+}
+
+// writeHistory answers with the revisions of the post id, oldest first.
+func (s *Server) writeHistory(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	revs, err := s.store.GetRevisions(id)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("error fetching revisions")
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, "unable to fetch revisions")
+		return
+	}
+	_, _ = helper.WriteJson(w, http.StatusOK, revs)
+}
+
+// getRollbackRevision decodes the body of a rollback request and returns the
+// requested revision of the post id, it answers the request if that fails.
+func (s *Server) getRollbackRevision(w http.ResponseWriter, r *http.Request, id uuid.UUID) (*models.Revision, bool) {
+	var body rollbackBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	rev, err := s.store.GetRevision(id, body.Revision)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, fmt.Sprintf("revision %d not found", body.Revision))
+		return nil, false
+	}
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	return rev, true
+}
+
+func (s *Server) getPictureHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+
+	pic, err := s.store.GetPicture(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !canModify(r, pic.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+
+	s.writeHistory(w, r, id)
+}
+
+// rollbackPicture restores the content, state and crop of a revision, the
+// crop is rendered again from the original if it differs and removed if the
+// revision doesn't use one.
+func (s *Server) rollbackPicture(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+	unlock := s.postLocks.lock(id)
+	defer unlock()
+
+	pic, err := s.store.GetPicture(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !canModify(r, pic.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, pic.Version) {
+		return
+	}
+	if !pic.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, errTrashed)
+		return
+	}
+
+	rev, ok := s.getRollbackRevision(w, r, id)
+	if !ok {
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Int("revision", rev.Number).Msg("rollbackPicture")
+
+	before := pictureState(pic)
+	target := rev.State
+	var fresh, stale []string
+	// crops stored before cropPicture clamped them may reach over the edge of
+	// the original, they are restored as the part that was actually cut
+	cb := target.CroppedBounds.Intersect(pic.OriginalBounds)
+	switch {
+	case !target.UseCropped || target.CroppedBounds.Empty():
+		stale = clearCrop(pic)
+	case cb != pic.CroppedBounds:
+		if cb.Empty() {
+			_, _ = helper.WriteError(w, http.StatusConflict,
+				fmt.Sprintf("the crop of revision %d doesn't fit the picture", rev.Number))
+			return
+		}
+		if fresh, stale, err = s.renderCrop(pic, cb); err != nil {
+			log.Ctx(r.Context()).Error().Err(err).Msg("rollbackPicture")
+			_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	pic.Content = target.Content
+	pic.Disabled = target.Disabled
+	pic.UseCropped = target.UseCropped && !pic.CroppedBounds.Empty()
+	if len(diffState(before, pictureState(pic))) == 0 {
+		setETag(w, pic.Version)
+		_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
+		return
+	}
+	pic.Edited = time.Now()
+
+	err = s.updatePost(r, store.Post{Picture: pic}, models.RevisionRollback, before, rev.Number)
+	if err != nil {
+		s.deleteBlobs(fresh)
+		writeUpdateError(w, r, err)
+		return
+	}
+	s.deleteBlobs(stale)
+
+	setETag(w, pic.Version)
+	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
+}
+
+func (s *Server) getInstagramHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+
+	post, err := s.store.GetInstagram(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !canModify(r, post.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+
+	s.writeHistory(w, r, id)
+}
+
+// rollbackInstagram restores the state of a revision.
+func (s *Server) rollbackInstagram(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+	unlock := s.postLocks.lock(id)
+	defer unlock()
+
+	post, err := s.store.GetInstagram(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !canModify(r, post.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, post.Version) {
+		return
+	}
+	if !post.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, errTrashed)
+		return
+	}
+
+	rev, ok := s.getRollbackRevision(w, r, id)
+	if !ok {
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Int("revision", rev.Number).Msg("rollbackInstagram")
+
+	before := instaState(post)
+	post.Disabled = rev.State.Disabled
+	if len(diffState(before, instaState(post))) == 0 {
+		setETag(w, post.Version)
+		_, _ = helper.WriteJson(w, http.StatusOK, fromInsta(*post))
+		return
+	}
+	post.Edited = time.Now()
+
+	err = s.updatePost(r, store.Post{Instagram: post}, models.RevisionRollback, before, rev.Number)
+	if err != nil {
+		writeUpdateError(w, r, err)
+		return
+	}
+
+	setETag(w, post.Version)
+	_, _ = helper.WriteJson(w, http.StatusOK, fromInsta(*post))
+}
@@ -1,115 +1,325 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/rs/zerolog/log"
-	"github.com/rverst/bwof-backend/pkg/helper"
-	goji "goji.io"
+	"github.com/rverst/bwof-backend/pkg/blob"
+	"github.com/rverst/bwof-backend/pkg/store"
 	"goji.io/pat"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
 )
 
-const (
-	EnvDataDir              = "DATA"
-	EnvDbFile               = "DB"
-	EnvInstagramAccessToken = "INSTA_TOKEN"
-)
-
-var (
-	db           *bolt.DB
-	dataDir      string
-	pictureDir   string
-	instaPostDir string
-	instaToken   string
-)
+// Server is a wall backend with its own database and media store, it
+// implements http.Handler and can be mounted into any mux.
+type Server struct {
+	cfg        Config
+	store      store.Store
+	blobs      blob.Store
+	corsPolicy corsPolicy
+	metrics    *serverMetrics
+	postLocks  postLocks
+	// resizeCache keeps the pictures resized on request, renders limits how
+	// many are rendered at the same time.
+	resizeCache *resizeCache
+	renders     chan struct{}
+	handler     http.Handler
+}
 
-func Run() {
+// New opens the bolt database and the media store given by cfg, zero values
+// are replaced by the defaults. The returned Server must be closed
+// to release the database.
+func New(cfg Config) (*Server, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
-	instaToken = os.Getenv(EnvInstagramAccessToken)
+	db, err := store.OpenBolt(path.Join(cfg.DataDir, cfg.DbFile))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open db: %w", err)
+	}
 
-	var err error
-	dataDir = helper.GetStringEnv(EnvDataDir, "/data")
-	if len(dataDir) > 1 && dataDir[0] == '.' && dataDir[1] == '/' {
-		dataDir = dataDir[2:]
+	s, err := NewWithStore(cfg, db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
 	}
+	return s, nil
+}
 
-	pictureDir = path.Join(dataDir, "pictures")
-	_, err = os.Stat(pictureDir)
-	if os.IsNotExist(err) {
-		err = os.Mkdir(pictureDir, 0770)
+// NewWithStore is like New but keeps the records in st instead of the bolt
+// database, closing the Server closes st.
+func NewWithStore(cfg Config, st store.Store) (*Server, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
+
+	blobs, err := cfg.blobStore()
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to open/create picture dir")
+		return nil, fmt.Errorf("unable to open media store: %w", err)
+	}
+	log.Info().Str("media_store", cfg.MediaStore).Str("media_urls", cfg.MediaUrls).Msg("media store")
+
+	s := &Server{
+		cfg:        cfg,
+		store:      st,
+		blobs:      blobs,
+		corsPolicy: newCorsPolicy(cfg),
 	}
+	s.metrics = newServerMetrics(st)
 
-	instaPostDir = path.Join(dataDir, "instagram")
-	_, err = os.Stat(instaPostDir)
-	if os.IsNotExist(err) {
-		err = os.Mkdir(instaPostDir, 0770)
+	cacheDir := cfg.ResizeCacheDir
+	if cacheDir == "" {
+		cacheDir = path.Join(cfg.DataDir, "resize-cache")
 	}
+	s.resizeCache, err = newResizeCache(cacheDir, int64(cfg.ResizeCacheSize))
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to open/create instagram dir")
+		return nil, fmt.Errorf("unable to open resize cache: %w", err)
 	}
+	s.renders = make(chan struct{}, runtime.NumCPU())
+	s.metrics.registry.NewGaugeFunc("bwof_resize_cache_bytes", "Size of the cached resized pictures.",
+		func() float64 { return float64(s.resizeCache.bytes()) })
 
-	dbFile := path.Join(dataDir, helper.GetStringEnv(EnvDbFile, "data.db"))
-	db, err = bolt.Open(dbFile, 0600, nil)
+	err = s.bootstrapAdmin(cfg.AdminUser, cfg.AdminPassword)
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to open db")
+		return nil, fmt.Errorf("unable to create initial user: %w", err)
 	}
-	defer func() {
-		err := db.Close()
+
+	s.handler = s.logRequests(s.routes())
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Close closes the store of the server.
+func (s *Server) Close() error {
+	return s.store.Close()
+}
+
+func (s *Server) routes() http.Handler {
+	mux := newRouteMux()
+	mux.HandleFunc(pat.Get("/api/list"), s.cors(s.allow(permRead, s.getList)))
+	mux.HandleFunc(pat.Get("/api/posts"), s.cors(s.allow(permRead, s.getPosts)))
+
+	mux.HandleFunc(pat.Post("/api/login"), s.cors(s.login))
+	mux.HandleFunc(pat.Post("/api/logout"), s.cors(s.auth(s.logout)))
+	mux.HandleFunc(pat.Get("/api/me"), s.cors(s.auth(s.getMe)))
+
+	mux.HandleFunc(pat.Get("/api/user"), s.cors(s.allow(permManageUsers, s.getUsers)))
+	mux.HandleFunc(pat.Post("/api/user"), s.cors(s.allow(permManageUsers, s.createUser)))
+	mux.HandleFunc(pat.Patch("/api/user/:id"), s.cors(s.allow(permManageUsers, s.updateUserAccount)))
+	mux.HandleFunc(pat.Delete("/api/user/:id"), s.cors(s.allow(permManageUsers, s.deleteUser)))
+
+	mux.HandleFunc(pat.Get("/api/key"), s.cors(s.allow(permManageUsers, s.getApiKeys)))
+	mux.HandleFunc(pat.Post("/api/key"), s.cors(s.allow(permManageUsers, s.createApiKey)))
+	mux.HandleFunc(pat.Delete("/api/key/:id"), s.cors(s.allow(permManageUsers, s.revokeApiKey)))
+
+	mux.HandleFunc(pat.Get("/api/picture/:id"), s.cors(s.allow(permBrowse, s.getPicture)))
+	mux.HandleFunc(pat.Get("/api/picture"), s.cors(s.allow(permBrowse, s.getPictures)))
+	mux.HandleFunc(pat.Post("/api/picture"), s.cors(s.allow(permUpload, s.uploadPicture)))
+	mux.HandleFunc(pat.Patch("/api/picture/:id/crop"), s.cors(s.allow(permEditOwn, s.cropPicture)))
+	mux.HandleFunc(pat.Patch("/api/picture/:id/edit"), s.cors(s.allow(permEditOwn, s.editPictureContent)))
+	mux.HandleFunc(pat.Patch("/api/picture/:id/disable"), s.cors(s.allow(permEditOwn, s.disablePicture)))
+	mux.HandleFunc(pat.Delete("/api/picture/:id"), s.cors(s.allow(permEditOwn, s.deletePicture)))
+	mux.HandleFunc(pat.Post("/api/picture/:id/restore"), s.cors(s.allow(permEditOwn, s.restorePicture)))
+	mux.HandleFunc(pat.Get("/api/picture/:id/history"), s.cors(s.allow(permEditOwn, s.getPictureHistory)))
+	mux.HandleFunc(pat.Post("/api/picture/:id/rollback"), s.cors(s.allow(permEditOwn, s.rollbackPicture)))
+
+	mux.HandleFunc(pat.Get("/api/instagram/:id"), s.cors(s.allow(permBrowse, s.getInstagram)))
+	mux.HandleFunc(pat.Get("/api/instagram"), s.cors(s.allow(permBrowse, s.getInstagrams)))
+	mux.HandleFunc(pat.Post("/api/instagram"), s.cors(s.allow(permUpload, s.uploadInstagram)))
+	mux.HandleFunc(pat.Patch("/api/instagram/:id/disable"), s.cors(s.allow(permEditOwn, s.disableInstagram)))
+	mux.HandleFunc(pat.Delete("/api/instagram/:id"), s.cors(s.allow(permEditOwn, s.deleteInstagram)))
+	mux.HandleFunc(pat.Post("/api/instagram/:id/restore"), s.cors(s.allow(permEditOwn, s.restoreInstagram)))
+	mux.HandleFunc(pat.Get("/api/instagram/:id/history"), s.cors(s.allow(permEditOwn, s.getInstagramHistory)))
+	mux.HandleFunc(pat.Post("/api/instagram/:id/rollback"), s.cors(s.allow(permEditOwn, s.rollbackInstagram)))
+
+	mux.HandleFunc(pat.Get("/api/trash"), s.cors(s.allow(permEditOwn, s.getTrash)))
+
+	mux.HandleFunc(pat.Get("/api/backup"), s.cors(s.allow(permBackup, s.getBackup)))
+	mux.HandleFunc(pat.Get("/api/export"), s.cors(s.allow(permBackup, s.getExport)))
+	mux.HandleFunc(pat.Post("/api/import"), s.cors(s.allow(permImport, s.postImport)))
+	mux.HandleFunc(pat.Get("/api/fsck"), s.cors(s.allow(permMaintenance, s.getFsck)))
+	mux.HandleFunc(pat.Post("/api/fsck"), s.cors(s.allow(permMaintenance, s.postFsck)))
+
+	// metrics need an admin session or an api key with the metrics scope
+	mux.HandleFunc(pat.Get("/metrics"), s.allow(permMetrics, s.metrics.registry.Handler().ServeHTTP))
+	mux.HandleFunc(pat.Get("/healthz"), quiet(s.getHealth))
+	mux.HandleFunc(pat.Get("/readyz"), quiet(s.getReady))
+
+	mux.HandleFunc(pat.Get("/pictures/:id/:variant"), s.serveVariant)
+	mux.HandleFunc(pat.Get("/pictures/*"), s.serveMedia)
+	mux.HandleFunc(pat.Get("/instagram/*"), s.serveMedia)
+	mux.Handle(pat.Get("/*"), http.FileServer(http.Dir(s.cfg.PublicDir)))
+
+	mux.handlePreflight(s.preflight)
+	return mux
+}
+
+// ListenAndServe listens on the configured address, with TLS if a key pair is
+// configured, and runs the scheduled backups and the trash purger until ctx is
+// done. It then stops accepting connections and waits up to ShutdownTimeout
+// for in-flight requests, e.g. uploads, and a running backup to finish.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if s.cfg.Addr == "" {
+		s.cfg.Addr = ":8000"
+	}
+	hs := &http.Server{
+		Addr:              s.cfg.Addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+	}
+
+	useTLS := s.cfg.TLSCert != "" && s.cfg.TLSKey != ""
+	if useTLS {
+		cr, err := newCertReloader(s.cfg.TLSCert, s.cfg.TLSKey)
 		if err != nil {
-			log.Error().Err(err).Msg("db.Close()")
+			return fmt.Errorf("unable to load tls key pair: %w", err)
 		}
+		hs.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: cr.GetCertificate,
+		}
+	}
+
+	jctx, stopJobs := context.WithCancel(ctx)
+	var jobs sync.WaitGroup
+	for _, run := range []func(context.Context){s.RunBackups, s.RunPurger} {
+		jobs.Add(1)
+		go func(run func(context.Context)) {
+			defer jobs.Done()
+			run(jctx)
+		}(run)
+	}
+	defer func() {
+		stopJobs()
+		jobs.Wait()
 	}()
 
-	mux := goji.NewMux()
-	mux.HandleFunc(pat.Options("/*"), cors(blank))
-	mux.HandleFunc(pat.Get("/api/list"), cors(getList))
-  mux.HandleFunc(pat.Get("/api/posts"), cors(getPosts))
-
-	mux.HandleFunc(pat.Get("/api/picture/:id"), cors(getPicture))
-	mux.HandleFunc(pat.Get("/api/picture"), cors(getPictures))
-	mux.HandleFunc(pat.Post("/api/picture"), cors(uploadPicture))
-	mux.HandleFunc(pat.Patch("/api/picture/:id/crop"), cors(cropPicture))
-	mux.HandleFunc(pat.Patch("/api/picture/:id/edit"), cors(editPictureContent))
-	mux.HandleFunc(pat.Patch("/api/picture/:id/disable"), cors(disablePicture))
-	mux.HandleFunc(pat.Delete("/api/picture/:id"), cors(deletePicture))
-
-	mux.HandleFunc(pat.Get("/api/instagram/:id"), cors(getInstagram))
-	mux.HandleFunc(pat.Get("/api/instagram"), cors(getInstagrams))
-	mux.HandleFunc(pat.Post("/api/instagram"), cors(uploadInstagram))
-	mux.HandleFunc(pat.Patch("/api/instagram/:id/disable"), cors(disableInstagram))
-	mux.HandleFunc(pat.Delete("/api/instagram/:id"), cors(deleteInstagram))
-
-	mux.Handle(pat.Get("/pictures/*"),
-		http.StripPrefix("/pictures/", http.FileServer(http.Dir(pictureDir))))
-	mux.Handle(pat.Get("/instagram/*"),
-		http.StripPrefix("/instagram/", http.FileServer(http.Dir(instaPostDir))))
-	mux.Handle(pat.Get("/*"), http.FileServer(http.Dir("/app/public")))
-
-	err = http.ListenAndServe(":8000", mux)
-	if err != nil {
-		log.Fatal().Err(err).Msg("unable to start listener")
+	errc := make(chan error, 1)
+	go func() {
+		log.Info().Bool("tls", useTLS).Msgf("service running at %s", s.cfg.Addr)
+		var err error
+		if useTLS {
+			err = hs.ListenAndServeTLS("", "")
+		} else {
+			err = hs.ListenAndServe()
+		}
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
 	}
-	log.Info().Msg("service running at :8000")
+
+	log.Info().Dur("timeout", s.cfg.ShutdownTimeout).Msg("shutting down")
+	sctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	return hs.Shutdown(sctx)
+}
+
+// deadlineSetter is implemented by the response writers of net/http that
+// can change the deadlines of their connection.
+type deadlineSetter interface {
+	SetReadDeadline(deadline time.Time) error
+	SetWriteDeadline(deadline time.Time) error
 }
 
-func blank(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("blank", r.URL)
-	w.WriteHeader(http.StatusOK)
+// liftDeadlines removes the ReadTimeout and WriteTimeout from the connection
+// of r, for requests that transfer whole archives and easily take longer.
+// Wrapping writers are unwrapped until one can set the deadlines.
+func liftDeadlines(w http.ResponseWriter, r *http.Request) {
+	for {
+		if d, ok := w.(deadlineSetter); ok {
+			for _, set := range []func(time.Time) error{d.SetReadDeadline, d.SetWriteDeadline} {
+				if err := set(time.Time{}); err != nil {
+					log.Ctx(r.Context()).Warn().Err(err).Msg("unable to lift deadline")
+				}
+			}
+			return
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			log.Ctx(r.Context()).Warn().Msg("unable to lift deadline, not supported by the connection")
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+// RunFsck checks the data of the given config with Fsck, prints every issue
+// to w and reports whether no issue is left.
+func RunFsck(cfg Config, repair bool, w io.Writer) (bool, error) {
+	s, err := New(cfg)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+
+	report, err := s.Fsck(repair)
+	if err != nil {
+		return false, err
+	}
+	for _, i := range report.Issues {
+		state := ""
+		if i.Repaired {
+			state = " (repaired)"
+		}
+		_, _ = fmt.Fprintf(w, "%-18s %s: %s%s\n", i.Type, i.Path, i.Detail, state)
+	}
+	_, _ = fmt.Fprintf(w, "checked %d pictures and %d instagram posts, %d issues\n",
+		report.Pictures, report.Instagram, len(report.Issues))
+	return report.Ok(), nil
 }
 
-func cors(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods",
-			"OPTIONS, POST, GET, PUT, PATCH, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers",
-			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		f(w, r) // original function call
+// Run starts a Server with the given config and blocks until the process
+// receives SIGINT or SIGTERM, the database is closed after all in-flight
+// requests are done.
+func Run(cfg Config) {
+	s, err := New(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to create server")
+	}
+	defer func() {
+		err := s.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("db.Close()")
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		x := <-sig
+		log.Info().Str("signal", x.String()).Msg("received signal")
+		cancel()
+	}()
+
+	err = s.ListenAndServe(ctx)
+	if err != nil && err != http.ErrServerClosed {
+		log.Error().Err(err).Msg("unable to start listener")
 	}
 }
@@ -0,0 +1,1359 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testAdmin    = "admin"
+	testPassword = "secret123"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server with an in-memory store and its media in a
+// temporary directory, both are removed when the test ends. The config can be
+// changed by configure before the server is created.
+func newTestServer(t *testing.T, configure ...func(*Config)) *Server {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bwof-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return newTestServerIn(t, dir, store.NewMemory(), configure...)
+}
+
+// newBoltTestServer is like newTestServer with a bolt database in the
+// temporary directory.
+func newBoltTestServer(t *testing.T, configure ...func(*Config)) *Server {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bwof-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	db, err := store.OpenBolt(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestServerIn(t, dir, db, configure...)
+}
+
+// newTestServerIn returns a server with the records in st and the media in
+// dir.
+func newTestServerIn(t *testing.T, dir string, st store.Store, configure ...func(*Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.DataDir = dir
+	cfg.PublicDir = dir
+	cfg.AdminUser = testAdmin
+	cfg.AdminPassword = testPassword
+	cfg.RenditionWidths = []int{64}
+	for _, f := range configure {
+		f(&cfg)
+	}
+	s, err := NewWithStore(cfg, st)
+	if err != nil {
+		_ = st.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// do sends a request through s.ServeHTTP, token is sent as bearer token if
+// set.
+func do(t *testing.T, s *Server, method, target, token string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, body)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// decode decodes the JSON body of w into v.
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", w.Body.String(), err)
+	}
+}
+
+// login returns a session token of the initial admin.
+func login(t *testing.T, s *Server) string {
+	t.Helper()
+	w := do(t, s, http.MethodPost, "/api/login", "",
+		strings.NewReader(`{"name":"`+testAdmin+`","password":"`+testPassword+`"}`), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	var res loginResponse
+	decode(t, w, &res)
+	return res.Token
+}
+
+// testPNG returns a png of w x h pixels filled with c.
+func testPNG(t *testing.T, w, h int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadBody returns the multipart form of a picture upload of file and its
+// content type.
+func uploadBody(t *testing.T, file []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="uploadFile"; filename="test.png"`},
+		"Content-Type":        {"image/png"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write(file)
+	_ = mw.WriteField("text", "a test")
+	_ = mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+// upload uploads file as picture and returns the response.
+func upload(t *testing.T, s *Server, token string, file []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	body, contentType := uploadBody(t, file)
+	return do(t, s, http.MethodPost, "/api/picture", token, body,
+		http.Header{"Content-Type": {contentType}})
+}
+
+// uploadPicture uploads a picture of w x h pixels in c and returns it.
+func uploadPicture(t *testing.T, s *Server, token string, w, h int, c color.Color) pictureResponse {
+	t.Helper()
+	res := upload(t, s, token, testPNG(t, w, h, c))
+	if res.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", res.Code, res.Body)
+	}
+	var p pictureResponse
+	decode(t, res, &p)
+	return p
+}
+
+func TestServerPictureLifecycle(t *testing.T) {
+	s := newTestServer(t)
+
+	if w := upload(t, s, "", testPNG(t, 8, 8, color.White)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("upload without login: got %d, want 401", w.Code)
+	}
+	if w := do(t, s, http.MethodPost, "/api/login", "",
+		strings.NewReader(`{"name":"admin","password":"wrong"}`), nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("login with wrong password: got %d, want 401", w.Code)
+	}
+	token := login(t, s)
+
+	red := uploadPicture(t, s, token, 120, 80, color.RGBA{R: 255, A: 255})
+	blue := uploadPicture(t, s, token, 80, 120, color.RGBA{B: 255, A: 255})
+	if red.Width != 120 || red.Height != 80 {
+		t.Errorf("size of upload: got %dx%d, want 120x80", red.Width, red.Height)
+	}
+	if len(red.Renditions) != 1 || red.Renditions[0].Width != 64 {
+		t.Errorf("renditions of upload: got %+v, want one of width 64", red.Renditions)
+	}
+	if w := do(t, s, http.MethodGet, red.OrigUrl, "", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("get original: got %d, want 200", w.Code)
+	}
+
+	w := upload(t, s, token, testPNG(t, 120, 80, color.RGBA{R: 255, A: 255}))
+	if w.Code != http.StatusConflict {
+		t.Errorf("duplicate upload: got %d, want 409", w.Code)
+	}
+
+	list := func() []pictureResponse {
+		t.Helper()
+		w := do(t, s, http.MethodGet, "/api/picture", token, nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list: %d %s", w.Code, w.Body)
+		}
+		var l []pictureResponse
+		decode(t, w, &l)
+		return l
+	}
+	if l := list(); len(l) != 2 || l[0].Id != blue.Id || l[1].Id != red.Id {
+		t.Fatalf("list: got %+v, want blue and red, newest first", l)
+	}
+
+	if w := do(t, s, http.MethodDelete, "/api/picture/"+red.Id, token, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if l := list(); len(l) != 1 || l[0].Id != blue.Id {
+		t.Errorf("list after delete: got %+v, want only blue", l)
+	}
+	if w := do(t, s, http.MethodGet, "/api/picture/"+red.Id, "", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("get deleted picture without login: got %d, want 401", w.Code)
+	}
+	w = do(t, s, http.MethodGet, "/api/trash", token, nil, nil)
+	var trash []pictureResponse
+	decode(t, w, &trash)
+	if len(trash) != 1 || trash[0].Id != red.Id || trash[0].DeletedBy != testAdmin {
+		t.Errorf("trash: got %+v, want red deleted by %s", trash, testAdmin)
+	}
+	if w := do(t, s, http.MethodGet, red.OrigUrl, "", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("get original of deleted picture: got %d, want 404", w.Code)
+	}
+
+	again := uploadPicture(t, s, token, 120, 80, color.RGBA{R: 255, A: 255})
+	if again.Id == red.Id {
+		t.Errorf("upload of deleted content: got the trashed picture")
+	}
+	w = do(t, s, http.MethodPost, "/api/picture/"+red.Id+"/restore", token, nil, nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("restore of uploaded again content: got %d, want 409", w.Code)
+	}
+}
+
+// createKey creates an api key with scope and returns the plain key.
+func createKey(t *testing.T, s *Server, token string, scope models.KeyScope) string {
+	t.Helper()
+	body := `{"name":"` + string(scope) + `","scope":"` + string(scope) + `"}`
+	w := do(t, s, http.MethodPost, "/api/key", token, strings.NewReader(body), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create key: got %d: %s", w.Code, w.Body)
+	}
+	var k apiKeyResponse
+	decode(t, w, &k)
+	return k.Key
+}
+
+func TestServerMissingPost(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+	id := uuid.New().String()
+
+	tests := []struct {
+		method, target, body string
+	}{
+		{http.MethodPatch, "/api/picture/" + id + "/crop", `{"crop":{"width":1,"height":1}}`},
+		{http.MethodPatch, "/api/picture/" + id + "/edit", `{"title":"a","text":"b"}`},
+		{http.MethodPatch, "/api/picture/" + id + "/disable", `{"disable":true}`},
+		{http.MethodDelete, "/api/picture/" + id, ""},
+		{http.MethodPatch, "/api/instagram/" + id + "/disable", `{"disable":true}`},
+		{http.MethodDelete, "/api/instagram/" + id, ""},
+	}
+	for _, tt := range tests {
+		w := do(t, s, tt.method, tt.target, token, strings.NewReader(tt.body), nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: got %d, want 404: %s", tt.method, tt.target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestServerApiKeys(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+
+	w := do(t, s, http.MethodPost, "/api/key", token, strings.NewReader(`{"name":"screen","scope":"admin"}`), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("create key with unknown scope: got %d, want 400", w.Code)
+	}
+
+	key := createKey(t, s, token, models.ScopeRead)
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(parts) != 2 {
+		t.Fatalf("got key %q, want %s<id>_<secret>", key, apiKeyPrefix)
+	}
+	id := uuid.MustParse(parts[0])
+	k, err := s.store.GetApiKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k.Hash, hashApiKeySecret(parts[1])) {
+		t.Errorf("got stored hash %x, want the sha256 of the secret", k.Hash)
+	}
+
+	uploadKey := createKey(t, s, token, models.ScopeUpload)
+	p := uploadPicture(t, s, uploadKey, 4, 4, color.White)
+	pic, err := s.store.GetPicture(uuid.MustParse(p.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pic.Uploader != "key:upload" {
+		t.Errorf("upload with key: got uploader %q, want key:upload", pic.Uploader)
+	}
+
+	w = do(t, s, http.MethodGet, "/api/key", token, nil, nil)
+	if strings.Contains(w.Body.String(), parts[1]) {
+		t.Errorf("list keys: the secret is in the response: %s", w.Body)
+	}
+
+	tests := []struct {
+		name, method, target, token string
+		want                        int
+	}{
+		{"read key", http.MethodGet, "/api/list", key, http.StatusOK},
+		{"read key uploads", http.MethodPost, "/api/picture", key, http.StatusForbidden},
+		{"wrong secret", http.MethodGet, "/api/list", key[:len(key)-1] + "x", http.StatusUnauthorized},
+		{"unknown id", http.MethodGet, "/api/list", apiKeyPrefix + uuid.New().String() + "_" + parts[1], http.StatusUnauthorized},
+		{"malformed", http.MethodGet, "/api/list", apiKeyPrefix + "nope", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if w := do(t, s, tt.method, tt.target, tt.token, nil, nil); w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	w = do(t, s, http.MethodDelete, "/api/key/"+id.String(), token, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d: %s", w.Code, w.Body)
+	}
+	w = do(t, s, http.MethodGet, "/api/list", key, nil, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: got %d, want 401", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("revoked key: got no WWW-Authenticate header")
+	}
+}
+
+func TestServerCORS(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.CORSOrigins = []string{"https://Wall.example/", "http://localhost:3000"}
+	})
+	token := login(t, s)
+
+	tests := []struct {
+		name, method, origin string
+		allowed              bool
+	}{
+		{"preflight", http.MethodOptions, "https://wall.example", true},
+		{"preflight with port", http.MethodOptions, "http://localhost:3000", true},
+		{"preflight of other origin", http.MethodOptions, "https://evil.example", false},
+		{"preflight of other port", http.MethodOptions, "http://localhost:3001", false},
+		{"request", http.MethodGet, "https://wall.example", true},
+		{"request of other origin", http.MethodGet, "https://evil.example", false},
+		{"request without origin", http.MethodGet, "", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Access-Control-Request-Method": {http.MethodDelete}}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		w := do(t, s, tt.method, "/api/picture/"+uuid.New().String(), token, nil, header)
+		h := w.Header()
+		if tt.method == http.MethodOptions && w.Code != http.StatusNoContent {
+			t.Errorf("%s: got %d, want 204", tt.name, w.Code)
+		}
+		if !strings.Contains(strings.Join(h["Vary"], ","), "Origin") {
+			t.Errorf("%s: got Vary %q, want Origin", tt.name, h["Vary"])
+		}
+		if !tt.allowed {
+			for _, k := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Allow-Methods"} {
+				if v := h.Get(k); v != "" {
+					t.Errorf("%s: got %s %q, want none", tt.name, k, v)
+				}
+			}
+			continue
+		}
+		if got := h.Get("Access-Control-Allow-Origin"); got != tt.origin {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want %q", tt.name, got, tt.origin)
+		}
+		if h.Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("%s: credentials aren't allowed", tt.name)
+		}
+		if tt.method != http.MethodOptions {
+			continue
+		}
+		if got := h.Get("Access-Control-Allow-Methods"); !strings.Contains(got, http.MethodDelete) || strings.Contains(got, http.MethodPost) {
+			t.Errorf("%s: got Access-Control-Allow-Methods %q, want the methods of the route", tt.name, got)
+		}
+		if got := h.Get("Access-Control-Max-Age"); got != "600" {
+			t.Errorf("%s: got Access-Control-Max-Age %q, want 600", tt.name, got)
+		}
+	}
+
+	// the default allows any origin, but without credentials
+	s = newTestServer(t)
+	w := do(t, s, http.MethodOptions, "/api/list", "", nil, http.Header{"Origin": {"https://evil.example"}})
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("wildcard: got Access-Control-Allow-Origin %q, want *", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("wildcard: got Access-Control-Allow-Credentials %q, want none", got)
+	}
+
+	for _, o := range []string{"wall.example", "ftp://wall.example", "https://wall.example/path", "https://wall.example?x=1"} {
+		if err := validateOrigin(o); err == nil {
+			t.Errorf("validateOrigin(%q): got no error", o)
+		}
+	}
+}
+
+func TestServerRequestId(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+
+	var logs bytes.Buffer
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(&logs)
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	defer func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	}()
+
+	tests := []struct {
+		name, id string
+		keep     bool
+	}{
+		{"from client", "proxy-1234", true},
+		{"none", "", false},
+		{"with space", "a b", false},
+		{"too long", strings.Repeat("x", maxRequestIdLength+1), false},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		header := http.Header{}
+		if tt.id != "" {
+			header.Set(headerRequestId, tt.id)
+		}
+		// createApiKey logs the request before it rejects the missing scope
+		w := do(t, s, http.MethodPost, "/api/key", token, strings.NewReader(`{"name":"screen"}`), header)
+		id := w.Header().Get(headerRequestId)
+		if tt.keep && id != tt.id {
+			t.Errorf("%s: got id %q, want %q", tt.name, id, tt.id)
+		}
+		if !tt.keep {
+			if _, err := uuid.Parse(id); err != nil {
+				t.Errorf("%s: got id %q, want a new uuid", tt.name, id)
+			}
+		}
+
+		var msgs []string
+		dec := json.NewDecoder(&logs)
+		for dec.More() {
+			var line struct {
+				Message   string `json:"message"`
+				RequestId string `json:"request_id"`
+			}
+			if err := dec.Decode(&line); err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, line.Message)
+			if line.RequestId != id {
+				t.Errorf("%s: log %q has request id %q, want %q", tt.name, line.Message, line.RequestId, id)
+			}
+		}
+		if len(msgs) < 2 || msgs[len(msgs)-1] != "access" {
+			t.Errorf("%s: got logs %q, want the handler logs and the access log", tt.name, msgs)
+		}
+	}
+}
+
+func TestServerBackup(t *testing.T) {
+	w := do(t, newTestServer(t), http.MethodGet, "/api/backup", "", nil, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("backup without token: got %d, want 401", w.Code)
+	}
+	mem := newTestServer(t)
+	w = do(t, mem, http.MethodGet, "/api/backup", login(t, mem), nil, nil)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("backup of the memory store: got %d, want 501", w.Code)
+	}
+
+	s := newBoltTestServer(t)
+	token := login(t, s)
+	p := uploadPicture(t, s, token, 16, 16, color.White)
+
+	w = do(t, s, http.MethodGet, "/api/backup?files=maybe", token, nil, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("backup with files=maybe: got %d, want 400", w.Code)
+	}
+
+	w = do(t, s, http.MethodGet, "/api/backup", token, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("backup: got %d: %s", w.Code, w.Body)
+	}
+	dbFile := filepath.Join(s.cfg.DataDir, "restored.db")
+	if err := ioutil.WriteFile(dbFile, w.Body.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := store.OpenBolt(dbFile)
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	_, err = db.GetPicture(uuid.MustParse(p.Id))
+	_ = db.Close()
+	if err != nil {
+		t.Errorf("backup: uploaded picture: %v", err)
+	}
+
+	w = do(t, s, http.MethodGet, "/api/backup?files=true", token, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("backup with files: got %d: %s", w.Code, w.Body)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[h.Name] = true
+	}
+	if !names[s.cfg.DbFile] || !names[strings.TrimPrefix(p.OrigUrl, "/")] {
+		t.Errorf("backup with files: got %v, want the database and %s", names, p.OrigUrl)
+	}
+}
+
+func TestServerBackupRotation(t *testing.T) {
+	const retention = 3
+	s := newBoltTestServer(t, func(c *Config) {
+		c.BackupRetention = retention
+	})
+	s.cfg.BackupDir = filepath.Join(s.cfg.DataDir, "backups")
+	if err := os.MkdirAll(s.cfg.BackupDir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(s.cfg.BackupDir, "notes.txt")
+	if err := ioutil.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var want []string
+	for i := 0; i < retention+2; i++ {
+		name, err := s.writeBackupFile(start.Add(time.Duration(i) * time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pruneBackups(s.cfg.BackupDir, s.cfg.BackupRetention); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, filepath.Base(name))
+	}
+	want = want[len(want)-retention:]
+
+	infos, err := ioutil.ReadDir(s.cfg.BackupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fi := range infos {
+		if fi.Name() != filepath.Base(other) {
+			got = append(got, fi.Name())
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got backups %v, want the newest %d %v", got, retention, want)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("other file in the backup directory: %v", err)
+	}
+}
+
+func TestServerETags(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+	p := uploadPicture(t, s, token, 16, 16, color.White)
+	target := "/api/picture/" + p.Id
+
+	w := do(t, s, http.MethodGet, target, token, nil, nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("get: got %d with ETag %q, want 200 with a strong ETag", w.Code, etag)
+	}
+	w = do(t, s, http.MethodGet, target, token, nil, http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("get with current If-None-Match: got %d, want 304 without body", w.Code)
+	}
+
+	edit := func(title string, header http.Header) *httptest.ResponseRecorder {
+		return do(t, s, http.MethodPatch, target+"/edit", token,
+			strings.NewReader(`{"title":"`+title+`","text":"text"}`), header)
+	}
+	w = edit("first", http.Header{"If-Match": {etag}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("edit with current If-Match: got %d: %s", w.Code, w.Body)
+	}
+	current := w.Header().Get("ETag")
+	if current == "" || current == etag {
+		t.Errorf("edit: got ETag %q, want a new one", current)
+	}
+
+	// etag is stale now
+	w = edit("second", http.Header{"If-Match": {etag}})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("edit with stale If-Match: got %d, want 412", w.Code)
+	}
+	if got := w.Header().Get("ETag"); got != current {
+		t.Errorf("edit with stale If-Match: got ETag %q, want %q", got, current)
+	}
+	w = do(t, s, http.MethodDelete, target, token, nil, http.Header{"If-Match": {etag}})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete with stale If-Match: got %d, want 412", w.Code)
+	}
+	w = do(t, s, http.MethodGet, target, token, nil, http.Header{"If-None-Match": {etag}})
+	var got pictureResponse
+	decode(t, w, &got)
+	if w.Code != http.StatusOK || got.Title != "first" || got.DeletedAt != nil {
+		t.Errorf("after rejected changes: got %d %+v, want the first edit", w.Code, got)
+	}
+
+	for _, header := range []http.Header{
+		{"If-Match": {`"0", ` + current}},
+		{"If-Match": {"*"}},
+		nil,
+	} {
+		if w := edit("third", header); w.Code != http.StatusOK {
+			t.Errorf("edit with If-Match %q: got %d, want 200", header.Get("If-Match"), w.Code)
+		}
+	}
+
+	w = do(t, s, http.MethodGet, "/api/list", token, nil, nil)
+	list := w.Header().Get("ETag")
+	if !strings.HasPrefix(list, "W/") {
+		t.Fatalf("list: got ETag %q, want a weak one", list)
+	}
+	if w := do(t, s, http.MethodGet, "/api/list", token, nil, http.Header{"If-None-Match": {list}}); w.Code != http.StatusNotModified {
+		t.Errorf("list with current If-None-Match: got %d, want 304", w.Code)
+	}
+	edit("fourth", nil)
+	if w := do(t, s, http.MethodGet, "/api/list", token, nil, http.Header{"If-None-Match": {list}}); w.Code != http.StatusOK {
+		t.Errorf("list with stale If-None-Match: got %d, want 200", w.Code)
+	}
+}
+
+func TestServerRenditions(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.RenditionWidths = []int{64, 32, 64, 256}
+	})
+	token := login(t, s)
+
+	p := uploadPicture(t, s, token, 100, 50, color.White)
+	if len(p.Renditions) != 2 {
+		t.Fatalf("renditions: got %+v, want widths 32 and 64", p.Renditions)
+	}
+	var want []string
+	for i, w := range []int{32, 64} {
+		r := p.Renditions[i]
+		if r.Width != w || r.Height != w/2 || r.Cropped {
+			t.Errorf("rendition %d: got %+v, want %dx%d of the original", i, r, w, w/2)
+		}
+		res := do(t, s, http.MethodGet, r.Url, "", nil, nil)
+		if res.Code != http.StatusOK {
+			t.Errorf("rendition %s: got %d, want 200", r.Url, res.Code)
+			continue
+		}
+		if cfg, _, err := image.DecodeConfig(res.Body); err != nil || cfg.Width != w {
+			t.Errorf("rendition %s: got width %d (%v), want %d", r.Url, cfg.Width, err, w)
+		}
+		want = append(want, fmt.Sprintf("%s %dw", r.Url, w))
+	}
+	want = append(want, p.OrigUrl+" 100w")
+	if p.Srcset != strings.Join(want, ", ") {
+		t.Errorf("srcset: got %q, want %q", p.Srcset, strings.Join(want, ", "))
+	}
+
+	// a picture narrower than every width is only served as it is
+	small := uploadPicture(t, s, token, 30, 30, color.Black)
+	if len(small.Renditions) != 0 || small.Srcset != small.OrigUrl+" 30w" {
+		t.Errorf("small picture: got renditions %+v and srcset %q, want only the original",
+			small.Renditions, small.Srcset)
+	}
+
+	cfg := DefaultConfig()
+	cfg.RenditionWidths = []int{640, 0}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "rendition_widths") {
+		t.Errorf("Validate with width 0: got %v, want a rendition_widths error", err)
+	}
+}
+
+func TestResizeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwof-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cached := func() []string {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(infos))
+		for i, fi := range infos {
+			names[i] = fi.Name()
+		}
+		return names
+	}
+
+	c, err := newResizeCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := c.put(name, []byte("1234")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, ok := c.open("a")
+	if !ok {
+		t.Fatal("open a: not cached")
+	}
+	_ = f.Close()
+	// b is the least recently used now
+	if err := c.put("c", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	if got := cached(); strings.Join(got, ",") != "a,c" || c.bytes() != 8 {
+		t.Errorf("after eviction: got %v with %d bytes, want a,c with 8", got, c.bytes())
+	}
+	if _, ok := c.open("b"); ok {
+		t.Error("open b: got the evicted file")
+	}
+
+	if err := c.put("big", make([]byte, 11)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.open("big"); ok || c.bytes() != 8 {
+		t.Errorf("file larger than the cache: got stored, %d bytes", c.bytes())
+	}
+
+	// a reopened cache ranks by modification time and drops interrupted writes
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "c"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".put-1"), []byte("12"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err = newResizeCache(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cached(); strings.Join(got, ",") != "a" || c.bytes() != 4 {
+		t.Errorf("reopened with 4 bytes: got %v with %d bytes, want a with 4", got, c.bytes())
+	}
+}
+
+func TestServerResize(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.ResizeSizes = []int{16, 32}
+	})
+	token := login(t, s)
+	p := uploadPicture(t, s, token, 64, 32, color.White)
+	base := "/pictures/" + p.Id + "/"
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"original", http.StatusBadRequest},
+		{"original?w=20", http.StatusBadRequest},
+		{"original?w=x", http.StatusBadRequest},
+		{"original?w=16&h=4096", http.StatusBadRequest},
+		{"original?w=16&fit=stretch", http.StatusBadRequest},
+		{"original?w=16&fmt=gif", http.StatusBadRequest},
+		{"crop?w=16", http.StatusNotFound},
+		{uuid.New().String() + "/original?w=16", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		target := base + tt.query
+		if strings.Contains(tt.query, "/") {
+			target = "/pictures/" + tt.query
+		}
+		if w := do(t, s, http.MethodGet, target, "", nil, nil); w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", target, w.Code, tt.want)
+		}
+	}
+	if n := s.resizeCache.bytes(); n != 0 {
+		t.Errorf("rejected requests: got %d cached bytes, want 0", n)
+	}
+
+	sizes := []struct {
+		query         string
+		width, height int
+	}{
+		{"original?w=32", 32, 16},
+		{"original?w=32&h=16", 32, 16},
+		{"original?h=16&w=32", 32, 16},
+		{"auto?w=16&h=16", 16, 16},
+		{"auto?w=16&h=16&fit=contain", 16, 8},
+	}
+	etags := make(map[string]bool)
+	for _, sz := range sizes {
+		w := do(t, s, http.MethodGet, base+sz.query, "", nil, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d, want 200", sz.query, w.Code)
+			continue
+		}
+		etags[w.Header().Get("ETag")] = true
+		if cfg, _, err := image.DecodeConfig(w.Body); err != nil || cfg.Width != sz.width || cfg.Height != sz.height {
+			t.Errorf("%s: got %dx%d (%v), want %dx%d", sz.query, cfg.Width, cfg.Height, err, sz.width, sz.height)
+		}
+	}
+	// the order of the parameters doesn't change the key
+	if len(etags) != len(sizes)-1 {
+		t.Errorf("got %d distinct results, want %d", len(etags), len(sizes)-1)
+	}
+
+	// served from the cache once the source is gone
+	pic, err := s.store.GetPicture(uuid.MustParse(p.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.blobs.Delete(mediaKey(kindPictures, pic.Id, pic.OriginalPath)); err != nil {
+		t.Fatal(err)
+	}
+	if w := do(t, s, http.MethodGet, base+"original?w=32", "", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("cached resize: got %d, want 200", w.Code)
+	}
+	if w := do(t, s, http.MethodGet, base+"original?w=16", "", nil, nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("uncached resize without source: got %d, want 500", w.Code)
+	}
+}
+
+func TestServerMetricsAuth(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"read key", createKey(t, s, token, models.ScopeRead), http.StatusForbidden},
+		{"metrics key", createKey(t, s, token, models.ScopeMetrics), http.StatusOK},
+		{"admin", token, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := do(t, s, http.MethodGet, "/metrics", tt.token, nil, nil); w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	key := createKey(t, s, token, models.ScopeMetrics)
+	if w := do(t, s, http.MethodGet, "/api/picture", key, nil, nil); w.Code != http.StatusForbidden {
+		t.Errorf("metrics key on /api/picture: got %d, want 403", w.Code)
+	}
+}
+
+func TestServerMetricsMethods(t *testing.T) {
+	s := newTestServer(t)
+	do(t, s, "BREW", "/api/picture", "", nil, nil)
+	do(t, s, http.MethodGet, "/api/picture", "", nil, nil)
+
+	w := do(t, s, http.MethodGet, "/metrics", login(t, s), nil, nil)
+	body := w.Body.String()
+	if strings.Contains(body, `method="BREW"`) {
+		t.Errorf("metrics: unknown method is a label value:\n%s", body)
+	}
+	for _, m := range []string{methodOther, http.MethodGet} {
+		if !strings.Contains(body, `method="`+m+`"`) {
+			t.Errorf("metrics: no requests with method %s:\n%s", m, body)
+		}
+	}
+}
+
+func TestServerListPages(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+
+	if w := do(t, s, http.MethodGet, "/api/picture", token, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("empty list: got %d, want 404", w.Code)
+	}
+	want := make([]string, 3)
+	for i := range want {
+		// newest first
+		want[len(want)-1-i] = uploadPicture(t, s, token, 8, 8, color.RGBA{G: uint8(i), A: 255}).Id
+	}
+
+	list := func(target string) ([]string, string) {
+		t.Helper()
+		w := do(t, s, http.MethodGet, target, token, nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list %s: %d %s", target, w.Code, w.Body)
+		}
+		var l []pictureResponse
+		decode(t, w, &l)
+		ids := make([]string, len(l))
+		for i, p := range l {
+			ids[i] = p.Id
+		}
+		return ids, w.Header().Get(headerNextCursor)
+	}
+	if got, next := list("/api/picture"); strings.Join(got, ",") != strings.Join(want, ",") || next != "" {
+		t.Errorf("without limit: got %v %q, want all of %v", got, next, want)
+	}
+
+	var got []string
+	target := "/api/picture?limit=2"
+	for target != "" {
+		page, next := list(target)
+		got = append(got, page...)
+		target = ""
+		if next != "" {
+			target = "/api/picture?cursor=" + next
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("pages: got %v, want %v", got, want)
+	}
+
+	if got, _ := list("/api/picture?uploader=nobody"); len(got) != 0 {
+		t.Errorf("filtered list: got %v, want none", got)
+	}
+}
+
+func TestServerExportImport(t *testing.T) {
+	src := newTestServer(t)
+	token := login(t, src)
+	p := uploadPicture(t, src, token, 32, 16, color.RGBA{R: 200, A: 255})
+	w := do(t, src, http.MethodPatch, "/api/picture/"+p.Id+"/edit", token,
+		strings.NewReader(`{"title":"edited","text":"by the test"}`), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("edit: %d %s", w.Code, w.Body)
+	}
+	w = do(t, src, http.MethodGet, "/api/export", token, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", w.Code, w.Body)
+	}
+	archive := w.Body.Bytes()
+
+	dst := newTestServer(t)
+	token = login(t, dst)
+	w = do(t, dst, http.MethodPost, "/api/import", token, bytes.NewReader(archive), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", w.Code, w.Body)
+	}
+	var res importResult
+	decode(t, w, &res)
+	if res.Imported != 1 {
+		t.Errorf("import: got %+v, want one imported post", res)
+	}
+
+	w = do(t, dst, http.MethodGet, "/api/picture/"+p.Id+"/history", token, nil, nil)
+	var revs []models.Revision
+	decode(t, w, &revs)
+	if len(revs) != 2 || revs[0].Action != models.RevisionOriginal || revs[1].State.Content.Title != "edited" {
+		t.Errorf("imported history: got %+v, want original and content revision", revs)
+	}
+	if w := do(t, dst, http.MethodGet, p.OrigUrl, "", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("imported original: got %d, want 200", w.Code)
+	}
+}
+
+func TestServerFsckRepair(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+	p := uploadPicture(t, s, token, 120, 80, color.RGBA{B: 200, A: 255})
+	pic, err := s.store.GetPicture(uuid.MustParse(p.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := []string{
+		mediaKey(kindPictures, pic.Id, pic.ThumbnailPath),
+		mediaKey(kindPictures, pic.Id, pic.Renditions[0].Path),
+	}
+	for _, key := range missing {
+		if err := s.blobs.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := do(t, s, http.MethodPost, "/api/fsck", token, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("fsck: %d %s", w.Code, w.Body)
+	}
+	var report FsckReport
+	decode(t, w, &report)
+	if len(report.Issues) != len(missing) || !report.Ok() {
+		t.Errorf("fsck: got %+v, want %d repaired missing files", report.Issues, len(missing))
+	}
+	for _, key := range missing {
+		rc, _, err := s.blobs.Get(key)
+		if err != nil {
+			t.Errorf("%s after repair: %v", key, err)
+			continue
+		}
+		_ = rc.Close()
+	}
+
+	w = do(t, s, http.MethodGet, "/api/fsck", token, nil, nil)
+	decode(t, w, &report)
+	if len(report.Issues) != 0 {
+		t.Errorf("fsck after repair: got %+v, want no issues", report.Issues)
+	}
+}
+
+func TestServerCropRollback(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+	p := uploadPicture(t, s, token, 120, 80, color.RGBA{G: 200, A: 255})
+	crop := func(body string) pictureResponse {
+		t.Helper()
+		w := do(t, s, http.MethodPatch, "/api/picture/"+p.Id+"/crop", token, strings.NewReader(body), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("crop %s: %d %s", body, w.Code, w.Body)
+		}
+		var res pictureResponse
+		decode(t, w, &res)
+		return res
+	}
+
+	get := func(url string) int {
+		t.Helper()
+		return do(t, s, http.MethodGet, url, "", nil, nil).Code
+	}
+
+	edge := image.Rect(60, 0, 120, 60)
+	first := crop(`{"crop":{"x":60,"y":0,"width":100,"height":60}}`)
+	if first.CroppedBounds != edge {
+		t.Errorf("crop over the edge: got %v, want %v", first.CroppedBounds, edge)
+	}
+	second := crop(`{"crop":{"x":10,"y":10,"width":100,"height":60}}`)
+	if second.CroppedUrl == first.CroppedUrl {
+		t.Errorf("crop again: got the url of the previous crop %s", first.CroppedUrl)
+	}
+	if len(second.Renditions) != 2 {
+		t.Errorf("renditions of crop: got %+v, want of original and crop", second.Renditions)
+	}
+	if c := get(first.CroppedUrl); c != http.StatusNotFound {
+		t.Errorf("previous crop: got %d, want 404", c)
+	}
+	for _, url := range []string{second.CroppedUrl, second.ThumbCropUrl, second.Renditions[1].Url} {
+		if c := get(url); c != http.StatusOK {
+			t.Errorf("get %s: got %d, want 200", url, c)
+		}
+	}
+
+	// revisions recorded before crops were clamped
+	if err := s.store.AddRevision(&models.Revision{
+		PostId:  uuid.MustParse(p.Id),
+		Action:  models.RevisionCrop,
+		Author:  testAdmin,
+		Changes: make([]models.Change, 0),
+		State:   models.RevisionState{UseCropped: true, CroppedBounds: image.Rect(60, 0, 160, 60)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	w := do(t, s, http.MethodGet, "/api/picture/"+p.Id+"/history", token, nil, nil)
+	var revs []models.Revision
+	decode(t, w, &revs)
+	w = do(t, s, http.MethodPost, "/api/picture/"+p.Id+"/rollback", token,
+		strings.NewReader(`{"revision":`+strconv.Itoa(revs[len(revs)-1].Number)+`}`), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rollback to unclamped crop: %d %s", w.Code, w.Body)
+	}
+	var res pictureResponse
+	decode(t, w, &res)
+	if res.CroppedBounds != edge || !res.UseCrop {
+		t.Errorf("rollback to unclamped crop: got %v, want %v", res.CroppedBounds, edge)
+	}
+
+	off := crop(`{"crop":{"x":0,"y":0,"width":0,"height":0}}`)
+	if off.UseCrop || off.CroppedUrl != "" || len(off.Renditions) != 1 {
+		t.Errorf("disabled crop: got %+v, want no crop and only renditions of the original", off)
+	}
+	infos, err := s.blobs.List(mediaPrefix(kindPictures, uuid.MustParse(p.Id)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range infos {
+		if strings.Contains(i.Key, "crop") {
+			t.Errorf("file of disabled crop left: %s", i.Key)
+		}
+	}
+}
+
+func TestServerLegacyMetadata(t *testing.T) {
+	s := newTestServer(t)
+	token := login(t, s)
+	p := uploadPicture(t, s, token, 40, 30, color.White)
+	if p.Metadata == nil || p.Metadata.Width != 40 || p.Metadata.Format != "png" {
+		t.Errorf("metadata of upload: got %+v, want 40 wide png", p.Metadata)
+	}
+
+	legacy := &models.Picture{Id: uuid.New(), Uploader: testAdmin}
+	if err := s.store.InsertPicture(legacy); err != nil {
+		t.Fatal(err)
+	}
+	w := do(t, s, http.MethodGet, "/api/picture/"+legacy.Id.String(), token, nil, nil)
+	var res pictureResponse
+	decode(t, w, &res)
+	if res.Metadata != nil {
+		t.Errorf("metadata of legacy picture: got %+v, want none", res.Metadata)
+	}
+}
+
+func TestLiftDeadlines(t *testing.T) {
+	for _, lift := range []bool{true, false} {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w = &statusWriter{ResponseWriter: w}
+			if lift {
+				liftDeadlines(w, r)
+			}
+			time.Sleep(300 * time.Millisecond)
+			_, _ = w.Write([]byte("archive"))
+		}))
+		srv.Config.WriteTimeout = 100 * time.Millisecond
+		srv.Start()
+		res, err := http.Get(srv.URL)
+		var body []byte
+		if err == nil {
+			body, err = ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+		}
+		srv.Close()
+		if lift && (err != nil || string(body) != "archive") {
+			t.Errorf("with lifted deadline: got %q %v, want archive", body, err)
+		}
+		if !lift && err == nil {
+			t.Errorf("without lifted deadline: got %q, want an error", body)
+		}
+	}
+}
+
+// writeCert writes a new self-signed key pair for name to dir and returns
+// the DER of the certificate.
+func writeCert(t *testing.T, dir, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwof-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("missing key pair: got no error")
+	}
+
+	// touch moves the modification time of the key pair forward and makes the
+	// next handshake check the files
+	later := time.Now()
+	touch := func(c *certReloader) {
+		later = later.Add(time.Minute)
+		for _, f := range []string{certFile, keyFile} {
+			if err := os.Chtimes(f, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.lastCheck = time.Time{}
+	}
+	served := func(c *certReloader) []byte {
+		cert, err := c.GetCertificate(nil)
+		if err != nil || cert == nil {
+			t.Fatalf("GetCertificate: got %v, %v", cert, err)
+		}
+		return cert.Certificate[0]
+	}
+
+	first := writeCert(t, dir, "first.test")
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(served(c), first) {
+		t.Error("got another certificate than the initial one")
+	}
+
+	second := writeCert(t, dir, "second.test")
+	if !bytes.Equal(served(c), first) {
+		t.Error("reloaded within the check interval")
+	}
+	touch(c)
+	if !bytes.Equal(served(c), second) {
+		t.Error("renewed certificate: got the old one, want the new one")
+	}
+
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(c)
+	if !bytes.Equal(served(c), second) {
+		t.Error("broken certificate: want the previous one to be served")
+	}
+}
+
+// freeAddr returns a local address that is free to listen on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	for _, timeout := range []time.Duration{5 * time.Second, 100 * time.Millisecond} {
+		s := newTestServer(t)
+		token := login(t, s)
+		s.cfg.Addr = freeAddr(t)
+		s.cfg.ShutdownTimeout = timeout
+		url := "http://" + s.cfg.Addr
+		// a connection the transport dials ahead but never uses would keep
+		// the shutdown waiting
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- s.ListenAndServe(ctx) }()
+		for i := 0; ; i++ {
+			res, err := client.Get(url + "/healthz")
+			if err == nil {
+				_ = res.Body.Close()
+				break
+			}
+			if i == 50 {
+				cancel()
+				t.Fatalf("server didn't start: %v", err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		// an upload whose body is still sent while the server shuts down
+		body, contentType := uploadBody(t, testPNG(t, 8, 8, color.White))
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest(http.MethodPost, url+"/api/picture", pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+token)
+		status := make(chan int, 1)
+		go func() {
+			res, err := client.Do(req)
+			if err != nil {
+				status <- 0
+				return
+			}
+			_ = res.Body.Close()
+			status <- res.StatusCode
+		}()
+		_, _ = pw.Write(body.Next(body.Len() / 2))
+		time.Sleep(100 * time.Millisecond)
+
+		cancel()
+		for i := 0; ; i++ {
+			conn, err := net.Dial("tcp", s.cfg.Addr)
+			if err != nil {
+				break
+			}
+			_ = conn.Close()
+			if i == 50 {
+				t.Fatal("still accepting connections after shutdown")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		if timeout < time.Second {
+			// the upload is never finished within the timeout
+			if err := <-done; err != context.DeadlineExceeded {
+				t.Errorf("shutdown with timeout: got %v, want %v", err, context.DeadlineExceeded)
+			}
+			_ = pw.CloseWithError(io.ErrUnexpectedEOF)
+			<-status
+			continue
+		}
+
+		_, _ = pw.Write(body.Bytes())
+		_ = pw.Close()
+		if code := <-status; code != http.StatusOK {
+			t.Errorf("upload during shutdown: got %d, want 200", code)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("shutdown: got %v, want nil", err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/rs/zerolog/log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// certCheckInterval limits how often the certificate files are checked
+	// for changes during handshakes.
+	certCheckInterval = 10 * time.Second
+)
+
+// certReloader serves a key pair from disk and reloads it as soon as one of
+// the files changed, so renewed certificates are picked up without restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the key pair if it changed since the last call.
+func (c *certReloader) load() error {
+	mt, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && !mt.After(c.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		log.Info().Str("cert", c.certFile).Msg("reloaded tls certificate")
+	}
+	c.cert = &cert
+	c.modTime = mt
+	return nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var mt time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return mt, err
+		}
+		if fi.ModTime().After(mt) {
+			mt = fi.ModTime()
+		}
+	}
+	return mt, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate. If reloading
+// fails, the previous certificate keeps being served.
+func (c *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastCheck) > certCheckInterval {
+		c.lastCheck = time.Now()
+		if err := c.load(); err != nil {
+			log.Error().Err(err).Str("cert", c.certFile).Msg("unable to reload tls certificate")
+		}
+	}
+	return c.cert, nil
+}
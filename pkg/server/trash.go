@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/store"
+	"goji.io/pat"
+	"net/http"
+	"time"
+)
+
+// purgeInterval is how often RunPurger looks for expired posts in the trash.
+const purgeInterval = time.Hour
+
+// errTrashed is sent for changes to a post in the trash, it has to be
+// restored first.
+const errTrashed = "post is in the trash"
+
+// getTrash lists the posts in the trash with the parameters of
+// parseListOptions. Users that can't moderate only see their own posts.
+func (s *Server) getTrash(w http.ResponseWriter, r *http.Request) {
+	o, err := parseListOptions(r)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	o.Trashed = true
+	if u := userFromContext(r.Context()); !hasPermission(u, permModerate) {
+		o.Uploader = u.Name
+	}
+	s.writePosts(w, r, o, "the trash is empty")
+}
+
+func (s *Server) restorePicture(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+	unlock := s.postLocks.lock(id)
+	defer unlock()
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Msg("restorePicture")
+
+	pic, err := s.store.GetPicture(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !canModify(r, pic.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, pic.Version) {
+		return
+	}
+	if pic.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, "picture is not in the trash")
+		return
+	}
+
+	pic.DeletedAt = time.Time{}
+	pic.DeletedBy = ""
+	err = s.store.UpdatePicture(pic)
+	if err != nil {
+		writeUpdateError(w, r, err)
+		return
+	}
+
+	setETag(w, pic.Version)
+	_, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*pic))
+}
+
+func (s *Server) restoreInstagram(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+	unlock := s.postLocks.lock(id)
+	defer unlock()
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Msg("restoreInstagram")
+
+	post, err := s.store.GetInstagram(id)
+	if err == store.ErrNotFound {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !canModify(r, post.Uploader) {
+		_, _ = helper.WriteError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	if !ifMatch(w, r, post.Version) {
+		return
+	}
+	if post.DeletedAt.IsZero() {
+		_, _ = helper.WriteError(w, http.StatusConflict, "instagram post is not in the trash")
+		return
+	}
+
+	post.DeletedAt = time.Time{}
+	post.DeletedBy = ""
+	err = s.store.UpdateInstagram(post)
+	if err != nil {
+		writeUpdateError(w, r, err)
+		return
+	}
+
+	setETag(w, post.Version)
+	_, _ = helper.WriteJson(w, http.StatusOK, fromInsta(*post))
+}
+
+// RunPurger permanently deletes the posts that have been in the trash for
+// longer than TrashRetention, once at start and then every purgeInterval
+// until ctx is done.
+func (s *Server) RunPurger(ctx context.Context) {
+	t := time.NewTicker(purgeInterval)
+	defer t.Stop()
+	for {
+		n, err := s.purgeTrash(time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("unable to purge trash")
+		} else if n > 0 {
+			log.Info().Int("posts", n).Msg("purged trash")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// purgeTrash permanently deletes the posts moved to the trash before now
+// minus TrashRetention and returns how many it deleted. The record is deleted
+// before the media, so a failure leaves at most orphaned files for fsck.
+func (s *Server) purgeTrash(now time.Time) (int, error) {
+	cutoff := now.Add(-s.cfg.TrashRetention)
+	expired := func(t time.Time) bool {
+		return !t.IsZero() && !t.After(cutoff)
+	}
+
+	n := 0
+	pics, err := s.store.GetPictures()
+	if err != nil {
+		return n, err
+	}
+	for _, p := range pics {
+		if !expired(p.DeletedAt) {
+			continue
+		}
+		purged, err := s.purge(kindPictures, p.Id, func() (bool, error) {
+			cur, err := s.store.GetPicture(p.Id)
+			return err == nil && expired(cur.DeletedAt), err
+		}, s.store.DeletePicture)
+		if err != nil {
+			return n, err
+		}
+		if purged {
+			n++
+		}
+	}
+
+	inst, err := s.store.GetInstagrams()
+	if err != nil {
+		return n, err
+	}
+	for _, i := range inst {
+		if !expired(i.DeletedAt) {
+			continue
+		}
+		purged, err := s.purge(kindInstagram, i.Id, func() (bool, error) {
+			cur, err := s.store.GetInstagram(i.Id)
+			return err == nil && expired(cur.DeletedAt), err
+		}, s.store.DeleteInstagram)
+		if err != nil {
+			return n, err
+		}
+		if purged {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// purge deletes the record of a post with del and then its revisions and
+// media. It holds the lock of the post and only purges it if expired still
+// reports true then, since it may have been restored in the meantime.
+func (s *Server) purge(kind string, id uuid.UUID, expired func() (bool, error), del func(uuid.UUID) error) (bool, error) {
+	unlock := s.postLocks.lock(id)
+	defer unlock()
+
+	ok, err := expired()
+	if err == store.ErrNotFound || (err == nil && !ok) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := del(id); err != nil {
+		return false, fmt.Errorf("delete %s/%s: %w", kind, id, err)
+	}
+	if err := s.store.DeleteRevisions(id); err != nil {
+		return true, fmt.Errorf("delete revisions of %s/%s: %w", kind, id, err)
+	}
+	if err := s.blobs.DeletePrefix(mediaPrefix(kind, id)); err != nil {
+		return true, fmt.Errorf("delete media of %s/%s: %w", kind, id, err)
+	}
+	log.Info().Str("kind", kind).Str("id", id.String()).Msg("purged post")
+	return true, nil
+}
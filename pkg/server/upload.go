@@ -2,21 +2,21 @@ package server
 
 import (
   "encoding/json"
+  "errors"
   "fmt"
   "github.com/google/uuid"
   "github.com/muesli/smartcrop"
   "github.com/muesli/smartcrop/nfnt"
   "github.com/nfnt/resize"
   "github.com/rs/zerolog/log"
+  "github.com/rverst/bwof-backend/pkg/exif"
   "github.com/rverst/bwof-backend/pkg/helper"
   "github.com/rverst/bwof-backend/pkg/models"
+  "github.com/rverst/bwof-backend/pkg/store"
   "image"
-  "image/jpeg"
-  "image/png"
+  "io"
   "mime/multipart"
   "net/http"
-  "os"
-  "path"
   "path/filepath"
   "regexp"
   "strings"
@@ -39,23 +39,46 @@ var (
   errInvalidPost = fmt.Errorf("invalid instagram post url")
 )
 
+// duplicateError is returned by savePicture if the same picture was uploaded
+// before and isn't in the trash.
+type duplicateError struct {
+  existing *models.Picture
+}
+
+func (e *duplicateError) Error() string {
+  return fmt.Sprintf("picture was already uploaded as %s", e.existing.Id)
+}
+
 type pictureResponse struct {
-  Id            string          `json:"id"`
-  Disabled      bool            `json:"disabled"`
-  Type          int             `json:"type"`
-  Title         string          `json:"title"`
-  Text          string          `json:"text"`
-  OrigUrl       string          `json:"orig_url"`
-  CroppedUrl    string          `json:"cropped_url"`
-  ThumbUrl      string          `json:"thumb_url"`
-  ThumbCropUrl  string          `json:"thumb_crop_url"`
-  Width         int             `json:"width"`
-  Height        int             `json:"height"`
-  UseCrop       bool            `json:"use_crop"`
-  TopCrop       image.Rectangle `json:"top_crop"`
-  CroppedBounds image.Rectangle `json:"cropped_bounds"`
-  Created       time.Time       `json:"created"`
-  Edited        time.Time       `json:"edited"`
+  Id            string              `json:"id"`
+  Disabled      bool                `json:"disabled"`
+  Type          int                 `json:"type"`
+  Title         string              `json:"title"`
+  Text          string              `json:"text"`
+  OrigUrl       string              `json:"orig_url"`
+  CroppedUrl    string              `json:"cropped_url"`
+  ThumbUrl      string              `json:"thumb_url"`
+  ThumbCropUrl  string              `json:"thumb_crop_url"`
+  Width         int                 `json:"width"`
+  Height        int                 `json:"height"`
+  UseCrop       bool                `json:"use_crop"`
+  TopCrop       image.Rectangle     `json:"top_crop"`
+  CroppedBounds image.Rectangle     `json:"cropped_bounds"`
+  Renditions    []renditionResponse `json:"renditions,omitempty"`
+  Metadata      *models.Metadata    `json:"metadata,omitempty"`
+  Srcset        string              `json:"srcset,omitempty"`
+  Created       time.Time           `json:"created"`
+  Edited        time.Time           `json:"edited"`
+  DeletedAt     *time.Time          `json:"deleted_at,omitempty"`
+  DeletedBy     string              `json:"deleted_by,omitempty"`
+}
+
+// renditionResponse is a downscaled copy of the original or the crop.
+type renditionResponse struct {
+  Url     string `json:"url"`
+  Width   int    `json:"width"`
+  Height  int    `json:"height"`
+  Cropped bool   `json:"cropped"`
 }
 
 func fromPicture(p models.Picture) pictureResponse {
@@ -73,9 +96,26 @@ func fromPicture(p models.Picture) pictureResponse {
     TopCrop:       p.TopCrop,
     CroppedBounds: p.CroppedBounds,
     Created:       p.Uploaded,
+    Edited:        p.Edited,
     Width:         p.OriginalBounds.Dx(),
     Height:        p.OriginalBounds.Dy(),
   }
+  if !p.DeletedAt.IsZero() {
+    r.DeletedAt, r.DeletedBy = &p.DeletedAt, p.DeletedBy
+  }
+  for _, x := range p.Renditions {
+    r.Renditions = append(r.Renditions, renditionResponse{
+      Url:     x.Url,
+      Width:   x.Width,
+      Height:  x.Height,
+      Cropped: x.Cropped,
+    })
+  }
+  r.Srcset = srcset(p, p.UseCropped)
+  // pictures uploaded before metadata was extracted have none
+  if p.Metadata != (models.Metadata{}) {
+    r.Metadata = &p.Metadata
+  }
   return r
 }
 
@@ -90,27 +130,30 @@ func fromInsta(i models.Instagram) pictureResponse {
     Created:  i.Uploaded,
     Edited:   i.Edited,
   }
+  if !i.DeletedAt.IsZero() {
+    r.DeletedAt, r.DeletedBy = &i.DeletedAt, i.DeletedBy
+  }
   return r
 }
 
-func uploadPicture(w http.ResponseWriter, r *http.Request) {
+func (s *Server) uploadPicture(w http.ResponseWriter, r *http.Request) {
 
   if !typeRegex.MatchString(r.Header.Get("Content-Type")) {
-    log.Error().Msg("wrong content-type")
+    log.Ctx(r.Context()).Error().Msg("wrong content-type")
     _, _ = helper.WriteError(w, http.StatusBadRequest, "request Content-Type isn't multipart/form-data")
     return
   }
 
   err := r.ParseMultipartForm(32 << 18)
   if err != nil {
-    log.Error().Err(err).Msg("parse multipartForm failed")
+    log.Ctx(r.Context()).Error().Err(err).Msg("parse multipartForm failed")
     _, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
     return
   }
 
   file, handler, err := r.FormFile("uploadFile")
   if err != nil {
-    log.Error().Err(err).Msg("get file")
+    log.Ctx(r.Context()).Error().Err(err).Msg("get file")
     _, _ = helper.WriteError(w, http.StatusBadRequest, "can't find 'uploadFile'")
     return
   }
@@ -119,7 +162,7 @@ func uploadPicture(w http.ResponseWriter, r *http.Request) {
   mime := handler.Header.Get("Content-Type")
   if !mimeRegex.MatchString(mime) {
     m := fmt.Sprintf("unsupported file, mime type was: %s", mime)
-    log.Error().Msg(m)
+    log.Ctx(r.Context()).Error().Msg(m)
     _, _ = helper.WriteError(w, http.StatusBadRequest, m)
     return
   }
@@ -129,27 +172,68 @@ func uploadPicture(w http.ResponseWriter, r *http.Request) {
   if !plainTextRegex.MatchString(title) ||
     !plainTextRegex.MatchString(text) {
     err := fmt.Errorf("only plain text allowed in title/text")
-    log.Warn().Err(err).Msg("editPictureContent")
+    log.Ctx(r.Context()).Warn().Err(err).Msg("editPictureContent")
     _, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
     return
   }
 
-  picture, err := savePicture(r, file, handler, title, text)
+  picture, err := s.savePicture(r, file, handler, title, text)
+  var dup *duplicateError
+  if errors.As(err, &dup) {
+    log.Ctx(r.Context()).Info().Str("existing", dup.existing.Id.String()).Msg("duplicate upload")
+    w.Header().Set("Location", fmt.Sprintf("/api/picture/%s", dup.existing.Id))
+    _, _ = helper.WriteJson(w, http.StatusConflict, models.Response{
+      Status: http.StatusConflict,
+      Error:  err.Error(),
+      Data:   fromPicture(*dup.existing),
+    })
+    return
+  }
   if err != nil {
-    log.Error().Err(err).Msg("savePicture")
+    log.Ctx(r.Context()).Error().Err(err).Msg("savePicture")
     _, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
     return
   }
+  setETag(w, picture.Version)
   _, _ = helper.WriteJson(w, http.StatusOK, fromPicture(*picture))
 }
 
-func savePicture(r *http.Request, file multipart.File, handler *multipart.FileHeader, title, text string) (*models.Picture, error) {
+func (s *Server) savePicture(r *http.Request, file multipart.File, handler *multipart.FileHeader, title, text string) (*models.Picture, error) {
 
+  s.metrics.uploadSize.Observe(float64(handler.Size))
+
+  start := time.Now()
+  meta := models.Metadata{Size: handler.Size, Orientation: 1}
+  if x, err := exif.Read(file); err == nil {
+    meta.Taken, meta.Orientation = x.Taken, x.Orientation
+    meta.CameraMake, meta.CameraModel = x.Make, x.Model
+  } else if err != exif.ErrNotFound {
+    // the picture is still usable, it may just be rotated
+    log.Ctx(r.Context()).Warn().Err(err).Str("file", handler.Filename).Msg("unable to read exif")
+  }
+  if _, err := file.Seek(0, io.SeekStart); err != nil {
+    return nil, err
+  }
+  s.metrics.observeImage(imageSourceUpload, "exif", start)
+
+  start = time.Now()
   img, format, err := image.Decode(file)
   if err != nil {
     return nil, err
   }
   _ = file.Close()
+  s.metrics.observeImage(imageSourceUpload, "decode", start)
+
+  // smartcrop and the crops work on the upright picture
+  start = time.Now()
+  img = exif.Orient(img, meta.Orientation)
+  s.metrics.observeImage(imageSourceUpload, "orient", start)
+  meta.Width, meta.Height, meta.Format = img.Bounds().Dx(), img.Bounds().Dy(), format
+
+  hash := imageHash(img)
+  if p, err := s.store.GetPictureByHash(hash); err == nil {
+    return nil, &duplicateError{existing: p}
+  }
 
   ext := "png"
   if jpegRegex.MatchString(format) {
@@ -159,46 +243,30 @@ func savePicture(r *http.Request, file multipart.File, handler *multipart.FileHe
   id := uuid.New()
   fileName := fmt.Sprintf("orig.%s", ext)
   thumbName := fmt.Sprintf("thumb.%s", ext)
-  dir := path.Join(pictureDir, id.String())
-  err = os.Mkdir(dir, 0770)
-  if err != nil {
-    return nil, err
-  }
-
-  f, err := os.OpenFile(path.Join(dir, fileName), os.O_WRONLY|os.O_CREATE, 0660)
-  if err != nil {
-    return nil, err
-  }
-  defer helper.Close(f, fileName)
-  t, err := os.OpenFile(path.Join(dir, thumbName), os.O_WRONLY|os.O_CREATE, 0660)
-  if err != nil {
-    return nil, err
-  }
-  defer helper.Close(t, thumbName)
 
-  thumb := resize.Thumbnail(helper.ThumbnailSize, helper.ThumbnailSize, img, resize.Lanczos3)
+  start = time.Now()
+  thumb := resize.Thumbnail(s.cfg.ThumbnailSize, s.cfg.ThumbnailSize, img, resize.Lanczos3)
+  rends, imgs := s.resizeRenditions(id, img, "."+ext, "")
+  s.metrics.observeImage(imageSourceUpload, "resize", start)
 
   w := float64(img.Bounds().Dx())
-  h := w / helper.TargetRatio
+  h := w / s.cfg.TargetRatio
 
   if int(h) > img.Bounds().Dy() {
     h = float64(img.Bounds().Dy())
-    w = h * helper.TargetRatio
+    w = h * s.cfg.TargetRatio
   }
 
   analyzer := smartcrop.NewAnalyzer(nfnt.NewDefaultResizer())
+  start = time.Now()
   topCrop, _ := analyzer.FindBestCrop(img, int(w), int(h))
+  s.metrics.observeImage(imageSourceUpload, "smartcrop", start)
 
-  var e1 error
-  var e2 error
-  if ext == "png" {
-    e1 = png.Encode(f, img)
-    e2 = png.Encode(t, thumb)
-  } else if ext == "jpg" {
-    o := &jpeg.Options{Quality: 100}
-    e1 = jpeg.Encode(f, img, o)
-    e2 = jpeg.Encode(t, thumb, o)
-  }
+  start = time.Now()
+  f, e1 := encodeImage(img, fileName)
+  t, e2 := encodeImage(thumb, thumbName)
+  files, e3 := encodeRenditions(rends, imgs)
+  s.metrics.observeImage(imageSourceUpload, "encode", start)
 
   if e1 != nil {
     return nil, e1
@@ -206,6 +274,22 @@ func savePicture(r *http.Request, file multipart.File, handler *multipart.FileHe
   if e2 != nil {
     return nil, e2
   }
+  if e3 != nil {
+    return nil, e3
+  }
+
+  prefix := mediaPrefix(kindPictures, id)
+  if err := s.putBlob(prefix+fileName, f); err != nil {
+    return nil, err
+  }
+  if err := s.putBlob(prefix+thumbName, t); err != nil {
+    _ = s.blobs.DeletePrefix(prefix)
+    return nil, err
+  }
+  if err := s.putFiles(prefix, files); err != nil {
+    _ = s.blobs.DeletePrefix(prefix)
+    return nil, err
+  }
 
   picture := &models.Picture{
     Id:               id,
@@ -215,39 +299,44 @@ func savePicture(r *http.Request, file multipart.File, handler *multipart.FileHe
     ThumbnailPath:    thumbName,
     OriginalUrl:      fmt.Sprintf("/pictures/%s/%s", id.String(), filepath.Base(fileName)),
     ThumbnailUrl:     fmt.Sprintf("/pictures/%s/%s", id.String(), filepath.Base(thumbName)),
+    Renditions:       rends,
     UploadedFilename: handler.Filename,
     Uploaded:         time.Now(),
+    Hash:             hash,
+    Metadata:         meta,
     Content: models.Content{
       Title: title,
       Text:  text,
     },
   }
 
-  //todo: get user
-  user := r.Context().Value("user")
-  if user == nil {
-    picture.Uploader = "anonymous"
-  }
+  picture.Uploader = uploaderName(r)
 
-  if err := insertNewPicture(picture); err != nil {
-    _ = os.RemoveAll(filepath.Dir(f.Name()))
+  if err := s.store.InsertPicture(picture); err != nil {
+    _ = s.blobs.DeletePrefix(prefix)
+    if err == store.ErrDuplicate {
+      // another upload of the same picture won the race
+      if p, e := s.store.GetPictureByHash(hash); e == nil {
+        return nil, &duplicateError{existing: p}
+      }
+    }
     return nil, err
   }
   return picture, nil
 }
 
-func uploadInstagram(w http.ResponseWriter, r *http.Request) {
+func (s *Server) uploadInstagram(w http.ResponseWriter, r *http.Request) {
 
   err := r.ParseMultipartForm(32 << 18)
   if err != nil {
-    log.Error().Err(err).Msg("parse multipartForm failed")
+    log.Ctx(r.Context()).Error().Err(err).Msg("parse multipartForm failed")
     _, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
     return
   }
 
   url := r.FormValue("url")
   if url == "" {
-    log.Error().Msg("missing url")
+    log.Ctx(r.Context()).Error().Msg("missing url")
     _, _ = helper.WriteError(w, http.StatusBadRequest, "missing url")
     return
   }
@@ -259,24 +348,25 @@ func uploadInstagram(w http.ResponseWriter, r *http.Request) {
     }
   }
 
-  post, err := saveInstagram(r, url)
+  post, err := s.saveInstagram(r, url)
   if err != nil {
-    log.Error().Err(err).Msg("error saving post")
-    s := http.StatusInternalServerError
+    log.Ctx(r.Context()).Error().Err(err).Msg("error saving post")
+    status := http.StatusInternalServerError
     if err == errInvalidPost {
-      s = http.StatusBadRequest
+      status = http.StatusBadRequest
     }
-    _, _ = helper.WriteError(w, s, err.Error())
+    _, _ = helper.WriteError(w, status, err.Error())
     return
   }
 
+  setETag(w, post.Version)
   _, _ = helper.WriteJson(w, http.StatusOK, fromInsta(*post))
 }
 
-func saveInstagram(r *http.Request, url string) (*models.Instagram, error) {
+func (s *Server) saveInstagram(r *http.Request, url string) (*models.Instagram, error) {
 
   uri_post := fmt.Sprintf(o_embedPost, url)
-  log.Info().Str("uri", uri_post).Msg("saveInstagram")
+  log.Ctx(r.Context()).Info().Str("uri", uri_post).Msg("saveInstagram")
 
   c := http.DefaultClient
 
@@ -284,17 +374,23 @@ func saveInstagram(r *http.Request, url string) (*models.Instagram, error) {
   if err != nil {
     return nil, err
   }
-  req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", instaToken))
+  req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.cfg.InstagramToken))
 
   r1, err := c.Do(req)
   if err != nil {
+    s.metrics.oembedRequests.Inc(oembedRequestError)
     return nil, err
   }
   defer helper.CloseRC(r1.Body, "r1")
+  if r1.StatusCode != http.StatusOK {
+    s.metrics.oembedRequests.Inc(oembedBadStatus)
+    return nil, fmt.Errorf("oembed request failed: %s", r1.Status)
+  }
 
   d1 := models.InstaData{}
   err = json.NewDecoder(r1.Body).Decode(&d1)
   if err != nil {
+    s.metrics.oembedRequests.Inc(oembedDecodeError)
     return nil, err
   }
 
@@ -304,36 +400,28 @@ func saveInstagram(r *http.Request, url string) (*models.Instagram, error) {
 
   r2, err := c.Get(d1.ThumbnailUrl)
   if err != nil {
+    s.metrics.oembedRequests.Inc(oembedThumbnailError)
     return nil, err
   }
   defer r2.Body.Close()
   thumb, format, err := image.Decode(r2.Body)
   if err != nil {
+    s.metrics.oembedRequests.Inc(oembedThumbnailError)
     return nil, err
   }
+  s.metrics.oembedRequests.Inc(oembedOk)
   ext := "png"
   if jpegRegex.MatchString(format) {
     ext = "jpg"
   }
   id := uuid.New()
   thumbName := fmt.Sprintf("thumb.%s", ext)
-  dir := path.Join(instaPostDir, id.String())
-  err = os.Mkdir(dir, 0770)
+  t, err := encodeImage(thumb, thumbName)
   if err != nil {
     return nil, err
   }
-  t, err := os.OpenFile(path.Join(dir, thumbName), os.O_WRONLY|os.O_CREATE, 0660)
-  if err != nil {
-    return nil, err
-  }
-  defer helper.Close(t, thumbName)
-  if ext == "png" {
-    err = png.Encode(t, thumb)
-  } else if ext == "jpg" {
-    o := &jpeg.Options{Quality: 100}
-    err = jpeg.Encode(t, thumb, o)
-  }
-  if err != nil {
+  prefix := mediaPrefix(kindInstagram, id)
+  if err := s.putBlob(prefix+thumbName, t); err != nil {
     return nil, err
   }
 
@@ -349,14 +437,10 @@ func saveInstagram(r *http.Request, url string) (*models.Instagram, error) {
     Data:            d1,
   }
 
-  //todo: get user
-  user := r.Context().Value("user")
-  if user == nil {
-    post.Uploader = "anonymous"
-  }
+  post.Uploader = uploaderName(r)
 
-  if err := insertNewInstagram(post); err != nil {
-    _ = os.RemoveAll(filepath.Dir(t.Name()))
+  if err := s.store.InsertInstagram(post); err != nil {
+    _ = s.blobs.DeletePrefix(prefix)
     return nil, err
   }
 
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"goji.io/pat"
+	"net/http"
+	"sort"
+)
+
+type createUserBody struct {
+	Name     string      `json:"name"`
+	Password string      `json:"password"`
+	Role     models.Role `json:"role"`
+}
+
+type updateUserBody struct {
+	Password string      `json:"password"`
+	Role     models.Role `json:"role"`
+}
+
+func (s *Server) getUsers(w http.ResponseWriter, _ *http.Request) {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Created.Before(users[j].Created)
+	})
+
+	list := make([]userResponse, len(users))
+	for i, u := range users {
+		list[i] = fromUser(u)
+	}
+
+	_, _ = helper.WriteJson(w, http.StatusOK, list)
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var body createUserBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("name", body.Name).Str("role", string(body.Role)).Msg("createUser")
+
+	if _, err := s.store.GetUserByName(body.Name); err == nil {
+		_, _ = helper.WriteError(w, http.StatusConflict, fmt.Sprintf("user already exists: %s", body.Name))
+		return
+	}
+
+	u, err := newUser(body.Name, body.Password, body.Role)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = s.store.InsertUser(u)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, _ = helper.WriteJson(w, http.StatusOK, fromUser(*u))
+}
+
+func (s *Server) updateUserAccount(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+
+	var body updateUserBody
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Str("role", string(body.Role)).Msg("updateUserAccount")
+
+	u, err := s.store.GetUser(id)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if body.Role != "" {
+		if !body.Role.Valid() {
+			_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid role: %s", body.Role))
+			return
+		}
+		if u.Id == userFromContext(r.Context()).Id && body.Role != models.RoleAdmin {
+			_, _ = helper.WriteError(w, http.StatusBadRequest, "can't revoke own admin role")
+			return
+		}
+		u.Role = body.Role
+	}
+
+	if body.Password != "" {
+		hash, err := hashPassword(body.Password)
+		if err != nil {
+			_, _ = helper.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		u.PasswordHash = hash
+		err = s.store.DeleteUserSessions(u.Id)
+		if err != nil {
+			log.Ctx(r.Context()).Error().Err(err).Msg("updateUserAccount: delete sessions")
+		}
+	}
+
+	err = s.store.UpdateUser(u)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, _ = helper.WriteJson(w, http.StatusOK, fromUser(*u))
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(pat.Param(r, "id"))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msgf("unable to parse id: %s", id)
+		_, _ = helper.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid id: %s", id))
+		return
+	}
+	log.Ctx(r.Context()).Info().Str("id", id.String()).Msg("deleteUser")
+
+	if id == userFromContext(r.Context()).Id {
+		_, _ = helper.WriteError(w, http.StatusBadRequest, "can't delete own account")
+		return
+	}
+
+	u, err := s.store.GetUser(id)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	err = s.store.DeleteUserSessions(u.Id)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = s.store.DeleteUser(u.Id)
+	if err != nil {
+		_, _ = helper.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
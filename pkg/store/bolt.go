@@ -0,0 +1,321 @@
+package store
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	bucketPics     = []byte("pictures")
+	bucketInsta    = []byte("instagram")
+	bucketUsers    = []byte("users")
+	bucketSessions = []byte("sessions")
+	bucketApiKeys  = []byte("apikeys")
+)
+
+// Bolt stores every entity as a versioned JSON record in its own bolt bucket.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens or creates the bolt database in file and migrates its
+// records to SchemaVersion.
+func OpenBolt(file string) (*Bolt, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &Bolt{db: db}
+	if err := s.migrate(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return s, nil
+}
+
+// Stats returns the statistics of the underlying database.
+func (s *Bolt) Stats() bolt.Stats {
+	return s.db.Stats()
+}
+
+// Backup implements Backuper with a read transaction, writers are not blocked
+// while the snapshot is written.
+func (s *Bolt) Backup(f func(size int64, snapshot io.WriterTo) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return f(tx.Size(), tx)
+	})
+}
+
+func (s *Bolt) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
+
+// put stores v as JSON under key, the bucket is created if necessary.
+func (s *Bolt) put(bucket, key []byte, v interface{}) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return fmt.Errorf("create bucket %s", err)
+		}
+		buf, err := encodeRecord(v)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, buf)
+	})
+}
+
+// get decodes the record stored under key into v.
+func (s *Bolt) get(bucket, key []byte, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return fmt.Errorf("can't open bucket")
+		}
+		raw := b.Get(key)
+		if raw == nil {
+			return ErrNotFound
+		}
+		return decodeRecord(raw, v)
+	})
+}
+
+// forEach calls f with every record of the bucket, a missing bucket is
+// treated as empty.
+func (s *Bolt) forEach(bucket []byte, f func(k, v []byte)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			f(k, v)
+			return nil
+		})
+	})
+}
+
+func (s *Bolt) delete(bucket, key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete(key)
+	})
+}
+
+func (s *Bolt) InsertPicture(p *models.Picture) error {
+	return s.putPicture(p, false)
+}
+
+func (s *Bolt) UpdatePicture(p *models.Picture) error {
+	return s.putPicture(p, true)
+}
+
+func (s *Bolt) GetPicture(id uuid.UUID) (*models.Picture, error) {
+	p := &models.Picture{}
+	if err := s.get(bucketPics, helper.UUIDtoBytes(id), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *Bolt) GetPictures() ([]models.Picture, error) {
+	list := make([]models.Picture, 0)
+	err := s.forEach(bucketPics, func(k, v []byte) {
+		var p = models.Picture{}
+		if err := decodeRecord(v, &p); err != nil {
+			warnUndecodable(bucketPics, k, err)
+			return
+		}
+		list = append(list, p)
+	})
+	return list, err
+}
+
+func (s *Bolt) DeletePicture(id uuid.UUID) error {
+	return s.deletePicture(helper.UUIDtoBytes(id))
+}
+
+func (s *Bolt) InsertInstagram(i *models.Instagram) error {
+	return s.putInstagram(i, false)
+}
+
+func (s *Bolt) UpdateInstagram(i *models.Instagram) error {
+	return s.putInstagram(i, true)
+}
+
+func (s *Bolt) GetInstagram(id uuid.UUID) (*models.Instagram, error) {
+	i := &models.Instagram{}
+	if err := s.get(bucketInsta, helper.UUIDtoBytes(id), i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (s *Bolt) GetInstagrams() ([]models.Instagram, error) {
+	list := make([]models.Instagram, 0)
+	err := s.forEach(bucketInsta, func(k, v []byte) {
+		var i = models.Instagram{}
+		if err := decodeRecord(v, &i); err != nil {
+			warnUndecodable(bucketInsta, k, err)
+			return
+		}
+		list = append(list, i)
+	})
+	return list, err
+}
+
+func (s *Bolt) DeleteInstagram(id uuid.UUID) error {
+	return s.deletePost(bucketInsta, bucketInstaUploaded, helper.UUIDtoBytes(id))
+}
+
+func (s *Bolt) InsertUser(u *models.User) error {
+	return s.put(bucketUsers, helper.UUIDtoBytes(u.Id), u)
+}
+
+func (s *Bolt) UpdateUser(u *models.User) error {
+	return s.put(bucketUsers, helper.UUIDtoBytes(u.Id), u)
+}
+
+func (s *Bolt) GetUser(id uuid.UUID) (*models.User, error) {
+	u := &models.User{}
+	if err := s.get(bucketUsers, helper.UUIDtoBytes(id), u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Bolt) GetUserByName(name string) (*models.User, error) {
+	var user *models.User
+	err := s.forEach(bucketUsers, func(k, v []byte) {
+		var u = models.User{}
+		if err := decodeRecord(v, &u); err != nil {
+			warnUndecodable(bucketUsers, k, err)
+			return
+		}
+		if strings.EqualFold(u.Name, name) {
+			user = &u
+		}
+	})
+	if err == nil && user == nil {
+		err = ErrNotFound
+	}
+	return user, err
+}
+
+func (s *Bolt) GetUsers() ([]models.User, error) {
+	list := make([]models.User, 0)
+	err := s.forEach(bucketUsers, func(k, v []byte) {
+		var u = models.User{}
+		if err := decodeRecord(v, &u); err != nil {
+			warnUndecodable(bucketUsers, k, err)
+			return
+		}
+		list = append(list, u)
+	})
+	return list, err
+}
+
+func (s *Bolt) DeleteUser(id uuid.UUID) error {
+	return s.delete(bucketUsers, helper.UUIDtoBytes(id))
+}
+
+func (s *Bolt) InsertSession(sess *models.Session) error {
+	return s.put(bucketSessions, []byte(sess.Token), sess)
+}
+
+func (s *Bolt) GetSession(token string) (*models.Session, error) {
+	x := &models.Session{}
+	if err := s.get(bucketSessions, []byte(token), x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (s *Bolt) DeleteSession(token string) error {
+	return s.delete(bucketSessions, []byte(token))
+}
+
+func (s *Bolt) DeleteExpiredSessions(t time.Time) error {
+	return s.deleteSessionsWhere(func(x models.Session) bool {
+		return x.Expires.Before(t)
+	})
+}
+
+func (s *Bolt) DeleteUserSessions(id uuid.UUID) error {
+	return s.deleteSessionsWhere(func(x models.Session) bool {
+		return x.UserId == id
+	})
+}
+
+// deleteSessionsWhere removes all sessions for which match returns true,
+// sessions that can't be decoded are removed as well.
+func (s *Bolt) deleteSessionsWhere(match func(x models.Session) bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSessions)
+		if b == nil {
+			return nil
+		}
+
+		keys := make([][]byte, 0)
+		err := b.ForEach(func(k, v []byte) error {
+			var x = models.Session{}
+			if err := decodeRecord(v, &x); err != nil || match(x) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Bolt) InsertApiKey(k *models.ApiKey) error {
+	return s.put(bucketApiKeys, helper.UUIDtoBytes(k.Id), k)
+}
+
+func (s *Bolt) UpdateApiKey(k *models.ApiKey) error {
+	return s.put(bucketApiKeys, helper.UUIDtoBytes(k.Id), k)
+}
+
+func (s *Bolt) GetApiKey(id uuid.UUID) (*models.ApiKey, error) {
+	k := &models.ApiKey{}
+	if err := s.get(bucketApiKeys, helper.UUIDtoBytes(id), k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (s *Bolt) GetApiKeys() ([]models.ApiKey, error) {
+	list := make([]models.ApiKey, 0)
+	err := s.forEach(bucketApiKeys, func(k, v []byte) {
+		var a = models.ApiKey{}
+		if err := decodeRecord(v, &a); err != nil {
+			warnUndecodable(bucketApiKeys, k, err)
+			return
+		}
+		list = append(list, a)
+	})
+	return list, err
+}
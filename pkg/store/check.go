@@ -0,0 +1,137 @@
+package store
+
+import (
+	"encoding/hex"
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/models"
+)
+
+// RecordError describes a stored record that can't be used.
+type RecordError struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Error  string `json:"error"`
+	// Index is set for problems of a secondary index.
+	Index bool `json:"index,omitempty"`
+}
+
+// newModel returns a new value of the type stored in a bucket.
+var newModel = map[string]func() interface{}{
+	string(bucketPics):      func() interface{} { return &models.Picture{} },
+	string(bucketInsta):     func() interface{} { return &models.Instagram{} },
+	string(bucketUsers):     func() interface{} { return &models.User{} },
+	string(bucketSessions):  func() interface{} { return &models.Session{} },
+	string(bucketApiKeys):   func() interface{} { return &models.ApiKey{} },
+	string(bucketRevisions): func() interface{} { return &models.Revision{} },
+}
+
+// keyString formats a key for humans, ids as uuid and other binary keys as
+// hex.
+func keyString(k []byte) string {
+	if len(k) == 16 {
+		if id, err := uuid.FromBytes(k); err == nil {
+			return id.String()
+		}
+	}
+	for _, c := range k {
+		if c < 0x20 || c > 0x7e {
+			return hex.EncodeToString(k)
+		}
+	}
+	return string(k)
+}
+
+// CheckRecords reports every record that can't be decoded and every entry
+// missing from or dangling in the upload and hash indexes.
+func (s *Bolt) CheckRecords() ([]RecordError, error) {
+	errs := make([]RecordError, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range dataBuckets {
+			b := tx.Bucket(name)
+			if b == nil {
+				continue
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				if err := decodeRecord(v, newModel[string(name)]()); err != nil {
+					errs = append(errs, RecordError{Bucket: string(name), Key: keyString(k), Error: err.Error()})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, x := range []struct{ bucket, index []byte }{
+			{bucketPics, bucketPicsUploaded},
+			{bucketInsta, bucketInstaUploaded},
+		} {
+			expected := make(map[string]bool)
+			if b := tx.Bucket(x.bucket); b != nil {
+				err := b.ForEach(func(k, v []byte) error {
+					var u uploadedRecord
+					id, err := uuid.FromBytes(k)
+					if err == nil && decodeRecord(v, &u) == nil {
+						expected[string(uploadKey(u.Uploaded, id))] = true
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			if idx := tx.Bucket(x.index); idx != nil {
+				err := idx.ForEach(func(k, _ []byte) error {
+					if !expected[string(k)] {
+						errs = append(errs, RecordError{Bucket: string(x.index), Key: keyString(k),
+							Error: "index entry without record", Index: true})
+					}
+					delete(expected, string(k))
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			for k := range expected {
+				errs = append(errs, RecordError{Bucket: string(x.index), Key: keyString([]byte(k)),
+					Error: "record missing in index", Index: true})
+			}
+		}
+
+		hashErrs, err := checkHashIndex(tx)
+		errs = append(errs, hashErrs...)
+		return err
+	})
+	return errs, err
+}
+
+// RepairIndexes rebuilds the upload and hash indexes from the records.
+func (s *Bolt) RepairIndexes() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := rebuildUploadIndexes(tx); err != nil {
+			return err
+		}
+		return rebuildHashIndex(tx)
+	})
+}
+
+// CheckRecords reports every record that can't be decoded.
+func (s *Memory) CheckRecords() ([]RecordError, error) {
+	errs := make([]RecordError, 0)
+	for _, name := range dataBuckets {
+		s.forEach(name, func(k, v []byte) {
+			if err := decodeRecord(v, newModel[string(name)]()); err != nil {
+				errs = append(errs, RecordError{Bucket: string(name), Key: string(k), Error: err.Error()})
+			}
+		})
+	}
+	return errs, nil
+}
+
+// RepairIndexes does nothing, Memory has no indexes.
+func (s *Memory) RepairIndexes() error {
+	return nil
+}
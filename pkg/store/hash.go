@@ -0,0 +1,251 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"sort"
+	"time"
+)
+
+// bucketPicsHash maps the content hash of a picture to its id. Pictures in
+// the trash aren't indexed, they don't block uploads of the same content and
+// can only be restored while no other picture has it.
+var bucketPicsHash = []byte("pictures_hash")
+
+// hashRecord decodes the fields of a picture needed for the hash index.
+type hashRecord struct {
+	Hash      string    `json:"hash"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// indexed reports whether the picture belongs into the hash index.
+func (h hashRecord) indexed() bool {
+	return h.Hash != "" && h.DeletedAt.IsZero()
+}
+
+// putPicture stores p like putInstagram and maintains the hash index, it
+// fails with ErrDuplicate if another picture that isn't trashed has the same
+// hash.
+func (s *Bolt) putPicture(p *models.Picture, update bool) error {
+	prev := p.Version
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putPictureTx(tx, p, update)
+	})
+	if err != nil {
+		p.Version = prev
+	}
+	return err
+}
+
+// putPictureTx is putPicture within tx, it sets the version of p also if tx
+// fails.
+func putPictureTx(tx *bolt.Tx, p *models.Picture, update bool) error {
+	key := helper.UUIDtoBytes(p.Id)
+	hb, err := tx.CreateBucketIfNotExists(bucketPicsHash)
+	if err != nil {
+		return fmt.Errorf("create bucket %s", err)
+	}
+	if p.Version, err = nextVersion(tx.Bucket(bucketPics), key, p.Version, update); err != nil {
+		return err
+	}
+	h := hashRecord{Hash: p.Hash, DeletedAt: p.DeletedAt}
+	if h.indexed() {
+		if owner := hb.Get([]byte(p.Hash)); owner != nil && !bytes.Equal(owner, key) {
+			return ErrDuplicate
+		}
+	}
+	if err := unhash(tx.Bucket(bucketPics), hb, key); err != nil {
+		return err
+	}
+	if err := putPostTx(tx, bucketPics, bucketPicsUploaded, key, uploadKey(p.Uploaded, p.Id), p); err != nil {
+		return err
+	}
+	if !h.indexed() {
+		return nil
+	}
+	return hb.Put([]byte(p.Hash), key)
+}
+
+// deletePicture removes a picture with its index entries.
+func (s *Bolt) deletePicture(key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if hb := tx.Bucket(bucketPicsHash); hb != nil {
+			if err := unhash(tx.Bucket(bucketPics), hb, key); err != nil {
+				return err
+			}
+		}
+		return deletePostTx(tx, bucketPics, bucketPicsUploaded, key)
+	})
+}
+
+// unhash removes the hash index entry of the currently stored picture with
+// key, entries owned by another picture are kept.
+func unhash(b, hb *bolt.Bucket, key []byte) error {
+	if b == nil {
+		return nil
+	}
+	raw := b.Get(key)
+	if raw == nil {
+		return nil
+	}
+	var h hashRecord
+	if err := decodeRecord(raw, &h); err != nil || h.Hash == "" {
+		return nil
+	}
+	if !bytes.Equal(hb.Get([]byte(h.Hash)), key) {
+		return nil
+	}
+	return hb.Delete([]byte(h.Hash))
+}
+
+// GetPictureByHash returns the picture with the content hash that isn't
+// trashed or ErrNotFound.
+func (s *Bolt) GetPictureByHash(hash string) (*models.Picture, error) {
+	p := &models.Picture{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket(bucketPicsHash)
+		if hb == nil || hash == "" {
+			return ErrNotFound
+		}
+		key := hb.Get([]byte(hash))
+		b := tx.Bucket(bucketPics)
+		if key == nil || b == nil {
+			return ErrNotFound
+		}
+		raw := b.Get(key)
+		if raw == nil {
+			return ErrNotFound
+		}
+		return decodeRecord(raw, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// hashIndex returns the hash index the pictures in b should have, the first
+// picture in key order owns a hash.
+func hashIndex(b *bolt.Bucket) (map[string][]byte, error) {
+	want := make(map[string][]byte)
+	if b == nil {
+		return want, nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		var h hashRecord
+		if _, err := uuid.FromBytes(k); err != nil || decodeRecord(v, &h) != nil || !h.indexed() {
+			return nil
+		}
+		if _, ok := want[h.Hash]; !ok {
+			want[h.Hash] = append([]byte(nil), k...)
+		}
+		return nil
+	})
+	return want, err
+}
+
+// rebuildHashIndex recreates the hash index from the pictures.
+func rebuildHashIndex(tx *bolt.Tx) error {
+	if tx.Bucket(bucketPicsHash) != nil {
+		if err := tx.DeleteBucket(bucketPicsHash); err != nil {
+			return err
+		}
+	}
+	hb, err := tx.CreateBucket(bucketPicsHash)
+	if err != nil {
+		return fmt.Errorf("create bucket %s", err)
+	}
+	want, err := hashIndex(tx.Bucket(bucketPics))
+	if err != nil {
+		return err
+	}
+	for h, k := range want {
+		if err := hb.Put([]byte(h), k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHashIndex reports entries of the hash index that don't match the
+// pictures.
+func checkHashIndex(tx *bolt.Tx) ([]RecordError, error) {
+	errs := make([]RecordError, 0)
+	want, err := hashIndex(tx.Bucket(bucketPics))
+	if err != nil {
+		return nil, err
+	}
+	if hb := tx.Bucket(bucketPicsHash); hb != nil {
+		err := hb.ForEach(func(k, v []byte) error {
+			if w, ok := want[string(k)]; !ok || !bytes.Equal(w, v) {
+				errs = append(errs, RecordError{Bucket: string(bucketPicsHash), Key: string(k),
+					Error: "hash entry without matching picture", Index: true})
+			}
+			delete(want, string(k))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for h := range want {
+		errs = append(errs, RecordError{Bucket: string(bucketPicsHash), Key: h,
+			Error: "picture missing in hash index", Index: true})
+	}
+	return errs, nil
+}
+
+// GetPictureByHash returns the picture with the content hash that isn't
+// trashed or ErrNotFound.
+func (s *Memory) GetPictureByHash(hash string) (*models.Picture, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pictureByHash(hash)
+}
+
+// pictureByHash is GetPictureByHash for callers that hold mu.
+func (s *Memory) pictureByHash(hash string) (*models.Picture, error) {
+	if hash == "" {
+		return nil, ErrNotFound
+	}
+	b := s.buckets[string(bucketPics)]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	// the first picture in key order owns a hash, like in Bolt
+	sort.Strings(keys)
+	for _, k := range keys {
+		var h hashRecord
+		if err := decodeRecord(b[k], &h); err != nil || !h.indexed() || h.Hash != hash {
+			continue
+		}
+		p := &models.Picture{}
+		if err := decodeRecord(b[k], p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return nil, ErrNotFound
+}
+
+// putPicture stores p, it fails with ErrDuplicate if another picture that
+// isn't trashed has the same hash. The check and the write happen under one lock, so of two
+// concurrent uploads of the same content only one is stored.
+func (s *Memory) putPicture(p *models.Picture, update bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putPictureLocked(p, update)
+}
+
+// putPictureLocked is putPicture for callers that hold mu.
+func (s *Memory) putPictureLocked(p *models.Picture, update bool) error {
+	if o, err := s.pictureByHash(p.Hash); err == nil && o.Id != p.Id && p.DeletedAt.IsZero() {
+		return ErrDuplicate
+	}
+	return s.putVersionedLocked(bucketPics, p.Id.String(), p, &p.Version, update)
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"time"
+)
+
+// Index buckets map the upload key of a post to an empty value.
+var (
+	bucketPicsUploaded  = []byte("pictures_uploaded")
+	bucketInstaUploaded = []byte("instagram_uploaded")
+)
+
+// uploadedRecord decodes the fields of a post needed for the index.
+type uploadedRecord struct {
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// putPostTx stores the post v and moves its index entry if the upload time
+// changed.
+func putPostTx(tx *bolt.Tx, bucket, index, key, idxKey []byte, v interface{}) error {
+	b, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return fmt.Errorf("create bucket %s", err)
+	}
+	idx, err := tx.CreateBucketIfNotExists(index)
+	if err != nil {
+		return fmt.Errorf("create bucket %s", err)
+	}
+	if err := unindex(b, idx, key); err != nil {
+		return err
+	}
+
+	buf, err := encodeRecord(v)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(key, buf); err != nil {
+		return err
+	}
+	return idx.Put(idxKey, []byte{})
+}
+
+// deletePost removes a post together with its index entry.
+func (s *Bolt) deletePost(bucket, index, key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deletePostTx(tx, bucket, index, key)
+	})
+}
+
+func deletePostTx(tx *bolt.Tx, bucket, index, key []byte) error {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil
+	}
+	if idx := tx.Bucket(index); idx != nil {
+		if err := unindex(b, idx, key); err != nil {
+			return err
+		}
+	}
+	return b.Delete(key)
+}
+
+// unindex removes the index entry of the currently stored post with key.
+func unindex(b, idx *bolt.Bucket, key []byte) error {
+	raw := b.Get(key)
+	if raw == nil {
+		return nil
+	}
+	var u uploadedRecord
+	if err := decodeRecord(raw, &u); err != nil {
+		// without upload time the entry can't be found, a rebuild of
+		// the index drops it
+		return nil
+	}
+	id, err := uuid.FromBytes(key)
+	if err != nil {
+		return nil
+	}
+	return idx.Delete(uploadKey(u.Uploaded, id))
+}
+
+// rebuildUploadIndexes recreates the upload time indexes from the records,
+// undecodable records are not indexed.
+func rebuildUploadIndexes(tx *bolt.Tx) error {
+	for _, x := range []struct{ bucket, index []byte }{
+		{bucketPics, bucketPicsUploaded},
+		{bucketInsta, bucketInstaUploaded},
+	} {
+		if tx.Bucket(x.index) != nil {
+			if err := tx.DeleteBucket(x.index); err != nil {
+				return err
+			}
+		}
+		idx, err := tx.CreateBucket(x.index)
+		if err != nil {
+			return fmt.Errorf("create bucket %s", err)
+		}
+		b := tx.Bucket(x.bucket)
+		if b == nil {
+			continue
+		}
+		err = b.ForEach(func(k, v []byte) error {
+			var u uploadedRecord
+			if err := decodeRecord(v, &u); err != nil {
+				warnUndecodable(x.bucket, k, err)
+				return nil
+			}
+			id, err := uuid.FromBytes(k)
+			if err != nil {
+				warnUndecodable(x.bucket, k, err)
+				return nil
+			}
+			return idx.Put(uploadKey(u.Uploaded, id), []byte{})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexIter walks an upload index in the order of a listing.
+type indexIter struct {
+	c         *bolt.Cursor
+	typ       int
+	k         []byte
+	asc       bool
+	low, high []byte
+}
+
+func newIndexIter(b *bolt.Bucket, typ int, o ListOptions, start, low, high []byte) *indexIter {
+	it := &indexIter{c: b.Cursor(), typ: typ, asc: o.Ascending, low: low, high: high}
+
+	var k []byte
+	if it.asc {
+		from, exclusive := low, false
+		if start != nil && bytes.Compare(start, low) >= 0 {
+			from, exclusive = start, true
+		}
+		k, _ = it.c.Seek(from)
+		if exclusive && bytes.Equal(k, from) {
+			k, _ = it.c.Next()
+		}
+	} else {
+		from, exclusive := high, false
+		if start != nil && bytes.Compare(start, high) <= 0 {
+			from, exclusive = start, true
+		}
+		k, _ = it.c.Seek(from)
+		if k == nil {
+			k, _ = it.c.Last()
+		} else if c := bytes.Compare(k, from); c > 0 || (exclusive && c == 0) {
+			k, _ = it.c.Prev()
+		}
+	}
+	it.set(k)
+	return it
+}
+
+func (it *indexIter) set(k []byte) {
+	if k == nil || !inRange(k, it.low, it.high) {
+		it.k = nil
+		return
+	}
+	it.k = k
+}
+
+func (it *indexIter) next() {
+	var k []byte
+	if it.asc {
+		k, _ = it.c.Next()
+	} else {
+		k, _ = it.c.Prev()
+	}
+	it.set(k)
+}
+
+// ListPosts returns a page of posts and the cursor of the next page, which
+// is empty on the last page. Filters are applied while walking the upload
+// index, posts they drop are only decoded as far as the filters need, so a
+// page of a rare match may still walk a large part of the index.
+func (s *Bolt) ListPosts(o ListOptions) ([]Post, string, error) {
+	start, low, high, err := o.bounds()
+	if err != nil {
+		return nil, "", err
+	}
+
+	list := make([]Post, 0)
+	next := ""
+	err = s.db.View(func(tx *bolt.Tx) error {
+		its := make([]*indexIter, 0, 2)
+		for _, x := range []struct {
+			typ   int
+			index []byte
+		}{
+			{TypePicture, bucketPicsUploaded},
+			{TypeInstagram, bucketInstaUploaded},
+		} {
+			if idx := tx.Bucket(x.index); idx != nil && o.includes(x.typ) {
+				its = append(its, newIndexIter(idx, x.typ, o, start, low, high))
+			}
+		}
+
+		var last []byte
+		for {
+			var it *indexIter
+			for _, x := range its {
+				if x.k != nil && (it == nil || o.before(x.k, it.k)) {
+					it = x
+				}
+			}
+			if it == nil {
+				return nil
+			}
+			if o.Limit > 0 && len(list) == o.Limit {
+				next = encodeCursor(last)
+				return nil
+			}
+
+			last = append(last[:0], it.k...)
+			if p, ok := getPost(tx, it.typ, it.k, o); ok {
+				list = append(list, p)
+			}
+			it.next()
+		}
+	})
+	return list, next, err
+}
+
+// getPost decodes the post an index key refers to if it matches the filters
+// of o. The fields the filters need are decoded first, so posts that are
+// filtered out are never decoded completely.
+func getPost(tx *bolt.Tx, typ int, k []byte, o ListOptions) (Post, bool) {
+	bucket := bucketPics
+	if typ == TypeInstagram {
+		bucket = bucketInsta
+	}
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return Post{}, false
+	}
+	id := keyId(k)
+	raw := b.Get(id[:])
+	if raw == nil {
+		return Post{}, false
+	}
+
+	var f filterRecord
+	if err := decodeRecord(raw, &f); err != nil {
+		warnUndecodable(bucket, id[:], err)
+		return Post{}, false
+	}
+	if !o.matchesRecord(f) {
+		return Post{}, false
+	}
+
+	var p Post
+	var err error
+	if typ == TypePicture {
+		p.Picture = &models.Picture{}
+		err = decodeRecord(raw, p.Picture)
+	} else {
+		p.Instagram = &models.Instagram{}
+		err = decodeRecord(raw, p.Instagram)
+	}
+	if err != nil {
+		warnUndecodable(bucket, id[:], err)
+		return Post{}, false
+	}
+	return p, true
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"strings"
+	"time"
+)
+
+// Post types, the same values are used for the type of a post in responses.
+const (
+	TypePicture   = 1
+	TypeInstagram = 2
+)
+
+// uploadKeyLength is the length of the keys of the upload time indexes, 8
+// bytes time followed by 16 bytes id.
+const uploadKeyLength = 24
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Post is either a picture or an Instagram post.
+type Post struct {
+	Picture   *models.Picture
+	Instagram *models.Instagram
+}
+
+func (p Post) Type() int {
+	if p.Picture != nil {
+		return TypePicture
+	}
+	return TypeInstagram
+}
+
+// version returns the version field of the post.
+func (p Post) version() *int {
+	if p.Picture != nil {
+		return &p.Picture.Version
+	}
+	return &p.Instagram.Version
+}
+
+func (p Post) Uploaded() time.Time {
+	if p.Picture != nil {
+		return p.Picture.Uploaded
+	}
+	return p.Instagram.Uploaded
+}
+
+func (p Post) key() []byte {
+	if p.Picture != nil {
+		return uploadKey(p.Picture.Uploaded, p.Picture.Id)
+	}
+	return uploadKey(p.Instagram.Uploaded, p.Instagram.Id)
+}
+
+// ListOptions selects a page of posts ordered by upload time.
+type ListOptions struct {
+	// Limit is the maximum number of posts returned, 0 means no limit.
+	Limit int
+	// Cursor continues a listing after the last post of a previous page.
+	Cursor string
+	// Ascending lists the oldest posts first instead of the newest.
+	Ascending bool
+	// Type restricts the listing to TypePicture or TypeInstagram, 0 lists both.
+	Type int
+	// Disabled, if not nil, only lists posts with the given state.
+	Disabled *bool
+	// Trashed lists only the posts in the trash instead of only the posts
+	// that aren't.
+	Trashed bool
+	// Uploader only lists posts of this uploader, ignoring case.
+	Uploader string
+	// From and To limit the upload time, both are inclusive and ignored if
+	// zero.
+	From time.Time
+	To   time.Time
+}
+
+// uploadKey returns the index key of a post uploaded at t. The sign bit of the
+// time is flipped so keys of times before 1970 still sort first.
+func uploadKey(t time.Time, id uuid.UUID) []byte {
+	k := make([]byte, uploadKeyLength)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano())^(1<<63))
+	copy(k[8:], id[:])
+	return k
+}
+
+func keyId(k []byte) uuid.UUID {
+	var id uuid.UUID
+	copy(id[:], k[8:])
+	return id
+}
+
+func encodeCursor(k []byte) string {
+	return base64.RawURLEncoding.EncodeToString(k)
+}
+
+func decodeCursor(c string) ([]byte, error) {
+	k, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil || len(k) != uploadKeyLength {
+		return nil, ErrInvalidCursor
+	}
+	return k, nil
+}
+
+func (o ListOptions) includes(typ int) bool {
+	return o.Type == 0 || o.Type == typ
+}
+
+// bounds returns the exclusive key to start after, nil to start at the first
+// key, and the inclusive lowest and highest key of the listing.
+func (o ListOptions) bounds() (start, low, high []byte, err error) {
+	low = make([]byte, uploadKeyLength)
+	high = bytes.Repeat([]byte{0xff}, uploadKeyLength)
+	if !o.From.IsZero() {
+		low = uploadKey(o.From, uuid.Nil)
+	}
+	if !o.To.IsZero() {
+		high = uploadKey(o.To, uuid.UUID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+	if o.Cursor != "" {
+		if start, err = decodeCursor(o.Cursor); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return start, low, high, nil
+}
+
+// filterRecord decodes the fields of a post the filters of a listing need.
+type filterRecord struct {
+	Disabled  bool      `json:"disabled"`
+	Uploader  string    `json:"uploader"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// matches applies the filters that need the post itself.
+func (o ListOptions) matches(p Post) bool {
+	if p.Picture != nil {
+		return o.matchesRecord(filterRecord{p.Picture.Disabled, p.Picture.Uploader, p.Picture.DeletedAt})
+	}
+	return o.matchesRecord(filterRecord{p.Instagram.Disabled, p.Instagram.Uploader, p.Instagram.DeletedAt})
+}
+
+func (o ListOptions) matchesRecord(f filterRecord) bool {
+	if o.Trashed == f.DeletedAt.IsZero() {
+		return false
+	}
+	if o.Disabled != nil && *o.Disabled != f.Disabled {
+		return false
+	}
+	if o.Uploader != "" && !strings.EqualFold(o.Uploader, f.Uploader) {
+		return false
+	}
+	return true
+}
+
+// before reports whether key a comes before b in the order of the listing.
+func (o ListOptions) before(a, b []byte) bool {
+	if o.Ascending {
+		return bytes.Compare(a, b) < 0
+	}
+	return bytes.Compare(a, b) > 0
+}
+
+// inRange reports whether k lies within low and high.
+func inRange(k, low, high []byte) bool {
+	return bytes.Compare(k, low) >= 0 && bytes.Compare(k, high) <= 0
+}
@@ -0,0 +1,304 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps all records in process memory. Records are held encoded, like
+// in Bolt, so callers never share values with the store.
+type Memory struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *Memory) Ping() error {
+	return nil
+}
+
+func (s *Memory) Close() error {
+	return nil
+}
+
+func (s *Memory) put(bucket []byte, key string, v interface{}) error {
+	buf, err := encodeRecord(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[string(bucket)]
+	if !ok {
+		b = make(map[string][]byte)
+		s.buckets[string(bucket)] = b
+	}
+	b[key] = buf
+	return nil
+}
+
+func (s *Memory) get(bucket []byte, key string, v interface{}) error {
+	s.mu.RLock()
+	raw, ok := s.buckets[string(bucket)][key]
+	s.mu.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return decodeRecord(raw, v)
+}
+
+// forEach calls f with every record of the bucket in key order.
+func (s *Memory) forEach(bucket []byte, f func(k, v []byte)) {
+	s.mu.RLock()
+	b := s.buckets[string(bucket)]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	values := make([][]byte, len(keys))
+	sort.Strings(keys)
+	for i, k := range keys {
+		values[i] = b[k]
+	}
+	s.mu.RUnlock()
+
+	for i, v := range values {
+		f([]byte(keys[i]), v)
+	}
+}
+
+func (s *Memory) delete(bucket []byte, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[string(bucket)], key)
+}
+
+func (s *Memory) InsertPicture(p *models.Picture) error {
+	return s.putPicture(p, false)
+}
+
+func (s *Memory) UpdatePicture(p *models.Picture) error {
+	return s.putPicture(p, true)
+}
+
+func (s *Memory) GetPicture(id uuid.UUID) (*models.Picture, error) {
+	p := &models.Picture{}
+	if err := s.get(bucketPics, id.String(), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *Memory) GetPictures() ([]models.Picture, error) {
+	list := make([]models.Picture, 0)
+	s.forEach(bucketPics, func(k, v []byte) {
+		var p = models.Picture{}
+		if err := decodeRecord(v, &p); err != nil {
+			warnUndecodable(bucketPics, k, err)
+			return
+		}
+		list = append(list, p)
+	})
+	return list, nil
+}
+
+func (s *Memory) DeletePicture(id uuid.UUID) error {
+	s.delete(bucketPics, id.String())
+	return nil
+}
+
+func (s *Memory) InsertInstagram(i *models.Instagram) error {
+	return s.putVersioned(bucketInsta, i.Id.String(), i, &i.Version, false)
+}
+
+func (s *Memory) UpdateInstagram(i *models.Instagram) error {
+	return s.putVersioned(bucketInsta, i.Id.String(), i, &i.Version, true)
+}
+
+func (s *Memory) GetInstagram(id uuid.UUID) (*models.Instagram, error) {
+	i := &models.Instagram{}
+	if err := s.get(bucketInsta, id.String(), i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (s *Memory) GetInstagrams() ([]models.Instagram, error) {
+	list := make([]models.Instagram, 0)
+	s.forEach(bucketInsta, func(k, v []byte) {
+		var i = models.Instagram{}
+		if err := decodeRecord(v, &i); err != nil {
+			warnUndecodable(bucketInsta, k, err)
+			return
+		}
+		list = append(list, i)
+	})
+	return list, nil
+}
+
+func (s *Memory) DeleteInstagram(id uuid.UUID) error {
+	s.delete(bucketInsta, id.String())
+	return nil
+}
+
+func (s *Memory) ListPosts(o ListOptions) ([]Post, string, error) {
+	start, low, high, err := o.bounds()
+	if err != nil {
+		return nil, "", err
+	}
+
+	posts := make([]Post, 0)
+	if o.includes(TypePicture) {
+		pics, _ := s.GetPictures()
+		for i := range pics {
+			posts = append(posts, Post{Picture: &pics[i]})
+		}
+	}
+	if o.includes(TypeInstagram) {
+		inst, _ := s.GetInstagrams()
+		for i := range inst {
+			posts = append(posts, Post{Instagram: &inst[i]})
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return o.before(posts[i].key(), posts[j].key())
+	})
+
+	list := make([]Post, 0)
+	for _, p := range posts {
+		k := p.key()
+		if !inRange(k, low, high) || (start != nil && !o.before(start, k)) {
+			continue
+		}
+		if o.Limit > 0 && len(list) == o.Limit {
+			return list, encodeCursor(list[len(list)-1].key()), nil
+		}
+		if o.matches(p) {
+			list = append(list, p)
+		}
+	}
+	return list, "", nil
+}
+
+func (s *Memory) InsertUser(u *models.User) error {
+	return s.put(bucketUsers, u.Id.String(), u)
+}
+
+func (s *Memory) UpdateUser(u *models.User) error {
+	return s.put(bucketUsers, u.Id.String(), u)
+}
+
+func (s *Memory) GetUser(id uuid.UUID) (*models.User, error) {
+	u := &models.User{}
+	if err := s.get(bucketUsers, id.String(), u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Memory) GetUserByName(name string) (*models.User, error) {
+	users, _ := s.GetUsers()
+	for i := range users {
+		if strings.EqualFold(users[i].Name, name) {
+			return &users[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *Memory) GetUsers() ([]models.User, error) {
+	list := make([]models.User, 0)
+	s.forEach(bucketUsers, func(k, v []byte) {
+		var u = models.User{}
+		if err := decodeRecord(v, &u); err != nil {
+			warnUndecodable(bucketUsers, k, err)
+			return
+		}
+		list = append(list, u)
+	})
+	return list, nil
+}
+
+func (s *Memory) DeleteUser(id uuid.UUID) error {
+	s.delete(bucketUsers, id.String())
+	return nil
+}
+
+func (s *Memory) InsertSession(sess *models.Session) error {
+	return s.put(bucketSessions, sess.Token, sess)
+}
+
+func (s *Memory) GetSession(token string) (*models.Session, error) {
+	x := &models.Session{}
+	if err := s.get(bucketSessions, token, x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (s *Memory) DeleteSession(token string) error {
+	s.delete(bucketSessions, token)
+	return nil
+}
+
+func (s *Memory) DeleteExpiredSessions(t time.Time) error {
+	s.deleteSessionsWhere(func(x models.Session) bool {
+		return x.Expires.Before(t)
+	})
+	return nil
+}
+
+func (s *Memory) DeleteUserSessions(id uuid.UUID) error {
+	s.deleteSessionsWhere(func(x models.Session) bool {
+		return x.UserId == id
+	})
+	return nil
+}
+
+func (s *Memory) deleteSessionsWhere(match func(x models.Session) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[string(bucketSessions)]
+	for k, v := range b {
+		var x = models.Session{}
+		if err := decodeRecord(v, &x); err != nil || match(x) {
+			delete(b, k)
+		}
+	}
+}
+
+func (s *Memory) InsertApiKey(k *models.ApiKey) error {
+	return s.put(bucketApiKeys, k.Id.String(), k)
+}
+
+func (s *Memory) UpdateApiKey(k *models.ApiKey) error {
+	return s.put(bucketApiKeys, k.Id.String(), k)
+}
+
+func (s *Memory) GetApiKey(id uuid.UUID) (*models.ApiKey, error) {
+	k := &models.ApiKey{}
+	if err := s.get(bucketApiKeys, id.String(), k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (s *Memory) GetApiKeys() ([]models.ApiKey, error) {
+	list := make([]models.ApiKey, 0)
+	s.forEach(bucketApiKeys, func(k, v []byte) {
+		var a = models.ApiKey{}
+		if err := decodeRecord(v, &a); err != nil {
+			warnUndecodable(bucketApiKeys, k, err)
+			return
+		}
+		list = append(list, a)
+	})
+	return list, nil
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/rs/zerolog/log"
+	"strconv"
+)
+
+var (
+	bucketMeta = []byte("meta")
+	keySchema  = []byte("schema")
+
+	// dataBuckets are the buckets holding versioned records.
+	dataBuckets = [][]byte{bucketPics, bucketInsta, bucketUsers, bucketSessions, bucketApiKeys, bucketRevisions}
+)
+
+// migration upgrades records to its version from the version before.
+type migration struct {
+	version     int
+	description string
+	// buckets the migration applies to, all data buckets if empty.
+	buckets [][]byte
+	// migrate converts the data of one record, nil if only the envelope
+	// changes.
+	migrate func(data json.RawMessage) (json.RawMessage, error)
+	// update runs once after all records were migrated, e.g. to build an
+	// index.
+	update func(tx *bolt.Tx) error
+}
+
+// migrations is the registry of all migrations ordered by version, the last
+// one has to match SchemaVersion.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "wrap records in a versioned envelope",
+	},
+	{
+		version:     2,
+		description: "index pictures and instagram posts by upload time",
+		update:      rebuildUploadIndexes,
+	},
+	// The hash is computed from the decoded upload, which the store never
+	// sees, so only pictures that already have one are indexed. Pictures
+	// uploaded before hashes were introduced keep an empty hash and aren't
+	// recognized as duplicates, the duplicate check covers new uploads only.
+	// Pictures in the trash aren't indexed either, see bucketPicsHash.
+	{
+		version:     3,
+		description: "index pictures by content hash",
+		buckets:     [][]byte{bucketPics},
+		update:      rebuildHashIndex,
+	},
+}
+
+func (m migration) appliesTo(bucket []byte) bool {
+	if len(m.buckets) == 0 {
+		return true
+	}
+	for _, b := range m.buckets {
+		if bytes.Equal(b, bucket) {
+			return true
+		}
+	}
+	return false
+}
+
+// migrate upgrades all records to SchemaVersion in a single transaction. It
+// fails if the database or any record was written by a newer version. Records
+// that can't be decoded or migrated are logged and left untouched.
+func (s *Bolt) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return fmt.Errorf("create bucket %s", err)
+		}
+
+		dbVersion := 0
+		if v := meta.Get(keySchema); v != nil {
+			if dbVersion, err = strconv.Atoi(string(v)); err != nil {
+				return fmt.Errorf("invalid schema version %q", v)
+			}
+		}
+		if dbVersion > SchemaVersion {
+			return fmt.Errorf("database has schema %d, this build supports up to %d", dbVersion, SchemaVersion)
+		}
+
+		for _, name := range dataBuckets {
+			b := tx.Bucket(name)
+			if b == nil {
+				continue
+			}
+			if err := migrateBucket(b, name); err != nil {
+				return err
+			}
+		}
+
+		if dbVersion < SchemaVersion {
+			for _, m := range migrations {
+				if m.version <= dbVersion {
+					continue
+				}
+				if m.update != nil {
+					if err := m.update(tx); err != nil {
+						return fmt.Errorf("migration %d: %w", m.version, err)
+					}
+				}
+				log.Info().Int("schema", m.version).Msgf("applied migration: %s", m.description)
+			}
+		}
+		return meta.Put(keySchema, []byte(strconv.Itoa(SchemaVersion)))
+	})
+}
+
+func migrateBucket(b *bolt.Bucket, name []byte) error {
+	updates := make(map[string][]byte)
+	migrated, failed := 0, 0
+
+	err := b.ForEach(func(k, v []byte) error {
+		version, data, err := readRecord(v)
+		if err != nil {
+			failed++
+			log.Warn().Str("bucket", string(name)).Hex("key", k).Err(err).
+				Msg("undecodable record, left as is")
+			return nil
+		}
+		if version > SchemaVersion {
+			return fmt.Errorf("record %x in %s has schema %d, this build supports up to %d",
+				k, name, version, SchemaVersion)
+		}
+		if version == SchemaVersion {
+			return nil
+		}
+
+		for _, m := range migrations {
+			if m.version <= version || m.migrate == nil || !m.appliesTo(name) {
+				continue
+			}
+			if data, err = m.migrate(data); err != nil {
+				failed++
+				log.Warn().Str("bucket", string(name)).Hex("key", k).Int("schema", m.version).Err(err).
+					Msg("migration failed, record left as is")
+				return nil
+			}
+		}
+
+		buf, err := json.Marshal(record{Schema: SchemaVersion, Data: data})
+		if err != nil {
+			return err
+		}
+		updates[string(k)] = buf
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, v := range updates {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+		migrated++
+	}
+	if migrated > 0 || failed > 0 {
+		log.Info().Str("bucket", string(name)).Int("migrated", migrated).Int("failed", failed).
+			Int("schema", SchemaVersion).Msg("migrated records")
+	}
+	return nil
+}
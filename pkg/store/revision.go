@@ -0,0 +1,279 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"strings"
+)
+
+// bucketRevisions holds the revisions of all posts, the key is the post id
+// followed by the revision number, so the revisions of a post are adjacent
+// and in order.
+var bucketRevisions = []byte("revisions")
+
+func revisionKey(postId uuid.UUID, number int) []byte {
+	k := make([]byte, 20)
+	copy(k, helper.UUIDtoBytes(postId))
+	binary.BigEndian.PutUint32(k[16:], uint32(number))
+	return k
+}
+
+// AddRevision stores rev as the next revision of its post and sets its
+// number, numbers start at 1.
+func (s *Bolt) AddRevision(rev *models.Revision) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketRevisions)
+		if err != nil {
+			return fmt.Errorf("create bucket %s", err)
+		}
+		return putRevision(b, rev, lastRevision(b, rev.PostId)+1)
+	})
+}
+
+// UpdateWithRevision updates the post p and adds rev in one transaction, see
+// RevisionStore.
+func (s *Bolt) UpdateWithRevision(p Post, original, rev *models.Revision) error {
+	version := p.version()
+	prev := *version
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if p.Picture != nil {
+			err = putPictureTx(tx, p.Picture, true)
+		} else {
+			err = putInstagramTx(tx, p.Instagram, true)
+		}
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(bucketRevisions)
+		if err != nil {
+			return fmt.Errorf("create bucket %s", err)
+		}
+		last := lastRevision(b, rev.PostId)
+		if original != nil && last == 0 {
+			last++
+			if err := putRevision(b, original, last); err != nil {
+				return err
+			}
+		}
+		return putRevision(b, rev, last+1)
+	})
+	if err != nil {
+		*version = prev
+	}
+	return err
+}
+
+// lastRevision returns the number of the latest revision of the post in b, 0
+// if it has none.
+func lastRevision(b *bolt.Bucket, postId uuid.UUID) int {
+	c := b.Cursor()
+	k, _ := c.Seek(revisionKey(postId, 1<<32-1))
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	if k == nil || !bytes.HasPrefix(k, helper.UUIDtoBytes(postId)) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(k[16:]))
+}
+
+// putRevision stores rev with number in b.
+func putRevision(b *bolt.Bucket, rev *models.Revision, number int) error {
+	rev.Number = number
+	buf, err := encodeRecord(rev)
+	if err != nil {
+		return err
+	}
+	return b.Put(revisionKey(rev.PostId, rev.Number), buf)
+}
+
+// GetRevisions returns the revisions of a post, oldest first.
+func (s *Bolt) GetRevisions(postId uuid.UUID) ([]models.Revision, error) {
+	list := make([]models.Revision, 0)
+	prefix := helper.UUIDtoBytes(postId)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRevisions)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var rev models.Revision
+			if err := decodeRecord(v, &rev); err != nil {
+				warnUndecodable(bucketRevisions, k, err)
+				continue
+			}
+			list = append(list, rev)
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (s *Bolt) GetRevision(postId uuid.UUID, number int) (*models.Revision, error) {
+	if number < 1 {
+		return nil, ErrNotFound
+	}
+	rev := &models.Revision{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRevisions)
+		if b == nil {
+			return ErrNotFound
+		}
+		raw := b.Get(revisionKey(postId, number))
+		if raw == nil {
+			return ErrNotFound
+		}
+		return decodeRecord(raw, rev)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// DeleteRevisions removes all revisions of a post.
+func (s *Bolt) DeleteRevisions(postId uuid.UUID) error {
+	prefix := helper.UUIDtoBytes(postId)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRevisions)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// memRevisionKey is the key of a revision in Memory, the padded number keeps
+// the revisions of a post in order.
+func memRevisionKey(postId uuid.UUID, number int) string {
+	return fmt.Sprintf("%s/%010d", postId, number)
+}
+
+func (s *Memory) AddRevision(rev *models.Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rev.Number = s.lastRevisionLocked(rev.PostId) + 1
+	buf, err := encodeRecord(rev)
+	if err != nil {
+		return err
+	}
+	s.revisionsLocked()[memRevisionKey(rev.PostId, rev.Number)] = buf
+	return nil
+}
+
+// UpdateWithRevision updates the post p and adds rev under one lock, see
+// RevisionStore. The revisions are encoded first, so nothing is stored if
+// that fails.
+func (s *Memory) UpdateWithRevision(p Post, original, rev *models.Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revs := []*models.Revision{rev}
+	last := s.lastRevisionLocked(rev.PostId)
+	if original != nil && last == 0 {
+		revs = []*models.Revision{original, rev}
+	}
+	bufs := make(map[string][]byte, len(revs))
+	for _, r := range revs {
+		last++
+		r.Number = last
+		buf, err := encodeRecord(r)
+		if err != nil {
+			return err
+		}
+		bufs[memRevisionKey(r.PostId, r.Number)] = buf
+	}
+
+	var err error
+	if p.Picture != nil {
+		err = s.putPictureLocked(p.Picture, true)
+	} else {
+		err = s.putVersionedLocked(bucketInsta, p.Instagram.Id.String(), p.Instagram, &p.Instagram.Version, true)
+	}
+	if err != nil {
+		return err
+	}
+	b := s.revisionsLocked()
+	for k, v := range bufs {
+		b[k] = v
+	}
+	return nil
+}
+
+// revisionsLocked returns the revision bucket, the caller holds mu.
+func (s *Memory) revisionsLocked() map[string][]byte {
+	b, ok := s.buckets[string(bucketRevisions)]
+	if !ok {
+		b = make(map[string][]byte)
+		s.buckets[string(bucketRevisions)] = b
+	}
+	return b
+}
+
+// lastRevisionLocked returns the number of the latest revision of the post,
+// 0 if it has none. The caller holds mu.
+func (s *Memory) lastRevisionLocked(postId uuid.UUID) int {
+	prefix := postId.String() + "/"
+	last := 0
+	for k := range s.buckets[string(bucketRevisions)] {
+		var n int
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if _, err := fmt.Sscanf(k[len(prefix):], "%d", &n); err == nil && n > last {
+			last = n
+		}
+	}
+	return last
+}
+
+func (s *Memory) GetRevisions(postId uuid.UUID) ([]models.Revision, error) {
+	list := make([]models.Revision, 0)
+	prefix := postId.String() + "/"
+	s.forEach(bucketRevisions, func(k, v []byte) {
+		if !strings.HasPrefix(string(k), prefix) {
+			return
+		}
+		var rev models.Revision
+		if err := decodeRecord(v, &rev); err != nil {
+			warnUndecodable(bucketRevisions, k, err)
+			return
+		}
+		list = append(list, rev)
+	})
+	return list, nil
+}
+
+func (s *Memory) GetRevision(postId uuid.UUID, number int) (*models.Revision, error) {
+	rev := &models.Revision{}
+	if err := s.get(bucketRevisions, memRevisionKey(postId, number), rev); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+func (s *Memory) DeleteRevisions(postId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[string(bucketRevisions)]
+	for k := range b {
+		if strings.HasPrefix(k, postId.String()+"/") {
+			delete(b, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+)
+
+// SchemaVersion is the version of the record format written by this build,
+// it has to be raised together with a new entry in migrations.
+const SchemaVersion = 3
+
+// record wraps every stored entity with the schema version it was written
+// with. Records written before versioning was introduced are plain JSON
+// objects without envelope and count as version 0.
+type record struct {
+	Schema int             `json:"schema"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func encodeRecord(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(record{Schema: SchemaVersion, Data: data})
+}
+
+func decodeRecord(raw []byte, v interface{}) error {
+	var r record
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return err
+	}
+	if r.Schema != SchemaVersion {
+		return fmt.Errorf("record has schema %d, expected %d", r.Schema, SchemaVersion)
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+// readRecord returns the schema version and the data of raw, which may be a
+// record of any version.
+func readRecord(raw []byte) (int, json.RawMessage, error) {
+	var r record
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return 0, nil, err
+	}
+	if r.Schema == 0 {
+		return 0, raw, nil
+	}
+	return r.Schema, r.Data, nil
+}
+
+// warnUndecodable logs a record that is left out of a result because it
+// can't be decoded, the record itself stays in the store.
+func warnUndecodable(bucket, key []byte, err error) {
+	log.Warn().
+		Str("bucket", string(bucket)).
+		Hex("key", key).
+		Err(err).
+		Msg("skipping undecodable record")
+}
@@ -0,0 +1,129 @@
+// Package store persists pictures, Instagram posts with their revisions,
+// users, sessions and api keys. Bolt is the implementation used by the server,
+// Memory keeps everything in process memory and is meant for tests.
+package store
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when a requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned by updates of a post that was changed since it was
+// read.
+var ErrConflict = errors.New("changed concurrently")
+
+// ErrDuplicate is returned when a picture has the same content hash as
+// another one.
+var ErrDuplicate = errors.New("duplicate content")
+
+// PictureStore and InstagramStore version every post. Insert stores a post
+// with the next version, replacing a stored one. Update fails with
+// ErrConflict unless the stored post still has the version of p, which then
+// is incremented.
+type PictureStore interface {
+	InsertPicture(p *models.Picture) error
+	UpdatePicture(p *models.Picture) error
+	GetPicture(id uuid.UUID) (*models.Picture, error)
+	GetPictures() ([]models.Picture, error)
+	DeletePicture(id uuid.UUID) error
+	// GetPictureByHash returns the picture whose content has the hash.
+	GetPictureByHash(hash string) (*models.Picture, error)
+}
+
+type InstagramStore interface {
+	InsertInstagram(i *models.Instagram) error
+	UpdateInstagram(i *models.Instagram) error
+	GetInstagram(id uuid.UUID) (*models.Instagram, error)
+	GetInstagrams() ([]models.Instagram, error)
+	DeleteInstagram(id uuid.UUID) error
+}
+
+// PostStore lists pictures and Instagram posts together.
+type PostStore interface {
+	// ListPosts returns a page of posts and the cursor of the next page,
+	// the cursor is empty on the last page.
+	ListPosts(o ListOptions) ([]Post, string, error)
+}
+
+// RevisionStore keeps the history of changes of posts.
+type RevisionStore interface {
+	// AddRevision stores rev as the next revision of its post and sets its
+	// number.
+	AddRevision(rev *models.Revision) error
+	// GetRevisions returns the revisions of a post, oldest first.
+	GetRevisions(postId uuid.UUID) ([]models.Revision, error)
+	GetRevision(postId uuid.UUID, number int) (*models.Revision, error)
+	// DeleteRevisions removes all revisions of a post.
+	DeleteRevisions(postId uuid.UUID) error
+	// UpdateWithRevision updates the post p like UpdatePicture or
+	// UpdateInstagram and adds rev as its next revision, either both are
+	// stored or neither. If the post has no revisions yet, original is
+	// added before rev, so the state before the first change is kept too.
+	UpdateWithRevision(p Post, original, rev *models.Revision) error
+}
+
+type UserStore interface {
+	InsertUser(u *models.User) error
+	UpdateUser(u *models.User) error
+	GetUser(id uuid.UUID) (*models.User, error)
+	// GetUserByName looks up a user by name, ignoring case.
+	GetUserByName(name string) (*models.User, error)
+	GetUsers() ([]models.User, error)
+	DeleteUser(id uuid.UUID) error
+}
+
+type SessionStore interface {
+	InsertSession(sess *models.Session) error
+	GetSession(token string) (*models.Session, error)
+	DeleteSession(token string) error
+	// DeleteExpiredSessions removes all sessions that expired before t.
+	DeleteExpiredSessions(t time.Time) error
+	// DeleteUserSessions removes all sessions of the given user.
+	DeleteUserSessions(id uuid.UUID) error
+}
+
+type ApiKeyStore interface {
+	InsertApiKey(k *models.ApiKey) error
+	UpdateApiKey(k *models.ApiKey) error
+	GetApiKey(id uuid.UUID) (*models.ApiKey, error)
+	GetApiKeys() ([]models.ApiKey, error)
+}
+
+// Checker verifies the stored records.
+type Checker interface {
+	// CheckRecords reports every record that can't be used, it never
+	// changes the store.
+	CheckRecords() ([]RecordError, error)
+	// RepairIndexes rebuilds all secondary indexes from the records.
+	RepairIndexes() error
+}
+
+// Store combines the stores of all entities.
+type Store interface {
+	PictureStore
+	InstagramStore
+	PostStore
+	RevisionStore
+	UserStore
+	SessionStore
+	ApiKeyStore
+	Checker
+
+	// Ping reports whether the store is usable.
+	Ping() error
+	Close() error
+}
+
+// Backuper is implemented by stores that can take a consistent snapshot while
+// they are in use.
+type Backuper interface {
+	// Backup calls f with the size and the contents of a snapshot, the
+	// snapshot is only valid until f returns.
+	Backup(f func(size int64, snapshot io.WriterTo) error) error
+}
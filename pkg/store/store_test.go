@@ -0,0 +1,493 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/rverst/bwof-backend/pkg/models"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stores returns a constructor of each implementation, the stores are closed
+// and removed when the test ends.
+func stores() map[string]func(t *testing.T) Store {
+	return map[string]func(t *testing.T) Store{
+		"Memory": func(t *testing.T) Store {
+			return NewMemory()
+		},
+		"Bolt": func(t *testing.T) Store {
+			dir, err := ioutil.TempDir("", "bwof-store-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = os.RemoveAll(dir) })
+			s, err := OpenBolt(filepath.Join(dir, "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = s.Close() })
+			return s
+		},
+	}
+}
+
+// runContract runs f against every implementation and checks that the
+// indexes are consistent afterwards.
+func runContract(t *testing.T, f func(t *testing.T, s Store)) {
+	for name, open := range stores() {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			f(t, s)
+			errs, err := s.CheckRecords()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(errs) > 0 {
+				t.Errorf("CheckRecords: got %+v, want none", errs)
+			}
+		})
+	}
+}
+
+var epoch = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func newPicture(uploaded time.Time, hash string) *models.Picture {
+	return &models.Picture{Id: uuid.New(), Uploaded: uploaded, Hash: hash, Uploader: "alice"}
+}
+
+func newInstagram(uploaded time.Time) *models.Instagram {
+	return &models.Instagram{Id: uuid.New(), Uploaded: uploaded, Uploader: "bob"}
+}
+
+func TestStoreVersions(t *testing.T) {
+	runContract(t, func(t *testing.T, s Store) {
+		p := newPicture(epoch, "")
+		if err := s.UpdatePicture(p); err != ErrNotFound {
+			t.Errorf("update of missing picture: got %v, want ErrNotFound", err)
+		}
+		if err := s.InsertPicture(p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Version != 1 {
+			t.Errorf("version after insert: got %d, want 1", p.Version)
+		}
+
+		stale := *p
+		p.Content.Text = "changed"
+		if err := s.UpdatePicture(p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Version != 2 {
+			t.Errorf("version after update: got %d, want 2", p.Version)
+		}
+		if err := s.UpdatePicture(&stale); err != ErrConflict {
+			t.Errorf("update of stale picture: got %v, want ErrConflict", err)
+		}
+		if stale.Version != 1 {
+			t.Errorf("version after failed update: got %d, want 1", stale.Version)
+		}
+		got, err := s.GetPicture(p.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != 2 || got.Content.Text != "changed" {
+			t.Errorf("stored picture: got version %d text %q, want 2 changed", got.Version, got.Content.Text)
+		}
+
+		// insert replaces a stored post and continues its versions
+		if err := s.InsertPicture(&stale); err != nil {
+			t.Fatal(err)
+		}
+		if stale.Version != 3 {
+			t.Errorf("version after insert over stored picture: got %d, want 3", stale.Version)
+		}
+
+		i := newInstagram(epoch)
+		if err := s.InsertInstagram(i); err != nil {
+			t.Fatal(err)
+		}
+		old := *i
+		if err := s.UpdateInstagram(i); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateInstagram(&old); err != ErrConflict {
+			t.Errorf("update of stale instagram post: got %v, want ErrConflict", err)
+		}
+		if got, err := s.GetInstagram(i.Id); err != nil || got.Version != 2 {
+			t.Errorf("stored instagram post: got %+v %v, want version 2", got, err)
+		}
+	})
+}
+
+func TestStoreHashIndex(t *testing.T) {
+	runContract(t, func(t *testing.T, s Store) {
+		if _, err := s.GetPictureByHash(""); err != ErrNotFound {
+			t.Errorf("empty hash: got %v, want ErrNotFound", err)
+		}
+		a := newPicture(epoch, "aaa")
+		if err := s.InsertPicture(a); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetPictureByHash("aaa"); err != nil || got.Id != a.Id {
+			t.Fatalf("by hash: got %+v %v, want %s", got, err, a.Id)
+		}
+
+		b := newPicture(epoch.Add(time.Minute), "aaa")
+		if err := s.InsertPicture(b); err != ErrDuplicate {
+			t.Errorf("insert of duplicate: got %v, want ErrDuplicate", err)
+		}
+		if _, err := s.GetPicture(b.Id); err != ErrNotFound {
+			t.Errorf("rejected duplicate was stored: %v", err)
+		}
+		b.Hash = "bbb"
+		if err := s.InsertPicture(b); err != nil {
+			t.Fatal(err)
+		}
+		b.Hash = "aaa"
+		if err := s.UpdatePicture(b); err != ErrDuplicate {
+			t.Errorf("update to duplicate: got %v, want ErrDuplicate", err)
+		}
+
+		// a picture keeps its own hash on updates and frees the old one
+		// when it changes
+		a.Content.Text = "changed"
+		if err := s.UpdatePicture(a); err != nil {
+			t.Fatalf("update keeping the hash: %v", err)
+		}
+		a.Hash = "ccc"
+		if err := s.UpdatePicture(a); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetPictureByHash("aaa"); err != ErrNotFound {
+			t.Errorf("old hash after change: got %v, want ErrNotFound", err)
+		}
+		if got, err := s.GetPictureByHash("ccc"); err != nil || got.Id != a.Id {
+			t.Errorf("new hash after change: got %+v %v, want %s", got, err, a.Id)
+		}
+
+		if err := s.DeletePicture(b.Id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetPictureByHash("bbb"); err != ErrNotFound {
+			t.Errorf("hash of deleted picture: got %v, want ErrNotFound", err)
+		}
+		c := newPicture(epoch, "bbb")
+		if err := s.InsertPicture(c); err != nil {
+			t.Errorf("insert with the hash of a deleted picture: %v", err)
+		}
+
+		// a picture in the trash doesn't block its content and can't be
+		// restored while another picture has it
+		c.DeletedAt = epoch
+		if err := s.UpdatePicture(c); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetPictureByHash("bbb"); err != ErrNotFound {
+			t.Errorf("hash of trashed picture: got %v, want ErrNotFound", err)
+		}
+		d := newPicture(epoch, "bbb")
+		if err := s.InsertPicture(d); err != nil {
+			t.Errorf("insert with the hash of a trashed picture: %v", err)
+		}
+		c.DeletedAt = time.Time{}
+		if err := s.UpdatePicture(c); err != ErrDuplicate {
+			t.Errorf("restore of duplicate: got %v, want ErrDuplicate", err)
+		}
+		if got, err := s.GetPictureByHash("bbb"); err != nil || got.Id != d.Id {
+			t.Errorf("hash after failed restore: got %+v %v, want %s", got, err, d.Id)
+		}
+
+		// rebuilding the index, as migration 3 does, leaves trashed pictures
+		// out too
+		if err := s.DeletePicture(d.Id); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RepairIndexes(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetPictureByHash("bbb"); err != ErrNotFound {
+			t.Errorf("hash of trashed picture after rebuild: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreRevisions(t *testing.T) {
+	runContract(t, func(t *testing.T, s Store) {
+		a, b := uuid.New(), uuid.New()
+		if list, err := s.GetRevisions(a); err != nil || len(list) != 0 {
+			t.Errorf("revisions of new post: got %+v %v, want none", list, err)
+		}
+
+		// more than 9 revisions, so ordering by number and not by text
+		// is required
+		for n := 1; n <= 12; n++ {
+			for _, id := range []uuid.UUID{a, b} {
+				rev := &models.Revision{PostId: id, Action: models.RevisionContent, Created: epoch}
+				if err := s.AddRevision(rev); err != nil {
+					t.Fatal(err)
+				}
+				if rev.Number != n {
+					t.Fatalf("number of revision: got %d, want %d", rev.Number, n)
+				}
+			}
+		}
+
+		list, err := s.GetRevisions(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 12 {
+			t.Fatalf("revisions: got %d, want 12", len(list))
+		}
+		for i, rev := range list {
+			if rev.Number != i+1 || rev.PostId != a {
+				t.Errorf("revision %d: got number %d of %s", i, rev.Number, rev.PostId)
+			}
+		}
+		if rev, err := s.GetRevision(a, 10); err != nil || rev.Number != 10 {
+			t.Errorf("revision 10: got %+v %v", rev, err)
+		}
+		for _, n := range []int{0, 13} {
+			if _, err := s.GetRevision(a, n); err != ErrNotFound {
+				t.Errorf("revision %d: got %v, want ErrNotFound", n, err)
+			}
+		}
+
+		if err := s.DeleteRevisions(a); err != nil {
+			t.Fatal(err)
+		}
+		if list, _ := s.GetRevisions(a); len(list) != 0 {
+			t.Errorf("revisions after delete: got %d, want none", len(list))
+		}
+		if list, _ := s.GetRevisions(b); len(list) != 12 {
+			t.Errorf("revisions of other post after delete: got %d, want 12", len(list))
+		}
+		rev := &models.Revision{PostId: a}
+		if err := s.AddRevision(rev); err != nil || rev.Number != 1 {
+			t.Errorf("revision after delete: got number %d %v, want 1", rev.Number, err)
+		}
+	})
+}
+
+func TestStoreUpdateWithRevision(t *testing.T) {
+	runContract(t, func(t *testing.T, s Store) {
+		p := newPicture(epoch, "aaa")
+		i := newInstagram(epoch)
+		if err := s.InsertPicture(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.InsertInstagram(i); err != nil {
+			t.Fatal(err)
+		}
+		revision := func(id uuid.UUID, action string) *models.Revision {
+			return &models.Revision{PostId: id, Action: action, Created: epoch}
+		}
+		actions := func(id uuid.UUID) []string {
+			t.Helper()
+			revs, err := s.GetRevisions(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			list := make([]string, len(revs))
+			for n, rev := range revs {
+				list[n] = strconv.Itoa(rev.Number) + rev.Action
+			}
+			return list
+		}
+
+		// the original is only added before the first revision
+		for _, action := range []string{models.RevisionContent, models.RevisionDisable} {
+			p.Content.Text = action
+			if err := s.UpdateWithRevision(Post{Picture: p},
+				revision(p.Id, models.RevisionOriginal), revision(p.Id, action)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, err := s.GetPicture(p.Id); err != nil || got.Version != 3 || got.Content.Text != models.RevisionDisable {
+			t.Errorf("updated picture: got %+v %v, want version 3", got, err)
+		}
+		want := "1original,2content,3disable"
+		if got := strings.Join(actions(p.Id), ","); got != want {
+			t.Errorf("revisions: got %s, want %s", got, want)
+		}
+
+		// neither the post nor the revisions are stored if the update fails
+		stale := *i
+		if err := s.UpdateWithRevision(Post{Instagram: i}, nil, revision(i.Id, models.RevisionDisable)); err != nil {
+			t.Fatal(err)
+		}
+		stale.Disabled = true
+		err := s.UpdateWithRevision(Post{Instagram: &stale},
+			revision(i.Id, models.RevisionOriginal), revision(i.Id, models.RevisionDisable))
+		if err != ErrConflict || stale.Version != 1 {
+			t.Errorf("stale update: got %v version %d, want ErrConflict version 1", err, stale.Version)
+		}
+		if got := strings.Join(actions(i.Id), ","); got != "1disable" {
+			t.Errorf("revisions after failed update: got %s, want 1disable", got)
+		}
+		if got, err := s.GetInstagram(i.Id); err != nil || got.Disabled {
+			t.Errorf("instagram post after failed update: got %+v %v, want unchanged", got, err)
+		}
+
+		d := newPicture(epoch, "aaa")
+		d.Hash = "bbb"
+		if err := s.InsertPicture(d); err != nil {
+			t.Fatal(err)
+		}
+		d.Hash = "aaa"
+		if err := s.UpdateWithRevision(Post{Picture: d}, nil, revision(d.Id, models.RevisionContent)); err != ErrDuplicate {
+			t.Errorf("update to duplicate: got %v, want ErrDuplicate", err)
+		}
+		if got := actions(d.Id); len(got) != 0 {
+			t.Errorf("revisions after duplicate: got %v, want none", got)
+		}
+	})
+}
+
+// ids returns the ids of posts in order.
+func ids(posts []Post) []uuid.UUID {
+	list := make([]uuid.UUID, len(posts))
+	for i, p := range posts {
+		if p.Picture != nil {
+			list[i] = p.Picture.Id
+		} else {
+			list[i] = p.Instagram.Id
+		}
+	}
+	return list
+}
+
+func equalIds(a, b []uuid.UUID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStoreUploadIndex(t *testing.T) {
+	runContract(t, func(t *testing.T, s Store) {
+		// uploaded in the order of the slice, one before 1970
+		p1 := newPicture(time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC), "")
+		i1 := newInstagram(epoch)
+		p2 := newPicture(epoch.Add(time.Hour), "")
+		i2 := newInstagram(epoch.Add(2 * time.Hour))
+		p3 := newPicture(epoch.Add(3*time.Hour), "")
+		for _, p := range []*models.Picture{p3, p1, p2} {
+			if err := s.InsertPicture(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, i := range []*models.Instagram{i2, i1} {
+			if err := s.InsertInstagram(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		list := func(o ListOptions) ([]uuid.UUID, string) {
+			t.Helper()
+			posts, cursor, err := s.ListPosts(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ids(posts), cursor
+		}
+		all := []uuid.UUID{p3.Id, i2.Id, p2.Id, i1.Id, p1.Id}
+		if got, cursor := list(ListOptions{}); !equalIds(got, all) || cursor != "" {
+			t.Errorf("all posts: got %v %q, want %v", got, cursor, all)
+		}
+		asc := []uuid.UUID{p1.Id, i1.Id, p2.Id, i2.Id, p3.Id}
+		if got, _ := list(ListOptions{Ascending: true}); !equalIds(got, asc) {
+			t.Errorf("ascending: got %v, want %v", got, asc)
+		}
+		if got, _ := list(ListOptions{Type: TypePicture}); !equalIds(got, []uuid.UUID{p3.Id, p2.Id, p1.Id}) {
+			t.Errorf("pictures: got %v", got)
+		}
+		if got, _ := list(ListOptions{From: epoch, To: epoch.Add(2 * time.Hour)}); !equalIds(got, []uuid.UUID{i2.Id, p2.Id, i1.Id}) {
+			t.Errorf("from and to, inclusive: got %v", got)
+		}
+
+		var pages []uuid.UUID
+		o := ListOptions{Limit: 2}
+		for n := 0; ; n++ {
+			if n > 5 {
+				t.Fatal("pagination doesn't end")
+			}
+			page, cursor := list(o)
+			if len(page) > 2 {
+				t.Fatalf("page %d: got %d posts, want at most 2", n, len(page))
+			}
+			pages = append(pages, page...)
+			if cursor == "" {
+				break
+			}
+			o.Cursor = cursor
+		}
+		if !equalIds(pages, all) {
+			t.Errorf("pages: got %v, want %v", pages, all)
+		}
+		if _, _, err := s.ListPosts(ListOptions{Cursor: "nope"}); err != ErrInvalidCursor {
+			t.Errorf("invalid cursor: got %v, want ErrInvalidCursor", err)
+		}
+
+		// a changed upload time moves the post, trashed and deleted posts
+		// leave the listing
+		p1.Uploaded = epoch.Add(4 * time.Hour)
+		if err := s.UpdatePicture(p1); err != nil {
+			t.Fatal(err)
+		}
+		i2.DeletedAt = epoch
+		if err := s.UpdateInstagram(i2); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeletePicture(p2.Id); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := list(ListOptions{}); !equalIds(got, []uuid.UUID{p1.Id, p3.Id, i1.Id}) {
+			t.Errorf("after changes: got %v", got)
+		}
+		if got, _ := list(ListOptions{Trashed: true}); !equalIds(got, []uuid.UUID{i2.Id}) {
+			t.Errorf("trash: got %v", got)
+		}
+		if got, _ := list(ListOptions{Uploader: "ALICE"}); !equalIds(got, []uuid.UUID{p1.Id, p3.Id}) {
+			t.Errorf("uploader, ignoring case: got %v", got)
+		}
+	})
+}
+
+func TestStoreConcurrentDuplicates(t *testing.T) {
+	runContract(t, func(t *testing.T, s Store) {
+		const n = 8
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				errs <- s.InsertPicture(newPicture(epoch, "same"))
+			}()
+		}
+		stored := 0
+		for i := 0; i < n; i++ {
+			switch err := <-errs; err {
+			case nil:
+				stored++
+			case ErrDuplicate:
+			default:
+				t.Errorf("insert: %v", err)
+			}
+		}
+		if stored != 1 {
+			t.Errorf("concurrent inserts of the same hash: %d stored, want 1", stored)
+		}
+		if pics, _ := s.GetPictures(); len(pics) != 1 {
+			t.Errorf("pictures: got %d, want 1", len(pics))
+		}
+	})
+}
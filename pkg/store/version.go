@@ -0,0 +1,99 @@
+package store
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/rverst/bwof-backend/pkg/helper"
+	"github.com/rverst/bwof-backend/pkg/models"
+)
+
+// versionRecord decodes the version of a stored post.
+type versionRecord struct {
+	Version int `json:"version"`
+}
+
+// versionOf returns the version a post gets that replaces raw, the stored
+// record or nil. With update it fails with ErrNotFound if nothing is stored
+// and with ErrConflict if the stored version isn't version.
+func versionOf(raw []byte, version int, update bool) (int, error) {
+	if raw == nil {
+		if update {
+			return 0, ErrNotFound
+		}
+		return 1, nil
+	}
+	var r versionRecord
+	if err := decodeRecord(raw, &r); err != nil {
+		if update {
+			return 0, err
+		}
+		return 1, nil
+	}
+	if update && r.Version != version {
+		return 0, ErrConflict
+	}
+	return r.Version + 1, nil
+}
+
+// nextVersion is versionOf for the post stored under key in b, which may be
+// nil.
+func nextVersion(b *bolt.Bucket, key []byte, version int, update bool) (int, error) {
+	var raw []byte
+	if b != nil {
+		raw = b.Get(key)
+	}
+	return versionOf(raw, version, update)
+}
+
+// putInstagram stores i with the next version and moves its index entry if
+// the upload time changed.
+func (s *Bolt) putInstagram(i *models.Instagram, update bool) error {
+	prev := i.Version
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putInstagramTx(tx, i, update)
+	})
+	if err != nil {
+		i.Version = prev
+	}
+	return err
+}
+
+// putInstagramTx is putInstagram within tx, it sets the version of i also if
+// tx fails.
+func putInstagramTx(tx *bolt.Tx, i *models.Instagram, update bool) error {
+	key := helper.UUIDtoBytes(i.Id)
+	var err error
+	if i.Version, err = nextVersion(tx.Bucket(bucketInsta), key, i.Version, update); err != nil {
+		return err
+	}
+	return putPostTx(tx, bucketInsta, bucketInstaUploaded, key, uploadKey(i.Uploaded, i.Id), i)
+}
+
+// putVersioned stores the post v, whose version field is version, with the
+// next version.
+func (s *Memory) putVersioned(bucket []byte, key string, v interface{}, version *int, update bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putVersionedLocked(bucket, key, v, version, update)
+}
+
+// putVersionedLocked is putVersioned for callers that hold mu.
+func (s *Memory) putVersionedLocked(bucket []byte, key string, v interface{}, version *int, update bool) error {
+	b, ok := s.buckets[string(bucket)]
+	if !ok {
+		b = make(map[string][]byte)
+		s.buckets[string(bucket)] = b
+	}
+	next, err := versionOf(b[key], *version, update)
+	if err != nil {
+		return err
+	}
+	prev := *version
+	*version = next
+	buf, err := encodeRecord(v)
+	if err != nil {
+		*version = prev
+		return err
+	}
+	b[key] = buf
+	return nil
+}